@@ -0,0 +1,218 @@
+// Read-only analysis of the layers of an image, to help slimming it.
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/spf13/cobra"
+)
+
+// Prefixes of the whiteout entries hiding the files of lower layers.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Statuses of layers whose files are hidden by the layers above them.
+const (
+	layerShadowed       = "shadowed"
+	layerMostlyShadowed = "mostly shadowed"
+)
+
+var analyzeOutput string
+
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze <imagePath>",
+	Short: "analyze reports the layers whose files are overwritten or deleted by later layers",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		image, err := OpenImage(args[0], false, false)
+		if err != nil {
+			return err
+		}
+		layers, err := analyzeLayers(image)
+		if err != nil {
+			return err
+		}
+		return writeLayerAnalysis(cmd.OutOrStdout(), layers, analyzeOutput)
+	},
+}
+
+// LayerAnalysis is how much of a layer is still visible in the final image
+// filesystem. Only files count, directories are never shadowed.
+type LayerAnalysis struct {
+	Digest        string `json:"digest"`
+	Size          int    `json:"size"`
+	Files         int    `json:"files"`
+	Bytes         int64  `json:"bytes"`
+	ShadowedFiles int    `json:"shadowedFiles"`
+	ShadowedBytes int64  `json:"shadowedBytes"`
+	Status        string `json:"status,omitempty"`
+}
+
+// layerFile is a file of the effective filesystem, with the layer adding it.
+type layerFile struct {
+	layer int
+	size  int64
+}
+
+// layerShadows tracks the files of the effective filesystem while walking the
+// layers from the bottom up, charging the files hidden by a layer to the
+// layers below that added them.
+type layerShadows struct {
+	files  map[string]layerFile
+	dirs   map[string]bool
+	layers []LayerAnalysis
+}
+
+// shadow hides the file at name, or everything below it if it is a
+// directory, when added by a layer below layer.
+func (s *layerShadows) shadow(name string, layer int) {
+	if f, ok := s.files[name]; ok && f.layer < layer {
+		s.hide(name, f)
+	}
+	if s.dirs[name] {
+		s.shadowBelow(name, layer)
+	}
+}
+
+// shadowBelow hides everything below dir added by a layer below layer.
+func (s *layerShadows) shadowBelow(dir string, layer int) {
+	for file, f := range s.files {
+		if f.layer < layer && (dir == "" || strings.HasPrefix(file, dir+"/")) {
+			s.hide(file, f)
+		}
+	}
+}
+
+func (s *layerShadows) hide(name string, f layerFile) {
+	s.layers[f.layer].ShadowedFiles++
+	s.layers[f.layer].ShadowedBytes += f.size
+	delete(s.files, name)
+}
+
+// add applies a tar entry of the layer to the filesystem.
+func (s *layerShadows) add(header *tar.Header, layer int) {
+	name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+	dir, base := path.Dir(name), path.Base(name)
+	if dir == "." {
+		dir = ""
+	}
+	switch {
+	case base == whiteoutOpaque:
+		s.shadowBelow(dir, layer)
+	case strings.HasPrefix(base, whiteoutPrefix):
+		s.shadow(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), layer)
+	case header.Typeflag == tar.TypeDir:
+		// A directory replaces a lower file, but keeps what is below it.
+		if f, ok := s.files[name]; ok && f.layer < layer {
+			s.hide(name, f)
+		}
+		s.dirs[name] = true
+	default:
+		s.shadow(name, layer)
+		s.files[name] = layerFile{layer: layer, size: header.Size}
+		for parent := dir; parent != ""; parent = strings.TrimSuffix(path.Dir(parent), ".") {
+			s.dirs[parent] = true
+		}
+		s.layers[layer].Files++
+		s.layers[layer].Bytes += header.Size
+	}
+}
+
+// analyzeLayers walks the layers of the image, reporting how much of each of
+// them is hidden by the layers above.
+func analyzeLayers(i Image) ([]LayerAnalysis, error) {
+	s := layerShadows{files: map[string]layerFile{}, dirs: map[string]bool{}}
+	for _, layer := range i.Manifest.Layers {
+		s.layers = append(s.layers, LayerAnalysis{Digest: layer.Digest, Size: layer.Size})
+	}
+
+	for k, layer := range i.Manifest.Layers {
+		err := readLayerEntries(i.BlobPath(layer.Digest), func(header *tar.Header, _ io.Reader) error {
+			s.add(header, k)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	for k := range s.layers {
+		s.layers[k].Status = shadowStatus(s.layers[k])
+	}
+	return s.layers, nil
+}
+
+// shadowStatus flags layers with every file hidden, or with most of their
+// bytes hidden.
+func shadowStatus(l LayerAnalysis) string {
+	switch {
+	case l.Files > 0 && l.ShadowedFiles == l.Files:
+		return layerShadowed
+	case l.Bytes > 0 && l.ShadowedBytes*2 > l.Bytes:
+		return layerMostlyShadowed
+	}
+	return ""
+}
+
+// readLayerEntries calls fn with every entry of the layer tar, gzipped or not,
+// and a reader of its content, stopping at the first error.
+func readLayerEntries(layerPath string, fn func(*tar.Header, io.Reader) error) error {
+	in, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	buffered := bufio.NewReader(in)
+	var src io.Reader = buffered
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// writeLayerAnalysis writes the analysis as JSON or as a table.
+func writeLayerAnalysis(w io.Writer, layers []LayerAnalysis, output string) error {
+	if output == "json" {
+		_, err := fmt.Fprintln(w, json.MustToJSON(layers))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tFILES\tSHADOWED FILES\tSHADOWED BYTES\tSTATUS")
+	for _, l := range layers {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", l.Digest, units.BytesSize(float64(l.Size)), l.Files,
+			l.ShadowedFiles, units.BytesSize(float64(l.ShadowedBytes)), l.Status)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AnalyzeTestSuite struct {
+	suite.Suite
+}
+
+func (suite *AnalyzeTestSuite) TestDeletedFileShadowsLayer() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil,
+		testLayer{"opt/cache/data.bin": "large build cache"},
+		testLayer{"opt/cache/.wh.data.bin": "", "app": "binary"},
+	)
+
+	layers, err := analyzeLayers(image)
+	suite.Require().NoError(err)
+	suite.Require().Len(layers, 2)
+	suite.Equal(1, layers[0].ShadowedFiles)
+	suite.Equal(int64(len("large build cache")), layers[0].ShadowedBytes)
+	suite.Equal(layerShadowed, layers[0].Status)
+	suite.Equal(1, layers[1].Files)
+	suite.Equal(0, layers[1].ShadowedFiles)
+	suite.Empty(layers[1].Status)
+}
+
+func (suite *AnalyzeTestSuite) TestOverwrittenAndOpaqueDirs() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil,
+		testLayer{"etc/app.conf": "v1 config that is long", "bin/app": "b"},
+		testLayer{"etc/app.conf": "v2"},
+		testLayer{"etc/.wh..wh..opq": "", "etc/other.conf": "x"},
+	)
+
+	layers, err := analyzeLayers(image)
+	suite.Require().NoError(err)
+	suite.Equal(layerMostlyShadowed, layers[0].Status)
+	suite.Equal(1, layers[0].ShadowedFiles)
+	suite.Equal(layerShadowed, layers[1].Status)
+	suite.Empty(layers[2].Status)
+}
+
+func (suite *AnalyzeTestSuite) TestWriteLayerAnalysis() {
+	layers := []LayerAnalysis{{Digest: "sha256:base", Size: 2048, Files: 1, Bytes: 10, ShadowedFiles: 1, ShadowedBytes: 10, Status: layerShadowed}}
+
+	table := bytes.Buffer{}
+	suite.Require().NoError(writeLayerAnalysis(&table, layers, ""))
+	suite.Contains(table.String(), "sha256:base")
+	suite.Contains(table.String(), "shadowed")
+
+	out := bytes.Buffer{}
+	suite.Require().NoError(writeLayerAnalysis(&out, layers, "json"))
+	suite.Contains(out.String(), `"shadowedBytes": 10`)
+}
+
+func TestAnalyzeTestSuite(t *testing.T) {
+	suite.Run(t, new(AnalyzeTestSuite))
+}
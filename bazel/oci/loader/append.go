@@ -0,0 +1,121 @@
+// Extra layers added on top of the image at load time.
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// appendedLayer copies the layer tar at tarPath, gzipped or not, into
+// blobsDir, returning its descriptor and diff ID. The tar is read through to
+// check it is one.
+func appendedLayer(ctx context.Context, tarPath, blobsDir string) (Descriptor, string, error) {
+	in, err := os.Open(tarPath)
+	if err != nil {
+		return Descriptor{}, "", fmt.Errorf("error opening layer to append: %w", err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(blobsDir, "layer-*")
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// The digest covers the blob as is, the diff ID the uncompressed tar.
+	blobHash := sha256.New()
+	diffHash := sha256.New()
+	buffered := bufio.NewReader(io.TeeReader(in, io.MultiWriter(out, blobHash)))
+	magic, _ := buffered.Peek(2)
+
+	layer := Descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar"}
+	var src io.Reader = buffered
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return Descriptor{}, "", fmt.Errorf("error reading layer %s: %w", tarPath, err)
+		}
+		defer gz.Close()
+		layer.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+		src = gz
+	}
+	diff := io.TeeReader(src, diffHash)
+
+	tr := tar.NewReader(diff)
+	files := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Descriptor{}, "", fmt.Errorf("layer %s is not a tar: %w", tarPath, err)
+		}
+		files++
+	}
+	// Whatever follows the end of the archive is part of the blob too.
+	if _, err := io.Copy(io.Discard, diff); err != nil {
+		return Descriptor{}, "", fmt.Errorf("error reading layer %s: %w", tarPath, err)
+	}
+	if _, err := io.Copy(io.Discard, buffered); err != nil {
+		return Descriptor{}, "", fmt.Errorf("error reading layer %s: %w", tarPath, err)
+	}
+	if err := out.Close(); err != nil {
+		return Descriptor{}, "", err
+	}
+
+	layer.Digest = hashDigest(blobHash)
+	if info, err := os.Stat(out.Name()); err == nil {
+		layer.Size = int(info.Size())
+	}
+	if err := os.Rename(out.Name(), filepath.Join(blobsDir, strings.TrimPrefix(layer.Digest, "sha256:"))); err != nil {
+		return Descriptor{}, "", err
+	}
+	logger(ctx).Println("Appending layer", tarPath, "with", files, "files as", layer.Digest)
+	return layer, hashDigest(diffHash), nil
+}
+
+// appendLayers adds the layer tars on top of the image layers, in order,
+// writing them into blobsDir. It returns the config update adding their diff
+// IDs, and a history entry for each when the config has a history.
+func (i *Image) appendLayers(ctx context.Context, tarPaths []string, blobsDir string) (func(map[string]interface{}) error, error) {
+	diffIDs := []interface{}{}
+	history := []interface{}{}
+	// The layers are shared with the unmodified image.
+	i.Manifest.Layers = append([]Descriptor(nil), i.Manifest.Layers...)
+	for _, tarPath := range tarPaths {
+		layer, diffID, err := appendedLayer(ctx, tarPath, blobsDir)
+		if err != nil {
+			return nil, err
+		}
+		i.Manifest.Layers = append(i.Manifest.Layers, layer)
+		diffIDs = append(diffIDs, diffID)
+		history = append(history, map[string]interface{}{
+			"created_by": "loader --append-layer " + filepath.Base(tarPath),
+			"comment":    "appended at load time",
+		})
+	}
+	i.PreparedBlobsDir = blobsDir
+
+	return func(configData map[string]interface{}) error {
+		rootfs, ok := configData["rootfs"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config json missing rootfs key")
+		}
+		ids, _ := rootfs["diff_ids"].([]interface{})
+		rootfs["diff_ids"] = append(ids, diffIDs...)
+		if entries, ok := configData["history"].([]interface{}); ok {
+			configData["history"] = append(entries, history...)
+		}
+		return nil
+	}, nil
+}
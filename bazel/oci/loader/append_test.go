@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	encodingjson "encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AppendTestSuite struct {
+	suite.Suite
+	image Image
+}
+
+func (suite *AppendTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), map[string]interface{}{"Cmd": []string{"/app"}}, testLayer{"app": "binary"})
+}
+
+// writeLayer writes the layer as a tar file, gzipped if compress is set.
+func (suite *AppendTestSuite) writeLayer(layer testLayer, compress bool) string {
+	data := tarTestLayer(suite.T(), layer)
+	if compress {
+		buf := bytes.Buffer{}
+		gw := gzip.NewWriter(&buf)
+		_, err := gw.Write(data)
+		suite.Require().NoError(err)
+		suite.Require().NoError(gw.Close())
+		data = buf.Bytes()
+	}
+	path := filepath.Join(suite.T().TempDir(), "layer.tar")
+	suite.Require().NoError(os.WriteFile(path, data, 0o644))
+	return path
+}
+
+// tarFiles returns the names of the files in a layer, gzipped or not.
+func (suite *AppendTestSuite) tarFiles(data []byte) []string {
+	var r io.Reader = bytes.NewReader(data)
+	if gz, err := gzip.NewReader(bytes.NewReader(data)); err == nil {
+		r = gz
+	}
+	names := []string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		suite.Require().NoError(err)
+		names = append(names, header.Name)
+	}
+	return names
+}
+
+func (suite *AppendTestSuite) testAppendLayer(compress bool) {
+	layerPath := suite.writeLayer(testLayer{"usr/bin/busybox": "tools"}, compress)
+	image := suite.image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{AppendLayers: []string{layerPath}}
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+	suite.NotEqual(suite.image.Manifest.Config.Digest, image.Manifest.Config.Digest)
+	suite.Len(suite.image.Manifest.Layers, 1)
+
+	tarPath, err := builder.Build(context.Background(), image, BuildOpts{})
+	suite.Require().NoError(err)
+	entries := readTestTar(suite.T(), tarPath)
+
+	manifests := []OutputManifest{}
+	suite.Require().NoError(encodingjson.Unmarshal(entries["manifest.json"], &manifests))
+	suite.Require().Len(manifests[0].Layers, 2)
+	suite.Equal([]string{"app"}, suite.tarFiles(entries[manifests[0].Layers[0]]))
+	suite.Equal([]string{"usr/bin/busybox"}, suite.tarFiles(entries[manifests[0].Layers[1]]))
+
+	configData := map[string]interface{}{}
+	suite.Require().NoError(encodingjson.Unmarshal(entries[manifests[0].Config], &configData))
+	suite.Len(configDiffIDs(configData), 2)
+	suite.Equal(suite.image.Manifest.Layers[0].Digest, image.Manifest.Layers[0].Digest)
+}
+
+func (suite *AppendTestSuite) TestAppendGzippedLayer() {
+	suite.testAppendLayer(true)
+}
+
+func (suite *AppendTestSuite) TestAppendUncompressedLayer() {
+	suite.testAppendLayer(false)
+}
+
+func (suite *AppendTestSuite) TestAppendedLayerIsLoaded() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	opts := Options{AppendLayers: []string{suite.writeLayer(testLayer{"usr/bin/busybox": "tools"}, true)}}
+
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, opts)
+	suite.Require().NoError(err)
+	suite.NotEqual(suite.image.Manifest.Config.Digest, action.Digest)
+	suite.Require().Contains(cli.images, action.Digest)
+	suite.Len(cli.images[action.Digest].RootFS.Layers, 2)
+}
+
+func (suite *AppendTestSuite) TestAppendNotATar() {
+	path := filepath.Join(suite.T().TempDir(), "layer.tar")
+	suite.Require().NoError(os.WriteFile(path, []byte("not a tar at all, but long enough to be read as a header"), 0o644))
+	image := suite.image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{AppendLayers: []string{path}}
+	suite.ErrorContains(builder.Prepare(context.Background(), &image), "is not a tar")
+}
+
+func TestAppendTestSuite(t *testing.T) {
+	suite.Run(t, new(AppendTestSuite))
+}
@@ -3,16 +3,20 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	encodingjson "encoding/json"
 
+	"github.com/distribution/reference"
+	"github.com/docker/go-units"
 	"github.com/juanique/monorepo/salsa/go/files"
 	"github.com/juanique/monorepo/salsa/go/json"
 	"github.com/juanique/monorepo/salsa/go/random"
@@ -90,10 +94,27 @@ type Image struct {
 	// Dynamically loaded
 	Index    ImageIndex `json:"index"`
 	Manifest Manifest   `json:"manifest"`
+
+	// PreparedBlobsDir holds the layers rewritten while preparing the image,
+	// which are looked up there before the OCI image directory.
+	PreparedBlobsDir string `json:"-"`
+
+	// ResolvedBlobs maps the digests to the real paths of their blobs, when
+	// the symlinks of the layout were resolved upfront.
+	ResolvedBlobs map[string]string `json:"-"`
 }
 
 // BlobPath returns the directory where the blobs are stored in the OCI image directory.
 func (i Image) BlobPath(digest string) string {
+	if i.PreparedBlobsDir != "" {
+		prepared := filepath.Join(i.PreparedBlobsDir, strings.TrimPrefix(digest, "sha256:"))
+		if _, err := os.Stat(prepared); err == nil {
+			return prepared
+		}
+	}
+	if resolved, ok := i.ResolvedBlobs[digest]; ok {
+		return resolved
+	}
 	return filepath.Join(i.Path, "blobs", strings.Replace(digest, ":", "/", -1))
 }
 
@@ -112,22 +133,46 @@ func (i Image) ManifestBlobPath() string {
 	return i.BlobPath(i.Index.Manifests[0].Digest)
 }
 
+// AddLayersAsLabels adds the layer digests to the config as the oci_layers
+// label, writing the new config into blobsDir.
 func (i *Image) AddLayersAsLabels(blobsDir string) error {
+	return i.UpdateConfig(blobsDir, i.addLayerLabels)
+}
+
+// UpdateConfig applies the updates to the config data and writes the result
+// into blobsDir as the new config of the image.
+func (i *Image) UpdateConfig(blobsDir string, updates ...func(configData map[string]interface{}) error) error {
 	var configData map[string]interface{}
 	err := json.FromFile(i.ConfigBlobPath(), &configData)
 	if err != nil {
 		return err
 	}
 
-	nestedConfig, ok := configData["config"]
-	if !ok {
+	if _, ok := configData["config"].(map[string]interface{}); !ok {
 		return fmt.Errorf("config json missing config key")
 	}
+	for _, update := range updates {
+		if err := update(configData); err != nil {
+			return err
+		}
+	}
 
-	labels, ok := nestedConfig.(map[string]interface{})["Labels"]
+	newConfig, err := WriteToBlob(configData, blobsDir)
+	if err != nil {
+		return err
+	}
+
+	newConfig.MediaType = "application/vnd.oci.image.config.v1+json"
+	i.Manifest.Config = newConfig
+	return nil
+}
+
+func (i *Image) addLayerLabels(configData map[string]interface{}) error {
+	nestedConfig := configData["config"].(map[string]interface{})
+	labels, ok := nestedConfig["Labels"]
 	if !ok || labels == nil {
-		nestedConfig.(map[string]interface{})["Labels"] = map[string]interface{}{}
-		labels = nestedConfig.(map[string]interface{})["Labels"]
+		nestedConfig["Labels"] = map[string]interface{}{}
+		labels = nestedConfig["Labels"]
 	}
 	labelsMap, ok := labels.(map[string]interface{})
 	if !ok {
@@ -139,18 +184,165 @@ func (i *Image) AddLayersAsLabels(blobsDir string) error {
 		blobDigests = append(blobDigests, filepath.Base(blobPath))
 	}
 	labelsMap["oci_layers"] = strings.Join(blobDigests, ",")
-	configData["config"].(map[string]interface{})["Labels"] = labelsMap
+	return nil
+}
 
-	newConfig, err := WriteToBlob(configData, blobsDir)
-	if err != nil {
-		return err
+// addSourceLabel adds the source label, naming the image directory, to the
+// config. It runs after addLayerLabels, which makes sure the labels exist.
+func (i *Image) addSourceLabel(configData map[string]interface{}) error {
+	labelsMap := configData["config"].(map[string]interface{})["Labels"].(map[string]interface{})
+	labelsMap[sourceLabel] = imageSource(i.Path)
+	return nil
+}
+
+// imageSource returns the image directory path recorded in the source label.
+// The Bazel output tree and runfiles prefixes are removed, so that the label,
+// and with it the image ID, is the same wherever Bazel runs the loader.
+func imageSource(path string) string {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if k := strings.LastIndex(path, "/bin/"); k >= 0 && strings.Contains(path[:k], "bazel-out/") {
+		return path[k+len("/bin/"):]
 	}
+	if k := strings.LastIndex(path, ".runfiles/"); k >= 0 {
+		// The runfiles path starts with the repository name.
+		if _, rest, ok := strings.Cut(path[k+len(".runfiles/"):], "/"); ok {
+			return rest
+		}
+	}
+	return path
+}
 
-	newConfig.MediaType = "application/vnd.oci.image.config.v1+json"
-	i.Manifest.Config = newConfig
+// StripOpts selects the env vars and labels removed from the image config.
+// Entries are path.Match patterns matched against the variable or label name.
+type StripOpts struct {
+	Env    []string
+	Labels []string
+}
+
+// Empty returns whether nothing is stripped.
+func (s StripOpts) Empty() bool {
+	return len(s.Env) == 0 && len(s.Labels) == 0
+}
+
+// stripConfig removes the matching env vars and labels from the config data.
+func (s StripOpts) stripConfig(ctx context.Context, configData map[string]interface{}) error {
+	nestedConfig := configData["config"].(map[string]interface{})
+
+	if env, ok := nestedConfig["Env"].([]interface{}); ok {
+		kept := []interface{}{}
+		for _, entry := range env {
+			name, _, _ := strings.Cut(fmt.Sprint(entry), "=")
+			matched, err := matchesAny(s.Env, name)
+			if err != nil {
+				return err
+			}
+			if matched {
+				logger(ctx).Println("Stripped env var", name)
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		nestedConfig["Env"] = kept
+	}
+
+	if labels, ok := nestedConfig["Labels"].(map[string]interface{}); ok {
+		for name := range labels {
+			matched, err := matchesAny(s.Labels, name)
+			if err != nil {
+				return err
+			}
+			if matched {
+				logger(ctx).Println("Stripped label", name)
+				delete(labels, name)
+			}
+		}
+	}
 	return nil
 }
 
+// dropHistory removes the build commands from the history of the config.
+// Docker matches the history entries that are not empty_layer with the
+// layers, so one entry keeping only its creation time is left for each layer.
+// A history that does not line up with the layers is dropped entirely.
+func dropHistory(ctx context.Context, configData map[string]interface{}) error {
+	entries, ok := configData["history"].([]interface{})
+	if !ok {
+		return nil
+	}
+	rootfs, _ := configData["rootfs"].(map[string]interface{})
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+
+	kept := []interface{}{}
+	for _, entry := range entries {
+		fields, _ := entry.(map[string]interface{})
+		if emptyLayer, _ := fields["empty_layer"].(bool); emptyLayer {
+			continue
+		}
+		slim := map[string]interface{}{}
+		if created, ok := fields["created"]; ok {
+			slim["created"] = created
+		}
+		kept = append(kept, slim)
+	}
+	if len(kept) != len(diffIDs) {
+		logger(ctx).Println("Warning: the history has", len(kept), "layer entries for", len(diffIDs), "layers, dropping all", len(entries), "history entries")
+		delete(configData, "history")
+		return nil
+	}
+	logger(ctx).Println("Dropped", len(entries)-len(kept), "empty layer history entries and the build commands of the other", len(kept))
+	configData["history"] = kept
+	return nil
+}
+
+// ConfigEdits are the user requested changes to the image config.
+type ConfigEdits struct {
+	Overlay *ConfigOverlay
+	Strip   StripOpts
+
+	// DropHistory removes the build commands from the config history.
+	DropHistory bool
+
+	// DockerCompat converts the config into a Docker schema2 config, with
+	// Docker media types, for daemons rejecting OCI configs.
+	DockerCompat bool
+
+	// ExcludePaths are path.Match patterns of files removed from the layers.
+	// The layers losing files get new digests and diff IDs, and so the image
+	// gets a new ID.
+	ExcludePaths []string
+
+	// AppendLayers are layer tars added on top of the image layers, changing
+	// the image ID.
+	AppendLayers []string
+
+	// Squash flattens the layers into a single one, changing the image ID.
+	// The squashed layer shares nothing with other images.
+	Squash bool
+
+	// LabelSource adds the source label listed by `list`. The label makes
+	// the image ID depend on the image directory, so the same image loaded
+	// from another target is a different image and is loaded again.
+	LabelSource bool
+}
+
+// Empty returns whether the config is left as is.
+func (e ConfigEdits) Empty() bool {
+	return e.Overlay == nil && e.Strip.Empty() && !e.DropHistory && !e.DockerCompat && len(e.ExcludePaths) == 0 && len(e.AppendLayers) == 0 && !e.Squash && !e.LabelSource
+}
+
+func matchesAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // GetLayerBlobPaths returns the paths to the image layer blobs in the OCI image directory.
 func (i Image) GetLayerBlobPaths() []string {
 	output := []string{}
@@ -172,11 +364,20 @@ func (i *Image) LoadIndex() error {
 }
 
 // NewImage creates a new Image from an OCI image directory.
+// Relative paths that do not exist are looked up in the Bazel runfiles.
 func NewImage(path string) (Image, error) {
-	image := Image{Path: path}
+	image := Image{Path: resolveRunfilesPath(path)}
+	if _, err := resolveLink(image.IndexPath(), "index.json"); err != nil {
+		return Image{}, err
+	}
 	if err := image.LoadIndex(); err != nil {
 		return Image{}, err
 	}
+	if len(image.Index.Manifests) > 0 {
+		if _, err := resolveLink(image.ManifestBlobPath(), "manifest blob "+image.Index.Manifests[0].Digest); err != nil {
+			return Image{}, err
+		}
+	}
 	if err := image.LoadManifest(); err != nil {
 		return Image{}, err
 	}
@@ -184,6 +385,88 @@ func NewImage(path string) (Image, error) {
 	return image, nil
 }
 
+// OpenImage creates the Image, also validating the manifest if strict is set
+// and resolving the symlinks of its blobs if resolveSymlinks is set.
+func OpenImage(path string, strict, resolveSymlinks bool) (Image, error) {
+	image, err := NewImage(path)
+	if err != nil {
+		return Image{}, err
+	}
+	if resolveSymlinks {
+		if err := image.ResolveSymlinks(); err != nil {
+			return Image{}, err
+		}
+	}
+	if strict {
+		if err := image.Validate(); err != nil {
+			return Image{}, fmt.Errorf("invalid image %s: %w", path, err)
+		}
+	}
+	return image, nil
+}
+
+// Media types of the blobs referenced by accepted manifests.
+var (
+	acceptedConfigMediaTypes = map[string]bool{
+		"application/vnd.oci.image.config.v1+json":       true,
+		"application/vnd.docker.container.image.v1+json": true,
+	}
+	acceptedLayerMediaTypes = map[string]bool{
+		"application/vnd.oci.image.layer.v1.tar":                       true,
+		"application/vnd.oci.image.layer.v1.tar+gzip":                  true,
+		"application/vnd.oci.image.layer.v1.tar+zstd":                  true,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":            true,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar":      true,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	}
+	digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// Validate checks that the manifest is internally consistent: the digests are
+// well formed, every layer has a size, the media types are known and there is
+// a layer for every diff ID in the config.
+func (i Image) Validate() error {
+	if len(i.Index.Manifests) == 0 {
+		return fmt.Errorf("index.json has no manifests")
+	}
+	if mediaType := i.Index.Manifests[0].MediaType; !acceptedMediaTypes[mediaType] {
+		return fmt.Errorf("unsupported manifest media type %q", mediaType)
+	}
+
+	config := i.Manifest.Config
+	if config.Digest == "" {
+		return fmt.Errorf("manifest has no config digest")
+	}
+	if !digestPattern.MatchString(config.Digest) {
+		return fmt.Errorf("malformed config digest %q", config.Digest)
+	}
+	if !acceptedConfigMediaTypes[config.MediaType] {
+		return fmt.Errorf("unsupported config media type %q", config.MediaType)
+	}
+
+	for k, layer := range i.Manifest.Layers {
+		if !digestPattern.MatchString(layer.Digest) {
+			return fmt.Errorf("layer %d has a malformed digest %q", k, layer.Digest)
+		}
+		if layer.Size <= 0 {
+			return fmt.Errorf("layer %d (%s) has no size", k, layer.Digest)
+		}
+		if !acceptedLayerMediaTypes[layer.MediaType] {
+			return fmt.Errorf("layer %d (%s) has unsupported media type %q", k, layer.Digest, layer.MediaType)
+		}
+	}
+
+	var configData map[string]interface{}
+	if err := json.FromFile(i.ConfigBlobPath(), &configData); err != nil {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+	if diffIDs := configDiffIDs(configData); len(diffIDs) != len(i.Manifest.Layers) {
+		return fmt.Errorf("manifest has %d layers but the config rootfs has %d diff_ids", len(i.Manifest.Layers), len(diffIDs))
+	}
+	return nil
+}
+
 // Outpufile represents a file that will be copied into the output tar.
 type OutputFile struct {
 	src string
@@ -205,12 +488,15 @@ type ImageBuilder struct {
 	outputManifest OutputManifest
 	repoTags       []string
 
+	// Edits are the changes made to the config in Prepare.
+	Edits ConfigEdits
+
 	// Stateful
 	filesToCopy []OutputFile
 	ConfigPath  string
 }
 
-func (b *ImageBuilder) Prepare(i *Image) error {
+func (b *ImageBuilder) Prepare(ctx context.Context, i *Image) error {
 	err := os.MkdirAll(b.blobsDir, 0o755)
 
 	// By default we use the original config blob path
@@ -224,8 +510,52 @@ func (b *ImageBuilder) Prepare(i *Image) error {
 		return fmt.Errorf("Unsupported media type: %s", i.Index.Manifests[0].MediaType)
 	}
 
-	if err := i.AddLayersAsLabels(b.blobsDir); err != nil {
-		return fmt.Errorf("Error adding layers as labels: %v", err)
+	stripConfig := func(configData map[string]interface{}) error { return b.Edits.Strip.stripConfig(ctx, configData) }
+	updates := []func(map[string]interface{}) error{b.Edits.Overlay.apply, stripConfig}
+	if b.Edits.DropHistory {
+		// Dropped before appending layers, which add their own entries.
+		updates = append(updates, func(configData map[string]interface{}) error { return dropHistory(ctx, configData) })
+	}
+	if len(b.Edits.ExcludePaths) > 0 {
+		updateDiffIDs, err := i.excludePaths(ctx, b.Edits.ExcludePaths, b.blobsDir)
+		if err != nil {
+			return fmt.Errorf("Error excluding paths: %v", err)
+		}
+		updates = append(updates, updateDiffIDs)
+	}
+	// Appended after excluding, so the appended layers are left as given.
+	if len(b.Edits.AppendLayers) > 0 {
+		appendDiffIDs, err := i.appendLayers(ctx, b.Edits.AppendLayers, b.blobsDir)
+		if err != nil {
+			return fmt.Errorf("Error appending layers: %v", err)
+		}
+		updates = append(updates, appendDiffIDs)
+	}
+	// Squashed last, so the appended layers are flattened too.
+	if b.Edits.Squash {
+		squashDiffIDs, err := i.squash(ctx, b.blobsDir)
+		if err != nil {
+			return fmt.Errorf("Error squashing layers: %v", err)
+		}
+		updates = append(updates, squashDiffIDs)
+	}
+	// Converted once the layers and their history entries are final.
+	if b.Edits.DockerCompat {
+		updates = append(updates, func(configData map[string]interface{}) error { return dockerCompatConfig(ctx, configData) })
+	}
+
+	// Strip after the overlay so it cannot bring back what is stripped, and
+	// before adding the layer labels so oci_layers is never stripped. The
+	// labels come last so they list the rewritten layers.
+	updates = append(updates, i.addLayerLabels)
+	if b.Edits.LabelSource {
+		updates = append(updates, i.addSourceLabel)
+	}
+	if err := i.UpdateConfig(b.blobsDir, updates...); err != nil {
+		return fmt.Errorf("Error updating config: %v", err)
+	}
+	if b.Edits.DockerCompat {
+		i.useDockerMediaTypes()
 	}
 
 	b.outputManifest.RepoTags = b.repoTags
@@ -235,17 +565,100 @@ func (b *ImageBuilder) Prepare(i *Image) error {
 	return nil
 }
 
+// Layouts of the tar written by Build.
+const (
+	// TarFormatDocker is the docker-archive layout: a manifest.json listing
+	// the config and the layer tarballs. Every Docker version can load it.
+	TarFormatDocker = "docker"
+	// TarFormatOCI is the OCI image layout: oci-layout, index.json and the
+	// blobs by digest. Docker only loads it since 25.0, but it is the layout
+	// expected by tools that do not understand manifest.json, such as
+	// `ctr import` on older containerd versions.
+	TarFormatOCI = "oci"
+)
+
 type BuildOpts struct {
+	// SkipLayers are left out of the tar. Only the docker layout supports it.
 	SkipLayers []string
+
+	// NoCache puts every layer in the tar, whatever SkipLayers says.
+	NoCache bool
+
+	// TarFormat is the layout of the tar, TarFormatDocker if empty.
+	TarFormat string
+
+	// MaxLayerSize fails the build if any layer is larger, in bytes. Layers
+	// larger than WarnLayerSize are only logged. Zero means no limit.
+	MaxLayerSize  int64
+	WarnLayerSize int64
+
+	// FailOnEmptyLayers makes Build fail for images without any layers.
+	FailOnEmptyLayers bool
+
+	// Progress receives a layer event as each layer is added to the tar, if
+	// set.
+	Progress ProgressFunc
+}
+
+// checkLayers guards against images produced by broken builds. Images without
+// layers are an error if failOnEmpty is set, and zero byte layer blobs are
+// logged.
+func checkLayers(ctx context.Context, i Image, failOnEmpty bool) error {
+	if len(i.Manifest.Layers) == 0 && failOnEmpty {
+		return fmt.Errorf("image %s has no layers, this usually means the image build is broken", i.Path)
+	}
+
+	for _, layerPath := range i.GetLayerBlobPaths() {
+		info, err := os.Stat(layerPath)
+		if err == nil && info.Size() == 0 {
+			logger(ctx).Println("Warning: layer blob", layerPath, "is empty, this usually means the image build is broken")
+		}
+	}
+	return nil
+}
+
+// checkLayerSizes guards against layers large enough to fill the disk of the
+// daemon, using the sizes in the manifest.
+func checkLayerSizes(ctx context.Context, i Image, max, warn int64) error {
+	for _, layer := range i.Manifest.Layers {
+		size := int64(layer.Size)
+		if max > 0 && size > max {
+			return fmt.Errorf("layer %s is %s, larger than the maximum of %s", layer.Digest, units.BytesSize(float64(size)), units.BytesSize(float64(max)))
+		}
+		if warn > 0 && size > warn {
+			logger(ctx).Println("Warning: layer", layer.Digest, "is", units.BytesSize(float64(size)), "larger than", units.BytesSize(float64(warn)))
+		}
+	}
+	return nil
 }
 
-// Build creates an OCI image tar from an OCI image directory.
-func (b *ImageBuilder) Build(i Image, opts BuildOpts) (string, error) {
+// SetRepoTags replaces the tags the tar is loaded with.
+func (b *ImageBuilder) SetRepoTags(repoTags []string) {
+	b.repoTags = repoTags
+	b.outputManifest.RepoTags = repoTags
+}
+
+// Build creates an OCI image tar from an OCI image directory. Cancelling ctx
+// stops the build between files, removing the partial tar.
+func (b *ImageBuilder) Build(ctx context.Context, i Image, opts BuildOpts) (string, error) {
+	if err := checkLayers(ctx, i, opts.FailOnEmptyLayers); err != nil {
+		return "", err
+	}
+	if err := checkLayerSizes(ctx, i, opts.MaxLayerSize, opts.WarnLayerSize); err != nil {
+		return "", err
+	}
+	if opts.TarFormat != "" && opts.TarFormat != TarFormatDocker && opts.TarFormat != TarFormatOCI {
+		return "", fmt.Errorf("unsupported tar format %q, must be %q or %q", opts.TarFormat, TarFormatDocker, TarFormatOCI)
+	}
+
 	configOutput := b.AddBlob(b.ConfigPath)
 	b.outputManifest.Config = configOutput.rel
 	layersToSkip := []string{}
 
 	for _, layerPath := range i.GetLayerBlobPaths() {
+		if opts.NoCache {
+			break
+		}
 		skipped := false
 		for _, skipLayer := range opts.SkipLayers {
 			if filepath.Base(layerPath) == skipLayer {
@@ -260,42 +673,84 @@ func (b *ImageBuilder) Build(i Image, opts BuildOpts) (string, error) {
 		}
 	}
 
-	for _, layer := range i.GetLayerBlobPaths() {
-		output := b.AddLayerBlob(layer, layersToSkip)
-		b.outputManifest.Layers = append(b.outputManifest.Layers, output.rel)
+	layers := i.GetLayerBlobPaths()
+	for k, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if opts.TarFormat == TarFormatOCI {
+			// The OCI layout keeps the layers under their digest.
+			b.AddBlob(layer)
+		} else {
+			output := b.AddLayerBlob(ctx, layer, layersToSkip)
+			b.outputManifest.Layers = append(b.outputManifest.Layers, output.rel)
+		}
+		if opts.Progress != nil {
+			opts.Progress(ProgressEvent{Type: ProgressLayer, Layer: filepath.Base(layer), Index: k + 1, Total: len(layers)})
+		}
+	}
+
+	tarInputs, err := b.stageFiles()
+	if err != nil {
+		return "", err
+	}
+
+	if opts.TarFormat == TarFormatOCI {
+		layoutFiles, err := b.writeOCILayout(i)
+		if err != nil {
+			return "", err
+		}
+		tarInputs = append(tarInputs, layoutFiles...)
+	} else {
+		outputManifest := []OutputManifest{b.outputManifest}
+		err := json.ToFile(b.GetOutputPath("manifest.json"), outputManifest)
+		if err != nil {
+			return "", err
+		}
+		tarInputs = append(tarInputs, "manifest.json")
 	}
 
+	return b.writeTar(ctx, tarInputs)
+}
+
+// stageFiles links the files to copy into the staging dir, returning their
+// paths relative to it.
+func (b *ImageBuilder) stageFiles() ([]string, error) {
 	tarInputs := []string{}
 	for _, file := range b.filesToCopy {
 		if file.src != file.dst {
 			exists, err := files.FileExists(file.dst)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			if exists {
 				// TOOD(juan.munoz): Why does this happen sometimes? how should we handle it?
 				continue
 			}
 			if err := files.CreateSymLink(file.src, file.dst); err != nil && file.src != file.dst {
-				return "", err
+				return nil, err
 			}
 		}
 		tarInputs = append(tarInputs, file.rel)
 	}
+	return tarInputs, nil
+}
 
-	outputManifest := []OutputManifest{b.outputManifest}
-	err := json.ToFile(b.GetOutputPath("manifest.json"), outputManifest)
-	if err != nil {
-		return "", err
-	}
-	tarInputs = append(tarInputs, "manifest.json")
-
+// writeTar packs the given files of the staging dir into image.tar.
+func (b *ImageBuilder) writeTar(ctx context.Context, tarInputs []string) (string, error) {
 	tarb, err := tarbuilder.New(b.stagingDir, b.GetOutputPath("image.tar"))
 	if err != nil {
 		return "", fmt.Errorf("failed to create tar builder: %w", err)
 	}
-	if err := tarb.Add(tarInputs); err != nil {
-		return "", fmt.Errorf("failed to add files to tar: %w", err)
+	for _, input := range tarInputs {
+		if err := ctx.Err(); err != nil {
+			tarb.Write()
+			os.Remove(b.GetOutputPath("image.tar"))
+			return "", err
+		}
+		if err := tarb.Add([]string{input}); err != nil {
+			return "", fmt.Errorf("failed to add files to tar: %w", err)
+		}
 	}
 
 	if err := tarb.Write(); err != nil {
@@ -304,6 +759,82 @@ func (b *ImageBuilder) Build(i Image, opts BuildOpts) (string, error) {
 	return b.GetOutputPath("image.tar"), nil
 }
 
+// ociManifest is the image manifest blob written in the OCI layout.
+type ociManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// ociIndexEntry is a manifest listed in the index.json of the OCI layout.
+type ociIndexEntry struct {
+	Descriptor
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// writeOCILayout writes the manifest blob, index.json and oci-layout files of
+// the OCI layout into the staging dir, returning their paths relative to it.
+// Every repo tag is a separate entry in the index.
+func (b *ImageBuilder) writeOCILayout(i Image) ([]string, error) {
+	mediaType := "application/vnd.oci.image.manifest.v1+json"
+	if b.Edits.DockerCompat {
+		mediaType = dockerManifestMediaType
+	}
+	manifest, err := WriteToBlob(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaType,
+		Config:        i.Manifest.Config,
+		Layers:        i.Manifest.Layers,
+	}, b.blobsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	manifest.MediaType = mediaType
+	manifestRel, _ := filepath.Rel(b.stagingDir, filepath.Join(b.blobsDir, strings.TrimPrefix(manifest.Digest, "sha256:")))
+
+	entries := []ociIndexEntry{}
+	for _, tag := range b.repoTags {
+		annotations := map[string]string{"io.containerd.image.name": tag}
+		if refName := ociRefName(tag); refName != "" {
+			annotations["org.opencontainers.image.ref.name"] = refName
+		}
+		entries = append(entries, ociIndexEntry{Descriptor: manifest, Annotations: annotations})
+	}
+	if len(entries) == 0 {
+		entries = append(entries, ociIndexEntry{Descriptor: manifest})
+	}
+	index := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     entries,
+	}
+	if err := json.ToFile(b.GetOutputPath("index.json"), index); err != nil {
+		return nil, err
+	}
+	if err := json.ToFile(b.GetOutputPath("oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		return nil, err
+	}
+	return []string{manifestRel, "index.json", "oci-layout"}, nil
+}
+
+// ociRefName returns the org.opencontainers.image.ref.name of the repo tag,
+// which is its tag. References by digest have none, as the colon of a
+// registry port or of a digest is not a tag separator.
+func ociRefName(repoTag string) string {
+	named, err := reference.ParseNormalizedNamed(repoTag)
+	if err != nil {
+		return ""
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return ""
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
 // GetOutputPath returns the for a file in the staging dir that will be packaged into the tar.
 func (b ImageBuilder) GetOutputPath(relPath string) string {
 	return filepath.Join(b.stagingDir, relPath)
@@ -321,7 +852,7 @@ func (b *ImageBuilder) AddBlob(blobPath string) OutputFile {
 }
 
 // AddLayerBlob adds a gzipped blob to the list of files that will be copied into the tar.
-func (b *ImageBuilder) AddLayerBlob(blobPath string, skipLayers []string) OutputFile {
+func (b *ImageBuilder) AddLayerBlob(ctx context.Context, blobPath string, skipLayers []string) OutputFile {
 	f := OutputFile{
 		src: blobPath,
 		dst: filepath.Join(b.blobsDir, filepath.Base(blobPath)+".tar.gz"),
@@ -332,7 +863,7 @@ func (b *ImageBuilder) AddLayerBlob(blobPath string, skipLayers []string) Output
 	for _, skipLayer := range skipLayers {
 		if filepath.Base(blobPath) == skipLayer {
 			skip = true
-			log.Println("Skipping layer", skipLayer)
+			logger(ctx).Println("Skipping layer", skipLayer)
 			break
 		}
 	}
@@ -349,7 +880,6 @@ func NewImageBuilder(imageSha string, repoTags []string) ImageBuilder {
 		stagingDir: "/tmp/" + random.String(10) + "_" + strings.Replace(imageSha, "sha256:", "", -1),
 		repoTags:   repoTags,
 	}
-	log.Println("Staging dir is ", builder.stagingDir)
 	builder.blobsDir = filepath.Join(builder.stagingDir, "blobs", "sha256")
 	return builder
 }
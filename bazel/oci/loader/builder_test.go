@@ -0,0 +1,479 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testLayer maps file paths to their contents in a test image layer.
+type testLayer map[string]string
+
+// tarTestLayer returns the uncompressed tar for the given layer contents.
+func tarTestLayer(t *testing.T, layer testLayer) []byte {
+	names := []string{}
+	for name := range layer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		content := layer[name]
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// writeTestBlob writes content into the blobs directory of the OCI layout and
+// returns its digest.
+func writeTestBlob(t *testing.T, dir string, content []byte) string {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	blobsDir := filepath.Join(dir, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobsDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(blobsDir, hash), content, 0o644))
+	return "sha256:" + hash
+}
+
+// writeTestImage writes an OCI image layout into dir, with the given container
+// config and gzipped layers, and returns the loaded Image.
+func writeTestImage(t *testing.T, dir string, containerConfig map[string]interface{}, layers ...testLayer) Image {
+	layerTars := [][]byte{}
+	for _, layer := range layers {
+		layerTars = append(layerTars, tarTestLayer(t, layer))
+	}
+	return writeTestImageTars(t, dir, containerConfig, layerTars...)
+}
+
+// writeTestImageTars is writeTestImage for layers given as uncompressed tars.
+func writeTestImageTars(t *testing.T, dir string, containerConfig map[string]interface{}, layerTars ...[]byte) Image {
+	manifestLayers := []Descriptor{}
+	diffIDs := []interface{}{}
+	for _, layerTar := range layerTars {
+		diffSum := sha256.Sum256(layerTar)
+		diffIDs = append(diffIDs, "sha256:"+hex.EncodeToString(diffSum[:]))
+
+		gzipped := bytes.Buffer{}
+		gw := gzip.NewWriter(&gzipped)
+		_, err := gw.Write(layerTar)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		manifestLayers = append(manifestLayers, Descriptor{
+			MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+			Size:      gzipped.Len(),
+			Digest:    writeTestBlob(t, dir, gzipped.Bytes()),
+		})
+	}
+
+	if containerConfig == nil {
+		containerConfig = map[string]interface{}{}
+	}
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       containerConfig,
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+	}
+	configJSON, err := encodingjson.Marshal(config)
+	require.NoError(t, err)
+
+	manifest := Manifest{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Config: Descriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Size:      len(configJSON),
+			Digest:    writeTestBlob(t, dir, configJSON),
+		},
+		Layers: manifestLayers,
+	}
+	manifestJSON, err := encodingjson.Marshal(manifest)
+	require.NoError(t, err)
+
+	index := ImageIndex{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.oci.image.index.v1+json",
+		Manifests: []Manifest{{
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Size:      len(manifestJSON),
+			Digest:    writeTestBlob(t, dir, manifestJSON),
+		}},
+	}
+	indexJSON, err := encodingjson.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), indexJSON, 0o644))
+
+	image, err := NewImage(dir)
+	require.NoError(t, err)
+	return image
+}
+
+func TestBuildFailsOnEmptyLayers(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil)
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+
+	_, err := builder.Build(context.Background(), image, BuildOpts{FailOnEmptyLayers: true})
+	require.ErrorContains(t, err, "has no layers")
+}
+
+func TestCheckLayersWarnsOnZeroByteLayer(t *testing.T) {
+	dir := t.TempDir()
+	image := writeTestImage(t, dir, nil, testLayer{"app": "binary"})
+	image.Manifest.Layers = append(image.Manifest.Layers, Descriptor{Digest: writeTestBlob(t, dir, nil)})
+
+	logs := bytes.Buffer{}
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	require.NoError(t, checkLayers(context.Background(), image, true))
+	require.Contains(t, logs.String(), "is empty")
+}
+
+func TestBuildFailsOnOversizedLayer(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"app": strings.Repeat("x", 4096)})
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+
+	_, err := builder.Build(context.Background(), image, BuildOpts{MaxLayerSize: 10})
+	require.ErrorContains(t, err, image.Manifest.Layers[0].Digest)
+	require.ErrorContains(t, err, "larger than the maximum of 10B")
+}
+
+func TestBuildReportsLayerProgress(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"etc/os-release": "debian"}, testLayer{"app": "binary"})
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+
+	events := []ProgressEvent{}
+	progress := func(event ProgressEvent) { events = append(events, event) }
+	_, err := builder.Build(context.Background(), image, BuildOpts{MaxLayerSize: 1, Progress: progress})
+	require.Error(t, err)
+	// Nothing is reported for a build failing its checks.
+	require.Empty(t, events)
+
+	_, err = builder.Build(context.Background(), image, BuildOpts{Progress: progress})
+	require.NoError(t, err)
+	layers := image.GetLayerBlobPaths()
+	require.Equal(t, []ProgressEvent{
+		{Type: ProgressLayer, Layer: filepath.Base(layers[0]), Index: 1, Total: 2},
+		{Type: ProgressLayer, Layer: filepath.Base(layers[1]), Index: 2, Total: 2},
+	}, events)
+}
+
+func TestCheckLayerSizesWarnsBetweenThresholds(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"app": "binary"})
+	size := int64(image.Manifest.Layers[0].Size)
+
+	logs := bytes.Buffer{}
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	require.NoError(t, checkLayerSizes(context.Background(), image, size+1, size-1))
+	require.Contains(t, logs.String(), "Warning: layer "+image.Manifest.Layers[0].Digest)
+
+	logs.Reset()
+	require.NoError(t, checkLayerSizes(context.Background(), image, 0, size))
+	require.Empty(t, logs.String())
+}
+
+func TestPrepareStripsEnvAndLabels(t *testing.T) {
+	containerConfig := map[string]interface{}{
+		"Env":    []interface{}{"PATH=/bin", "GITHUB_TOKEN=secret", "NPM_TOKEN=secret"},
+		"Labels": map[string]interface{}{"team": "infra", "internal.build-host": "ci-7"},
+	}
+
+	image := writeTestImage(t, t.TempDir(), containerConfig, testLayer{"app": "binary"})
+	plain := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	unstripped := image
+	require.NoError(t, plain.Prepare(context.Background(), &unstripped))
+
+	stripped := image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{Strip: StripOpts{Env: []string{"*_TOKEN"}, Labels: []string{"internal.*"}}}
+	require.NoError(t, builder.Prepare(context.Background(), &stripped))
+	require.NotEqual(t, unstripped.Manifest.Config.Digest, stripped.Manifest.Config.Digest)
+
+	configJSON, err := os.ReadFile(builder.ConfigPath)
+	require.NoError(t, err)
+	configData := map[string]interface{}{}
+	require.NoError(t, encodingjson.Unmarshal(configJSON, &configData))
+	config := configData["config"].(map[string]interface{})
+
+	require.Equal(t, []interface{}{"PATH=/bin"}, config["Env"])
+	labels := config["Labels"].(map[string]interface{})
+	require.NotContains(t, labels, "internal.build-host")
+	require.Equal(t, "infra", labels["team"])
+	require.Contains(t, labels, "oci_layers")
+}
+
+// setTestHistory replaces the config of the image with one holding history.
+func setTestHistory(t *testing.T, image *Image, history []interface{}) {
+	require.NoError(t, image.UpdateConfig(filepath.Join(image.Path, "blobs", "sha256"), func(configData map[string]interface{}) error {
+		configData["history"] = history
+		return nil
+	}))
+}
+
+func TestPrepareDropsHistory(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"etc/os-release": "debian"}, testLayer{"app": "binary"})
+	setTestHistory(t, &image, []interface{}{
+		map[string]interface{}{"created": "2024-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /"},
+		map[string]interface{}{"created": "2024-01-02T00:00:00Z", "created_by": "ENV TOKEN=secret", "empty_layer": true},
+		map[string]interface{}{"created": "2024-01-03T00:00:00Z", "created_by": "RUN build --token=secret", "comment": "buildkit"},
+	})
+
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{DropHistory: true}
+	dropped := image
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	require.NoError(t, builder.Prepare(context.Background(), &dropped))
+	require.Contains(t, logs.String(), "Dropped 1 empty layer history entries and the build commands of the other 2")
+	require.NotEqual(t, image.Manifest.Config.Digest, dropped.Manifest.Config.Digest)
+
+	configJSON, err := os.ReadFile(builder.ConfigPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(configJSON), "secret")
+	configData := map[string]interface{}{}
+	require.NoError(t, encodingjson.Unmarshal(configJSON, &configData))
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"created": "2024-01-01T00:00:00Z"},
+		map[string]interface{}{"created": "2024-01-03T00:00:00Z"},
+	}, configData["history"])
+
+	tarPath, err := builder.Build(context.Background(), dropped, BuildOpts{})
+	require.NoError(t, err)
+	entries := readTestTar(t, tarPath)
+	require.Equal(t, configJSON, entries[blobName(dropped.Manifest.Config.Digest)])
+}
+
+func TestDropHistoryNotMatchingLayers(t *testing.T) {
+	configData := map[string]interface{}{
+		"rootfs":  map[string]interface{}{"diff_ids": []interface{}{"sha256:a", "sha256:b"}},
+		"history": []interface{}{map[string]interface{}{"created_by": "RUN make"}},
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	require.NoError(t, dropHistory(context.Background(), configData))
+	require.NotContains(t, configData, "history")
+	require.Contains(t, logs.String(), "Warning: the history has 1 layer entries for 2 layers, dropping all 1 history entries")
+
+	// Configs without history are left alone.
+	require.NoError(t, dropHistory(context.Background(), configData))
+	require.NotContains(t, configData, "history")
+}
+
+func TestValidateAcceptsWellFormedImage(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"app": "binary"}, testLayer{"data": "x"})
+	require.NoError(t, image.Validate())
+}
+
+func TestValidateRejectsMalformedManifests(t *testing.T) {
+	for name, tc := range map[string]struct {
+		modify func(dir string, i *Image)
+		err    string
+	}{
+		"missing config digest": {
+			modify: func(dir string, i *Image) { i.Manifest.Config.Digest = "" },
+			err:    "manifest has no config digest",
+		},
+		"malformed config digest": {
+			modify: func(dir string, i *Image) { i.Manifest.Config.Digest = "sha256:xyz" },
+			err:    `malformed config digest "sha256:xyz"`,
+		},
+		"unknown config media type": {
+			modify: func(dir string, i *Image) { i.Manifest.Config.MediaType = "text/plain" },
+			err:    `unsupported config media type "text/plain"`,
+		},
+		"unknown manifest media type": {
+			modify: func(dir string, i *Image) { i.Index.Manifests[0].MediaType = "application/vnd.oci.image.index.v1+json" },
+			err:    "unsupported manifest media type",
+		},
+		"layer without size": {
+			modify: func(dir string, i *Image) { i.Manifest.Layers[0].Size = 0 },
+			err:    "has no size",
+		},
+		"layer with malformed digest": {
+			modify: func(dir string, i *Image) { i.Manifest.Layers[0].Digest = "md5:abc" },
+			err:    `layer 0 has a malformed digest "md5:abc"`,
+		},
+		"unknown layer media type": {
+			modify: func(dir string, i *Image) { i.Manifest.Layers[0].MediaType = "application/zip" },
+			err:    `unsupported media type "application/zip"`,
+		},
+		"more layers than diff_ids": {
+			modify: func(dir string, i *Image) {
+				i.Manifest.Layers = append(i.Manifest.Layers, Descriptor{
+					MediaType: "application/vnd.oci.image.layer.v1.tar",
+					Size:      5,
+					Digest:    writeTestBlob(t, dir, []byte("extra")),
+				})
+			},
+			err: "manifest has 2 layers but the config rootfs has 1 diff_ids",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			image := writeTestImage(t, dir, nil, testLayer{"app": "binary"})
+			tc.modify(dir, &image)
+			require.ErrorContains(t, image.Validate(), tc.err)
+		})
+	}
+}
+
+// readTestTar returns the contents of the regular files in the tar by name.
+func readTestTar(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	entries := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[header.Name] = content
+	}
+	return entries
+}
+
+// buildTestTar builds the tar of the image in the given format.
+func buildTestTar(t *testing.T, image Image, format string) (Image, map[string][]byte) {
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+	tarPath, err := builder.Build(context.Background(), image, BuildOpts{TarFormat: format})
+	require.NoError(t, err)
+	return image, readTestTar(t, tarPath)
+}
+
+func blobName(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+func TestBuildDockerTarFormat(t *testing.T) {
+	image, entries := buildTestTar(t, writeTestImage(t, t.TempDir(), nil, testLayer{"app": "binary"}), TarFormatDocker)
+
+	config := blobName(image.Manifest.Config.Digest)
+	layer := blobName(image.Manifest.Layers[0].Digest) + ".tar.gz"
+	require.ElementsMatch(t, []string{"manifest.json", config, layer}, mapKeys(entries))
+
+	manifests := []OutputManifest{}
+	require.NoError(t, encodingjson.Unmarshal(entries["manifest.json"], &manifests))
+	require.Equal(t, []OutputManifest{{Config: config, RepoTags: []string{"app:latest"}, Layers: []string{layer}}}, manifests)
+}
+
+func TestBuildNoCacheIgnoresSkipLayers(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"etc/os-release": "debian"}, testLayer{"app": "binary"})
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+	skip := []string{filepath.Base(image.GetLayerBlobPaths()[0])}
+
+	tarPath, err := builder.Build(context.Background(), image, BuildOpts{SkipLayers: skip, NoCache: true})
+	require.NoError(t, err)
+	entries := readTestTar(t, tarPath)
+
+	manifests := []OutputManifest{}
+	require.NoError(t, encodingjson.Unmarshal(entries["manifest.json"], &manifests))
+	require.Len(t, manifests[0].Layers, 2)
+	for _, layer := range manifests[0].Layers {
+		require.Contains(t, entries, layer)
+	}
+}
+
+func TestOCIRefName(t *testing.T) {
+	require.Equal(t, "v1", ociRefName("app:v1"))
+	require.Equal(t, "v1", ociRefName("localhost:5000/team/app:v1"))
+	require.Equal(t, "", ociRefName("localhost:5000/team/app"))
+	require.Equal(t, "", ociRefName("app@sha256:"+strings.Repeat("a", 64)))
+	require.Equal(t, "", ociRefName("app:v1@sha256:"+strings.Repeat("a", 64)))
+}
+
+func TestCancelledBuildLeavesNoTar(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"app": "binary"})
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := builder.Build(ctx, image, BuildOpts{})
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoFileExists(t, builder.GetOutputPath("image.tar"))
+}
+
+func TestBuildOCITarFormat(t *testing.T) {
+	image, entries := buildTestTar(t, writeTestImage(t, t.TempDir(), nil, testLayer{"app": "binary"}), TarFormatOCI)
+
+	index := struct {
+		Manifests []ociIndexEntry `json:"manifests"`
+	}{}
+	require.NoError(t, encodingjson.Unmarshal(entries["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, "app:latest", index.Manifests[0].Annotations["io.containerd.image.name"])
+	require.Equal(t, "latest", index.Manifests[0].Annotations["org.opencontainers.image.ref.name"])
+
+	manifestBlob := blobName(index.Manifests[0].Digest)
+	require.ElementsMatch(t, []string{
+		"oci-layout",
+		"index.json",
+		manifestBlob,
+		blobName(image.Manifest.Config.Digest),
+		blobName(image.Manifest.Layers[0].Digest),
+	}, mapKeys(entries))
+
+	manifest := ociManifest{}
+	require.NoError(t, encodingjson.Unmarshal(entries[manifestBlob], &manifest))
+	require.Equal(t, image.Manifest.Config, manifest.Config)
+	require.Equal(t, image.Manifest.Layers, manifest.Layers)
+}
+
+func TestBuildRejectsUnknownTarFormat(t *testing.T) {
+	image := writeTestImage(t, t.TempDir(), nil, testLayer{"app": "binary"})
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+
+	_, err := builder.Build(context.Background(), image, BuildOpts{TarFormat: "zip"})
+	require.ErrorContains(t, err, "unsupported tar format")
+}
+
+func mapKeys(m map[string][]byte) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
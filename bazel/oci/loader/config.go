@@ -0,0 +1,119 @@
+// Defaults for the flags from a config file and the environment.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// flagEnvPrefix is prepended to the flag names to get their env variable, e.g.
+// LOADER_STRIP_ENV for --strip-env.
+const flagEnvPrefix = "LOADER_"
+
+// flagEnvVar returns the env variable that sets the named flag.
+func flagEnvVar(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyFlagDefaults fills in the flags not given on the command line, first
+// from their env variable and then from the config file. The precedence is
+// defaults < config file < env < flags. List flags are comma separated in
+// the env and YAML lists in the config file.
+func applyFlagDefaults(flags *pflag.FlagSet, configPath string, getenv func(string) string) error {
+	if !flags.Changed("config") && getenv(flagEnvVar("config")) != "" {
+		configPath = getenv(flagEnvVar("config"))
+	}
+
+	fileValues := map[string]interface{}{}
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return fmt.Errorf("error reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &fileValues); err != nil {
+			return fmt.Errorf("error parsing config file %s: %w", configPath, err)
+		}
+	}
+
+	for name := range fileValues {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q in config file %s", name, configPath)
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "config" {
+			return
+		}
+		if env := getenv(flagEnvVar(flag.Name)); env != "" {
+			if setErr := setFlagFromString(flag, env); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", flagEnvVar(flag.Name), setErr)
+			}
+			return
+		}
+		if value, ok := fileValues[flag.Name]; ok {
+			if setErr := setFlagFromYAML(flag, value); setErr != nil {
+				err = fmt.Errorf("invalid %s in config file: %w", flag.Name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+func setFlagFromString(flag *pflag.Flag, value string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		return slice.Replace(strings.Split(value, ","))
+	}
+	return flag.Value.Set(value)
+}
+
+func setFlagFromYAML(flag *pflag.Flag, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			return slice.Replace(items)
+		}
+		return flag.Value.Set(strings.Join(items, ","))
+	case map[string]interface{}:
+		pairs := []string{}
+		for key, item := range v {
+			pairs = append(pairs, key+"="+fmt.Sprint(item))
+		}
+		sort.Strings(pairs)
+		return flag.Value.Set(strings.Join(pairs, ","))
+	}
+	return flag.Value.Set(fmt.Sprint(value))
+}
+
+// byteSize is a flag holding a size in bytes, given as e.g. "512MB" or "2g"
+// with binary units.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	size, err := units.RAMInBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(size)
+	return nil
+}
+
+func (b *byteSize) Type() string {
+	return "size"
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+	configPath string
+}
+
+func (suite *ConfigTestSuite) SetupTest() {
+	suite.configPath = filepath.Join(suite.T().TempDir(), "loader.yaml")
+	suite.Require().NoError(os.WriteFile(suite.configPath, []byte(`
+output: json
+skip-if-running: true
+docker-conn-fd: 3
+strip-env:
+  - "*_TOKEN"
+  - AWS_SECRET_ACCESS_KEY
+overlay-array-merge:
+  config.Cmd: append
+`), 0o644))
+}
+
+// parse returns the effective options for the command line args and env.
+func (suite *ConfigTestSuite) parse(args []string, env map[string]string) (Options, error) {
+	o := Options{}
+	flags := pflag.NewFlagSet("loader", pflag.ContinueOnError)
+	registerFlags(flags, &o)
+	suite.Require().NoError(flags.Parse(args))
+	err := applyFlagDefaults(flags, o.ConfigFile, func(k string) string { return env[k] })
+	return o, err
+}
+
+func (suite *ConfigTestSuite) TestConfigFileSetsOptions() {
+	o, err := suite.parse([]string{"--config", suite.configPath}, nil)
+	suite.Require().NoError(err)
+	suite.Equal("json", o.Output)
+	suite.True(o.SkipIfRunning)
+	suite.Equal(3, o.DockerConnFD)
+	suite.Equal([]string{"*_TOKEN", "AWS_SECRET_ACCESS_KEY"}, o.StripEnv)
+	suite.Equal(map[string]string{"config.Cmd": "append"}, o.OverlayArrayMerge)
+}
+
+func (suite *ConfigTestSuite) TestFlagsOverrideEnvOverridesConfigFile() {
+	env := map[string]string{"LOADER_OUTPUT": "env", "LOADER_STRIP_ENV": "A,B"}
+	o, err := suite.parse([]string{"--config", suite.configPath, "--strip-env", "C"}, env)
+	suite.Require().NoError(err)
+	suite.Equal("env", o.Output)
+	suite.Equal([]string{"C"}, o.StripEnv)
+	suite.True(o.SkipIfRunning)
+}
+
+func (suite *ConfigTestSuite) TestConfigFileFromEnv() {
+	o, err := suite.parse(nil, map[string]string{"LOADER_CONFIG": suite.configPath})
+	suite.Require().NoError(err)
+	suite.Equal("json", o.Output)
+}
+
+func (suite *ConfigTestSuite) TestUnknownOptionInConfigFile() {
+	suite.Require().NoError(os.WriteFile(suite.configPath, []byte("no-such-flag: true\n"), 0o644))
+	_, err := suite.parse([]string{"--config", suite.configPath}, nil)
+	suite.ErrorContains(err, "no-such-flag")
+}
+
+func (suite *ConfigTestSuite) TestLayerSizeFlags() {
+	env := map[string]string{"LOADER_WARN_LAYER_SIZE": "512MB"}
+	o, err := suite.parse([]string{"--max-layer-size", "2g"}, env)
+	suite.Require().NoError(err)
+	suite.Equal(int64(2<<30), o.MaxLayerSize)
+	suite.Equal(int64(512<<20), o.WarnLayerSize)
+
+	_, err = suite.parse(nil, map[string]string{"LOADER_MAX_LAYER_SIZE": "lots"})
+	suite.Error(err)
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
@@ -0,0 +1,229 @@
+// Discovery of the Docker daemon the loader connects to.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/juanique/monorepo/salsa/go/json"
+)
+
+// defaultDockerSocket is where rootful Docker listens by default.
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// resolveDockerHost returns the daemon address to use, or an empty string to
+// keep the client defaults. An explicit host wins, then DOCKER_HOST, then the
+// default socket. Only when none of those work do we look for a rootless
+// daemon socket under XDG_RUNTIME_DIR.
+func resolveDockerHost(explicitHost string, getenv func(string) string, defaultSocket string) string {
+	if explicitHost != "" {
+		return explicitHost
+	}
+	if getenv(client.EnvOverrideHost) != "" || socketReachable(defaultSocket) {
+		return ""
+	}
+
+	runtimeDir := getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return ""
+	}
+	rootlessSocket := filepath.Join(runtimeDir, "docker.sock")
+	if !socketReachable(rootlessSocket) {
+		return ""
+	}
+
+	log.Println("Auto-detected rootless Docker socket at", rootlessSocket)
+	return "unix://" + rootlessSocket
+}
+
+// socketReachable reports whether something accepts connections on the given
+// unix socket.
+func socketReachable(path string) bool {
+	conn, err := net.DialTimeout("unix", strings.TrimPrefix(path, "unix://"), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// defaultDockerContext is the context of the docker CLI that stands for the
+// environment settings rather than a stored endpoint.
+const defaultDockerContext = "default"
+
+// dockerConfigDir is where the docker CLI keeps its config, credentials and
+// contexts: the explicit dir if any, then DOCKER_CONFIG, then ~/.docker.
+func dockerConfigDir(explicit string, getenv func(string) string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if dir := getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(getenv("HOME"), ".docker")
+}
+
+// selectDockerContext returns the name of the Docker context to use, or an
+// empty string for none. Like the docker CLI, an explicit context wins, then
+// DOCKER_CONTEXT, then the context chosen with `docker context use` unless
+// DOCKER_HOST is set.
+func selectDockerContext(explicit string, getenv func(string) string, configDir string) string {
+	name := explicit
+	if name == "" {
+		name = getenv("DOCKER_CONTEXT")
+	}
+	if name == "" && getenv(client.EnvOverrideHost) == "" {
+		config := struct {
+			CurrentContext string `json:"currentContext"`
+		}{}
+		if err := json.FromFile(filepath.Join(configDir, "config.json"), &config); err == nil {
+			name = config.CurrentContext
+		}
+	}
+	if name == defaultDockerContext {
+		return ""
+	}
+	return name
+}
+
+// dockerContextEndpoint is the daemon endpoint of a Docker context, as stored
+// by `docker context create`. The TLS files are empty when the context has
+// none.
+type dockerContextEndpoint struct {
+	Host          string
+	SkipTLSVerify bool
+	CAFile        string
+	CertFile      string
+	KeyFile       string
+}
+
+// loadDockerContext reads the docker endpoint of the named context from the
+// context store in configDir. Contexts are stored in directories named after
+// the sha256 of their name.
+func loadDockerContext(configDir, name string) (dockerContextEndpoint, error) {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+
+	meta := struct {
+		Endpoints map[string]struct {
+			Host          string `json:"Host"`
+			SkipTLSVerify bool   `json:"SkipTLSVerify"`
+		} `json:"Endpoints"`
+	}{}
+	metaPath := filepath.Join(configDir, "contexts", "meta", id, "meta.json")
+	if err := json.FromFile(metaPath, &meta); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return dockerContextEndpoint{}, fmt.Errorf("docker context %q not found in %s", name, configDir)
+		}
+		return dockerContextEndpoint{}, fmt.Errorf("error reading docker context %q: %w", name, err)
+	}
+	docker, ok := meta.Endpoints["docker"]
+	if !ok || docker.Host == "" {
+		return dockerContextEndpoint{}, fmt.Errorf("docker context %q has no docker endpoint", name)
+	}
+
+	endpoint := dockerContextEndpoint{Host: docker.Host, SkipTLSVerify: docker.SkipTLSVerify}
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	for file, path := range map[string]*string{"ca.pem": &endpoint.CAFile, "cert.pem": &endpoint.CertFile, "key.pem": &endpoint.KeyFile} {
+		if _, err := os.Stat(filepath.Join(tlsDir, file)); err == nil {
+			*path = filepath.Join(tlsDir, file)
+		}
+	}
+	return endpoint, nil
+}
+
+// usesTLS reports whether the endpoint needs a TLS client.
+func (e dockerContextEndpoint) usesTLS() bool {
+	return e.SkipTLSVerify || e.CAFile != "" || e.CertFile != "" || e.KeyFile != ""
+}
+
+// clientOpts returns the client options connecting to the endpoint.
+func (e dockerContextEndpoint) clientOpts() ([]client.Opt, error) {
+	opts := []client.Opt{}
+	if e.usesTLS() {
+		tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             e.CAFile,
+			CertFile:           e.CertFile,
+			KeyFile:            e.KeyFile,
+			InsecureSkipVerify: e.SkipTLSVerify,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error loading the TLS files of the docker context: %w", err)
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: tlsConfig},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	// The host goes last, so it configures the transport for its protocol.
+	return append(opts, client.WithHost(e.Host)), nil
+}
+
+// connFromFD wraps an already connected socket inherited as fd.
+func connFromFD(fd int) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("docker-conn-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid fd %d", fd)
+	}
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("error using fd %d as a Docker connection: %w", fd, err)
+	}
+	return conn, nil
+}
+
+// singleConnDialer returns a dialer that hands out conn instead of dialing.
+// The connection cannot be re-established, so only the first dial succeeds;
+// the client keeps it alive and reuses it for every request.
+func singleConnDialer(conn net.Conn) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var once sync.Once
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialed net.Conn
+		once.Do(func() { dialed = conn })
+		if dialed == nil {
+			return nil, fmt.Errorf("the Docker connection inherited with --docker-conn-fd was closed and cannot be dialed again")
+		}
+		return dialed, nil
+	}
+}
+
+// newDockerClient creates the Docker client for the daemon selected by opts.
+func newDockerClient(opts DockerLoaderOpts) (*client.Client, error) {
+	clientOpts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if opts.ConnFD != 0 {
+		conn, err := connFromFD(opts.ConnFD)
+		if err != nil {
+			return nil, err
+		}
+		clientOpts = append(clientOpts, client.WithDialContext(singleConnDialer(conn)))
+	} else if name := selectDockerContext(opts.DockerContext, os.Getenv, dockerConfigDir(opts.DockerConfig, os.Getenv)); name != "" && opts.DockerHost == "" {
+		endpoint, err := loadDockerContext(dockerConfigDir(opts.DockerConfig, os.Getenv), name)
+		if err != nil {
+			return nil, err
+		}
+		contextOpts, err := endpoint.clientOpts()
+		if err != nil {
+			return nil, err
+		}
+		clientOpts = append(clientOpts, contextOpts...)
+	} else if host := resolveDockerHost(opts.DockerHost, os.Getenv, defaultDockerSocket); host != "" {
+		clientOpts = append(clientOpts, client.WithHost(host))
+	}
+	return client.NewClientWithOpts(clientOpts...)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConnectionTestSuite struct {
+	suite.Suite
+}
+
+// listenUnix starts accepting connections on a unix socket at path.
+func (suite *ConnectionTestSuite) listenUnix(path string) {
+	listener, err := net.Listen("unix", path)
+	suite.Require().NoError(err)
+	suite.T().Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+}
+
+func (suite *ConnectionTestSuite) TestRootlessSocketChosenWhenDefaultAbsent() {
+	runtimeDir := suite.T().TempDir()
+	suite.listenUnix(filepath.Join(runtimeDir, "docker.sock"))
+
+	env := map[string]string{"XDG_RUNTIME_DIR": runtimeDir}
+	missingDefault := filepath.Join(suite.T().TempDir(), "docker.sock")
+
+	host := resolveDockerHost("", func(k string) string { return env[k] }, missingDefault)
+	suite.Equal("unix://"+filepath.Join(runtimeDir, "docker.sock"), host)
+}
+
+func (suite *ConnectionTestSuite) TestDefaultSocketPreferred() {
+	runtimeDir := suite.T().TempDir()
+	suite.listenUnix(filepath.Join(runtimeDir, "docker.sock"))
+
+	defaultSocket := filepath.Join(suite.T().TempDir(), "docker.sock")
+	suite.listenUnix(defaultSocket)
+
+	env := map[string]string{"XDG_RUNTIME_DIR": runtimeDir}
+	suite.Equal("", resolveDockerHost("", func(k string) string { return env[k] }, defaultSocket))
+}
+
+func (suite *ConnectionTestSuite) TestExplicitHostTakesPrecedence() {
+	runtimeDir := suite.T().TempDir()
+	suite.listenUnix(filepath.Join(runtimeDir, "docker.sock"))
+	missingDefault := filepath.Join(suite.T().TempDir(), "docker.sock")
+
+	env := map[string]string{"XDG_RUNTIME_DIR": runtimeDir}
+	getenv := func(k string) string { return env[k] }
+	suite.Equal("tcp://127.0.0.1:2375", resolveDockerHost("tcp://127.0.0.1:2375", getenv, missingDefault))
+
+	env["DOCKER_HOST"] = "tcp://127.0.0.1:2375"
+	suite.Equal("", resolveDockerHost("", getenv, missingDefault))
+}
+
+// writeDockerContext stores a context the way `docker context create` does,
+// with the given TLS files, returning the directory holding them.
+func (suite *ConnectionTestSuite) writeDockerContext(configDir, name, host string, skipTLSVerify bool, tlsFiles ...string) string {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+
+	metaDir := filepath.Join(configDir, "contexts", "meta", id)
+	suite.Require().NoError(os.MkdirAll(metaDir, 0o755))
+	meta := fmt.Sprintf(`{"Name":%q,"Metadata":{},"Endpoints":{"docker":{"Host":%q,"SkipTLSVerify":%t}}}`, name, host, skipTLSVerify)
+	suite.Require().NoError(os.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0o644))
+
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	suite.Require().NoError(os.MkdirAll(tlsDir, 0o755))
+	for _, file := range tlsFiles {
+		suite.Require().NoError(os.WriteFile(filepath.Join(tlsDir, file), []byte("pem"), 0o600))
+	}
+	return tlsDir
+}
+
+func (suite *ConnectionTestSuite) TestSelectDockerContext() {
+	configDir := suite.T().TempDir()
+	suite.Require().NoError(os.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"currentContext":"current"}`), 0o644))
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	suite.Equal("current", selectDockerContext("", getenv, configDir))
+	env["DOCKER_HOST"] = "tcp://127.0.0.1:2375"
+	suite.Equal("", selectDockerContext("", getenv, configDir))
+	env["DOCKER_CONTEXT"] = "from-env"
+	suite.Equal("from-env", selectDockerContext("", getenv, configDir))
+	suite.Equal("explicit", selectDockerContext("explicit", getenv, configDir))
+	suite.Equal("", selectDockerContext("default", getenv, configDir))
+}
+
+func (suite *ConnectionTestSuite) TestLoadDockerContextWithTLS() {
+	configDir := suite.T().TempDir()
+	tlsDir := suite.writeDockerContext(configDir, "remote", "tcp://build-host:2376", false, "ca.pem", "cert.pem", "key.pem")
+	suite.writeDockerContext(configDir, "insecure", "tcp://build-host:2375", true)
+
+	endpoint, err := loadDockerContext(configDir, "remote")
+	suite.Require().NoError(err)
+	suite.Equal(dockerContextEndpoint{
+		Host:     "tcp://build-host:2376",
+		CAFile:   filepath.Join(tlsDir, "ca.pem"),
+		CertFile: filepath.Join(tlsDir, "cert.pem"),
+		KeyFile:  filepath.Join(tlsDir, "key.pem"),
+	}, endpoint)
+	suite.True(endpoint.usesTLS())
+
+	endpoint, err = loadDockerContext(configDir, "insecure")
+	suite.Require().NoError(err)
+	suite.Equal(dockerContextEndpoint{Host: "tcp://build-host:2375", SkipTLSVerify: true}, endpoint)
+	opts, err := endpoint.clientOpts()
+	suite.Require().NoError(err)
+	cli, err := client.NewClientWithOpts(opts...)
+	suite.Require().NoError(err)
+	suite.Equal("tcp://build-host:2375", cli.DaemonHost())
+
+	_, err = loadDockerContext(configDir, "missing")
+	suite.ErrorContains(err, `docker context "missing" not found`)
+}
+
+func (suite *ConnectionTestSuite) TestClientConnectsToNamedContext() {
+	socket := filepath.Join(suite.T().TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	suite.Require().NoError(err)
+	defer listener.Close()
+	paths := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeDaemon(conn, paths)
+		}
+	}()
+
+	configDir := suite.T().TempDir()
+	suite.writeDockerContext(configDir, "local", "unix://"+socket, false)
+	suite.T().Setenv("DOCKER_CONFIG", configDir)
+	suite.T().Setenv("DOCKER_HOST", "")
+	suite.T().Setenv("DOCKER_CONTEXT", "")
+
+	cli, err := newDockerClient(DockerLoaderOpts{DockerContext: "local"})
+	suite.Require().NoError(err)
+	defer cli.Close()
+
+	version, err := cli.ServerVersion(context.Background())
+	suite.Require().NoError(err)
+	suite.Equal("fake-daemon", version.Version)
+}
+
+// serveFakeDaemon answers Docker API requests on conn, recording their paths.
+func serveFakeDaemon(conn net.Conn, paths chan<- string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		paths <- req.URL.Path
+
+		body := "OK"
+		if strings.HasSuffix(req.URL.Path, "/version") {
+			body = `{"Version":"fake-daemon"}`
+		}
+		resp := &http.Response{
+			Request:       req,
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Api-Version": {"1.43"}},
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(strings.NewReader(body)),
+		}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+func (suite *ConnectionTestSuite) TestClientUsesInheritedConnection() {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	suite.Require().NoError(err)
+	daemonFile := os.NewFile(uintptr(fds[1]), "daemon")
+	daemonConn, err := net.FileConn(daemonFile)
+	suite.Require().NoError(err)
+	daemonFile.Close()
+
+	paths := make(chan string, 10)
+	go serveFakeDaemon(daemonConn, paths)
+
+	cli, err := newDockerClient(DockerLoaderOpts{
+		// Would fail if the client dialed instead of using the fd.
+		DockerHost: "unix://" + filepath.Join(suite.T().TempDir(), "missing.sock"),
+		ConnFD:     fds[0],
+	})
+	suite.Require().NoError(err)
+	defer cli.Close()
+
+	version, err := cli.ServerVersion(context.Background())
+	suite.Require().NoError(err)
+	suite.Equal("fake-daemon", version.Version)
+	suite.Contains(<-paths, "/_ping")
+	suite.Contains(<-paths, "/version")
+}
+
+func (suite *ConnectionTestSuite) TestSingleConnDialerOnlyDialsOnce() {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	dial := singleConnDialer(conn)
+	dialed, err := dial(context.Background(), "unix", "/var/run/docker.sock")
+	suite.Require().NoError(err)
+	suite.Equal(conn, dialed)
+
+	_, err = dial(context.Background(), "unix", "/var/run/docker.sock")
+	suite.ErrorContains(err, "--docker-conn-fd was closed")
+}
+
+func (suite *ConnectionTestSuite) TestInheritedConnectionIsNotRetried() {
+	loaderOpts, err := newDockerLoaderOpts(context.Background(), Options{DockerConnFD: 3, MaxRetries: 3})
+	suite.Require().NoError(err)
+	_, ok := loaderOpts.Retry.take(retryBackoff)
+	suite.False(ok)
+}
+
+func TestConnectionTestSuite(t *testing.T) {
+	suite.Run(t, new(ConnectionTestSuite))
+}
@@ -0,0 +1,80 @@
+// Loading of several images from a single tar that packs their shared layers
+// once.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/juanique/monorepo/salsa/go/json"
+)
+
+// DedupStats counts the layer copies saved by packing shared layers once.
+type DedupStats struct {
+	Images       int   `json:"images"`
+	LayersPacked int   `json:"layersPacked"`
+	LayersShared int   `json:"layersShared"`
+	BytesSaved   int64 `json:"bytesSaved"`
+}
+
+// String summarizes the savings for the logs.
+func (s DedupStats) String() string {
+	return fmt.Sprintf("Packed %d layers for %d images, sharing %d layers (%d bytes) instead of packing them again",
+		s.LayersPacked, s.Images, s.LayersShared, s.BytesSaved)
+}
+
+// buildSharedTar builds a single docker-archive tar loading all the prepared
+// images, with every distinct layer blob packed once however many of the
+// images use it. Each image keeps its own config and tags in manifest.json.
+func buildSharedTar(ctx context.Context, images []preparedImage, opts BuildOpts) (string, DedupStats, error) {
+	if opts.TarFormat != "" && opts.TarFormat != TarFormatDocker {
+		return "", DedupStats{}, fmt.Errorf("sharing layers across images needs the %q tar format", TarFormatDocker)
+	}
+
+	stats := DedupStats{Images: len(images)}
+	shared := NewImageBuilder("shared", nil)
+	logger(ctx).Println("Staging dir is ", shared.stagingDir)
+	if err := os.MkdirAll(shared.blobsDir, 0o755); err != nil {
+		return "", stats, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	packed := map[string]string{}
+	manifests := []OutputManifest{}
+	for _, p := range images {
+		if err := checkLayers(ctx, p.Image, opts.FailOnEmptyLayers); err != nil {
+			return "", stats, err
+		}
+		if err := checkLayerSizes(ctx, p.Image, opts.MaxLayerSize, opts.WarnLayerSize); err != nil {
+			return "", stats, err
+		}
+
+		manifest := OutputManifest{
+			Config:   shared.AddBlob(p.Builder.ConfigPath).rel,
+			RepoTags: p.Builder.repoTags,
+			Layers:   []string{},
+		}
+		for _, layer := range p.Image.Manifest.Layers {
+			rel, ok := packed[layer.Digest]
+			if ok {
+				stats.LayersShared++
+				stats.BytesSaved += int64(layer.Size)
+			} else {
+				rel = shared.AddLayerBlob(ctx, p.Image.BlobPath(layer.Digest), nil).rel
+				packed[layer.Digest] = rel
+				stats.LayersPacked++
+			}
+			manifest.Layers = append(manifest.Layers, rel)
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	tarInputs, err := shared.stageFiles()
+	if err != nil {
+		return "", stats, err
+	}
+	if err := json.ToFile(shared.GetOutputPath("manifest.json"), manifests); err != nil {
+		return "", stats, err
+	}
+	tarPath, err := shared.writeTar(ctx, append(tarInputs, "manifest.json"))
+	return tarPath, stats, err
+}
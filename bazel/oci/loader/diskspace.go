@@ -0,0 +1,134 @@
+// Preflight check that the daemon has room for the image before loading it.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/go-units"
+)
+
+// infoGetter is the part of the Docker client used to find where the daemon
+// keeps its data.
+type infoGetter interface {
+	Info(ctx context.Context) (system.Info, error)
+}
+
+// availableBytes returns the space available to unprivileged users on the
+// filesystem holding dir.
+func availableBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// imageSize is the size of the config and the layer blobs of the image, as
+// listed in the manifest.
+func imageSize(i Image) int64 {
+	size := int64(i.Manifest.Config.Size)
+	for _, layer := range i.Manifest.Layers {
+		size += int64(layer.Size)
+	}
+	return size
+}
+
+// compressionRatioEstimate is how many times larger than its blob a
+// compressed layer is assumed to be once unpacked, when its real size is not
+// known. It is on the high side of typical gzip ratios for image layers, so
+// the check errs on the side of asking for too much space.
+const compressionRatioEstimate = 4
+
+// unpackedImageSize estimates the space the image takes in the daemon once
+// its layers are unpacked. The unpacked size of a gzipped layer is read from
+// the ISIZE trailer of the blob, which has the uncompressed size modulo 2^32;
+// layers where that is smaller than the blob, e.g. over 4GiB, and layers
+// compressed otherwise, are estimated with compressionRatioEstimate.
+func unpackedImageSize(i Image) int64 {
+	size := int64(i.Manifest.Config.Size)
+	for _, layer := range i.Manifest.Layers {
+		size += unpackedLayerSize(i.BlobPath(layer.Digest), int64(layer.Size))
+	}
+	return size
+}
+
+// unpackedLayerSize estimates the unpacked size of the layer blob at path,
+// of size bytes.
+func unpackedLayerSize(path string, size int64) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return size * compressionRatioEstimate
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return size
+	}
+	switch {
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		trailer := make([]byte, 4)
+		info, err := f.Stat()
+		if err != nil || info.Size() < 4 {
+			return size * compressionRatioEstimate
+		}
+		if _, err := f.ReadAt(trailer, info.Size()-4); err != nil {
+			return size * compressionRatioEstimate
+		}
+		if isize := int64(binary.LittleEndian.Uint32(trailer)); isize >= size {
+			return isize
+		}
+		return size * compressionRatioEstimate
+	case binary.LittleEndian.Uint32(magic) == zstdMagic:
+		return size * compressionRatioEstimate
+	default:
+		// An uncompressed tar.
+		return size
+	}
+}
+
+// zstdMagic starts every zstd frame.
+const zstdMagic = 0xfd2fb528
+
+// checkDiskSpace fails if the filesystem of the daemon data root has less
+// than needed bytes available. The data root is looked up on the local host,
+// so the check is skipped when it is not there, as with remote daemons or
+// daemons running in a VM.
+func checkDiskSpace(ctx context.Context, cli infoGetter, available func(string) (int64, error), needed int64) error {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting the Docker daemon info: %w", err)
+	}
+	if info.DockerRootDir == "" {
+		logger(ctx).Println("Skipping the disk space check, the daemon did not report its data root")
+		return nil
+	}
+
+	free, err := available(info.DockerRootDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger(ctx).Println("Skipping the disk space check,", info.DockerRootDir, "is not on this host")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking the space available in %s: %w", info.DockerRootDir, err)
+	}
+
+	if free < needed {
+		return fmt.Errorf("not enough disk space to load the image: it needs at least %s but only %s is available in %s",
+			units.BytesSize(float64(needed)), units.BytesSize(float64(free)), info.DockerRootDir)
+	}
+	return nil
+}
+
+// CheckDiskSpace fails if the daemon has not got room for needed bytes.
+func (d *DockerLoader) CheckDiskSpace(ctx context.Context, needed int64) error {
+	return checkDiskSpace(ctx, d.cli, availableBytes, needed)
+}
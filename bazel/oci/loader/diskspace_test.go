@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/system"
+	"github.com/stretchr/testify/suite"
+)
+
+type DiskSpaceTestSuite struct {
+	suite.Suite
+}
+
+// fakeInfoGetter reports a fixed daemon data root.
+type fakeInfoGetter string
+
+func (f fakeInfoGetter) Info(ctx context.Context) (system.Info, error) {
+	return system.Info{DockerRootDir: string(f)}, nil
+}
+
+// fixedAvailable reports the same available space for any directory.
+func fixedAvailable(free int64) func(string) (int64, error) {
+	return func(string) (int64, error) { return free, nil }
+}
+
+func (suite *DiskSpaceTestSuite) TestEnoughSpace() {
+	ctx := context.Background()
+	suite.NoError(checkDiskSpace(ctx, fakeInfoGetter("/var/lib/docker"), fixedAvailable(2048), 1024))
+}
+
+func (suite *DiskSpaceTestSuite) TestNotEnoughSpaceAborts() {
+	ctx := context.Background()
+	err := checkDiskSpace(ctx, fakeInfoGetter("/var/lib/docker"), fixedAvailable(1024), 2048)
+	suite.ErrorContains(err, "not enough disk space to load the image: it needs at least 2KiB but only 1KiB is available in /var/lib/docker")
+}
+
+func (suite *DiskSpaceTestSuite) TestRemoteDataRootIsSkipped() {
+	ctx := context.Background()
+	missing := func(dir string) (int64, error) {
+		return 0, fmt.Errorf("statfs %s: %w", dir, fs.ErrNotExist)
+	}
+	suite.NoError(checkDiskSpace(ctx, fakeInfoGetter("/var/lib/docker"), missing, 2048))
+	suite.NoError(checkDiskSpace(ctx, fakeInfoGetter(""), fixedAvailable(0), 2048))
+}
+
+func (suite *DiskSpaceTestSuite) TestUnpackedLayerSize() {
+	dir := suite.T().TempDir()
+	layer := tarTestLayer(suite.T(), testLayer{"app": strings.Repeat("binary", 1000)})
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, err := gz.Write(layer)
+	suite.Require().NoError(err)
+	suite.Require().NoError(gz.Close())
+	gzPath := filepath.Join(dir, "layer.tar.gz")
+	suite.Require().NoError(os.WriteFile(gzPath, gzipped.Bytes(), 0o644))
+	suite.Equal(int64(len(layer)), unpackedLayerSize(gzPath, int64(gzipped.Len())))
+
+	tarPath := filepath.Join(dir, "layer.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, layer, 0o644))
+	suite.Equal(int64(len(layer)), unpackedLayerSize(tarPath, int64(len(layer))))
+
+	zstdPath := filepath.Join(dir, "layer.tar.zst")
+	suite.Require().NoError(os.WriteFile(zstdPath, []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}, 0o644))
+	suite.Equal(int64(8*compressionRatioEstimate), unpackedLayerSize(zstdPath, 8))
+
+	// An ISIZE below the blob size has wrapped around 4GiB.
+	wrapped := append(append([]byte(nil), gzipped.Bytes()[:gzipped.Len()-4]...), 1, 0, 0, 0)
+	suite.Require().NoError(os.WriteFile(gzPath, wrapped, 0o644))
+	suite.Equal(int64(len(wrapped)*compressionRatioEstimate), unpackedLayerSize(gzPath, int64(len(wrapped))))
+}
+
+func (suite *DiskSpaceTestSuite) TestLoadAbortsBeforeBuilding() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	// Far more than any test machine has available.
+	image.Manifest.Layers[0].Size = 1 << 60
+
+	cli := newFakeDockerAPI()
+	cli.info = system.Info{DockerRootDir: suite.T().TempDir()}
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	_, err := loadImage(context.Background(), loader, image, []string{"app:latest"}, Options{CheckDiskSpace: true})
+	suite.ErrorContains(err, "not enough disk space to load the image")
+	suite.Equal(PhaseCheck, newErrorOutput(err).Phase)
+	suite.Empty(cli.loadedTars)
+}
+
+func TestDiskSpaceTestSuite(t *testing.T) {
+	suite.Run(t, new(DiskSpaceTestSuite))
+}
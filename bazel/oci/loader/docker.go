@@ -4,18 +4,79 @@ package main
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 
- 	"github.com/docker/docker/api/types"
- 	"github.com/docker/docker/client"
- 	"github.com/juanique/monorepo/salsa/go/json"
+	encodingjson "encoding/json"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/juanique/monorepo/salsa/go/must"
 )
 
-// areConfigsEqual compares the OCI config map with the Docker image config.
-func areConfigsEqual(ociConfig map[string]interface{}, dockerImage types.ImageInspect) bool {
+// comparableConfigFields lists every container config field that
+// areConfigsEqual knows how to compare.
+var comparableConfigFields = []string{
+	"Env",
+	"Cmd",
+	"Entrypoint",
+	"WorkingDir",
+	"User",
+	"Labels",
+	"ExposedPorts",
+	"Volumes",
+	"Healthcheck",
+	"StopSignal",
+}
+
+// defaultCompareFields are the fields compared when no explicit field set is
+// requested.
+var defaultCompareFields = []string{"Env", "Entrypoint", "Cmd", "WorkingDir", "User", "Labels"}
+
+// ConfigFieldSet is the set of container config fields considered when
+// comparing an OCI config against an existing Docker image.
+type ConfigFieldSet map[string]bool
+
+// NewConfigFieldSet builds the field set from an allowlist and a denylist. An
+// empty allowlist means the default fields.
+func NewConfigFieldSet(compare, ignore []string) (ConfigFieldSet, error) {
+	known := map[string]bool{}
+	for _, field := range comparableConfigFields {
+		known[field] = true
+	}
+
+	if len(compare) == 0 {
+		compare = defaultCompareFields
+	}
+
+	fields := ConfigFieldSet{}
+	for _, field := range compare {
+		if !known[field] {
+			return nil, fmt.Errorf("unknown config field %q, must be one of %v", field, comparableConfigFields)
+		}
+		fields[field] = true
+	}
+	for _, field := range ignore {
+		if !known[field] {
+			return nil, fmt.Errorf("unknown config field %q, must be one of %v", field, comparableConfigFields)
+		}
+		delete(fields, field)
+	}
+	return fields, nil
+}
+
+// areConfigsEqual compares the OCI config map with the Docker image config,
+// only looking at the given container config fields. With normalizeUser, the
+// User fields are compared with usersEqual instead of as raw strings.
+func areConfigsEqual(ociConfig map[string]interface{}, dockerImage types.ImageInspect, fields ConfigFieldSet, normalizeUser bool) bool {
 	// Compare Architecture and OS
 	if ociConfig["architecture"] != dockerImage.Architecture {
 		return false
@@ -29,46 +90,140 @@ func areConfigsEqual(ociConfig map[string]interface{}, dockerImage types.ImageIn
 	if !ok {
 		return false
 	}
+	dockerConfig := dockerImage.Config
+	if dockerConfig == nil {
+		dockerConfig = &container.Config{}
+	}
 
 	// Compare specific fields like Env, Cmd, Entrypoint, Labels
 	// We construct a temporary container.Config from OCI map to let usage of reflect or manual comparison
 	// But since we have a map, let's check key fields.
 
 	// Check Env
-	if !slicesEqual(getStringSlice(ociContainerConfig, "Env"), dockerImage.Config.Env) {
+	if fields["Env"] && !slicesEqual(getStringSlice(ociContainerConfig, "Env"), dockerConfig.Env) {
 		return false
 	}
 	// Check Entrypoint
-	if !slicesEqual(getStringSlice(ociContainerConfig, "Entrypoint"), dockerImage.Config.Entrypoint) {
+	if fields["Entrypoint"] && !slicesEqual(getStringSlice(ociContainerConfig, "Entrypoint"), dockerConfig.Entrypoint) {
 		return false
 	}
 	// Check Cmd
-	if !slicesEqual(getStringSlice(ociContainerConfig, "Cmd"), dockerImage.Config.Cmd) {
+	if fields["Cmd"] && !slicesEqual(getStringSlice(ociContainerConfig, "Cmd"), dockerConfig.Cmd) {
 		return false
 	}
 	// Check WorkingDir
-	if getString(ociContainerConfig, "WorkingDir") != dockerImage.Config.WorkingDir {
+	if fields["WorkingDir"] && getString(ociContainerConfig, "WorkingDir") != dockerConfig.WorkingDir {
 		return false
 	}
 	// Check User
-	if getString(ociContainerConfig, "User") != dockerImage.Config.User {
+	if fields["User"] {
+		ociUser := getString(ociContainerConfig, "User")
+		if normalizeUser && !usersEqual(ociUser, dockerConfig.User) {
+			return false
+		}
+		if !normalizeUser && ociUser != dockerConfig.User {
+			return false
+		}
+	}
+	// Check StopSignal
+	if fields["StopSignal"] && getString(ociContainerConfig, "StopSignal") != dockerConfig.StopSignal {
 		return false
 	}
 
 	// Check Labels
-	ociLabels := getMapStringString(ociContainerConfig, "Labels")
-	if len(ociLabels) != len(dockerImage.Config.Labels) {
-		return false
-	}
-	for k, v := range ociLabels {
-		if dockerImage.Config.Labels[k] != v {
+	if fields["Labels"] {
+		ociLabels := getMapStringString(ociContainerConfig, "Labels")
+		if len(ociLabels) != len(dockerConfig.Labels) {
 			return false
 		}
+		for k, v := range ociLabels {
+			if dockerConfig.Labels[k] != v {
+				return false
+			}
+		}
+	}
+
+	// The remaining fields are nested structures, compare them through their
+	// JSON representation.
+	if fields["ExposedPorts"] && !jsonValuesEqual(ociContainerConfig["ExposedPorts"], dockerConfig.ExposedPorts) {
+		return false
+	}
+	if fields["Volumes"] && !jsonValuesEqual(ociContainerConfig["Volumes"], dockerConfig.Volumes) {
+		return false
+	}
+	if fields["Healthcheck"] && !jsonValuesEqual(ociContainerConfig["Healthcheck"], dockerConfig.Healthcheck) {
+		return false
 	}
 
 	return true
 }
 
+// splitUser returns the user and group of a config User field. An empty user
+// and "0" are the root user.
+func splitUser(user string) (string, string) {
+	name, group, _ := strings.Cut(strings.TrimSpace(user), ":")
+	name, group = strings.TrimSpace(name), strings.TrimSpace(group)
+	if name == "" || name == "0" {
+		name = "root"
+	}
+	if group == "0" {
+		group = "root"
+	}
+	return name, group
+}
+
+// usersEqual compares two config User fields. A user without a group gets
+// the primary group from the image's /etc/passwd, which is not read, so
+// "uid" only equals "uid:0", the group used without a passwd entry, and
+// "uid:uid", the group of the usual one group per user setup; "uid:gid" with
+// any other group differs. Names other than root cannot be resolved to their
+// uid either, so "appuser" and "1000" still differ.
+func usersEqual(a, b string) bool {
+	nameA, groupA := splitUser(a)
+	nameB, groupB := splitUser(b)
+	if nameA != nameB {
+		return false
+	}
+	return groupA == groupB || defaultGroup(nameA, groupA, groupB) || defaultGroup(nameB, groupB, groupA)
+}
+
+// defaultGroup reports whether a user with the given group, empty if none,
+// may end up running with the other group.
+func defaultGroup(name, group, other string) bool {
+	return group == "" && (other == "root" || other == name)
+}
+
+// jsonValuesEqual compares a value decoded from the OCI config JSON with a
+// Docker API value by round-tripping the latter through JSON. Absent and empty
+// values are considered equal.
+func jsonValuesEqual(ociValue interface{}, dockerValue interface{}) bool {
+	data, err := encodingjson.Marshal(dockerValue)
+	if err != nil {
+		return false
+	}
+	var normalized interface{}
+	if err := encodingjson.Unmarshal(data, &normalized); err != nil {
+		return false
+	}
+
+	if isEmptyJSONValue(ociValue) && isEmptyJSONValue(normalized) {
+		return true
+	}
+	return reflect.DeepEqual(ociValue, normalized)
+}
+
+func isEmptyJSONValue(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(val) == 0
+	case []interface{}:
+		return len(val) == 0
+	}
+	return false
+}
+
 func getStringSlice(m map[string]interface{}, key string) []string {
 	val, ok := m[key]
 	if !ok || val == nil {
@@ -137,30 +292,264 @@ type DockerLoadAction struct {
 	TagsAdded          []string `json:"tagsAdded"`
 	TagsAlreadyPresent []string `json:"tagsAlreadyPresent"`
 	LoadTime           string   `json:"loadTime"`
+	SkippedReason      string   `json:"skippedReason,omitempty"`
+
+	// ExistingID is the ID of the image found in the daemon when it differs
+	// from Digest, e.g. for images matched by config.
+	ExistingID string `json:"existingId,omitempty"`
+
+	// TagsRepointed were moved from another image, and are also in
+	// TagsAdded. TagsSkipped were left on another image.
+	TagsRepointed []string `json:"tagsRepointed,omitempty"`
+	TagsSkipped   []string `json:"tagsSkipped,omitempty"`
+
+	// LoadedID is the ID the daemon reported for the loaded image when it
+	// differs from Digest.
+	LoadedID string `json:"loadedId,omitempty"`
+
+	// Forced is set when the image was loaded ignoring the images in the
+	// daemon, as requested by NoCache.
+	Forced bool `json:"forced,omitempty"`
+
+	// PulledFrom is the registry cache reference the image was pulled from
+	// instead of being built and loaded.
+	PulledFrom string `json:"pulledFrom,omitempty"`
+
+	LayerStats
+
+	// KindNodes has the result of importing the image into each node when
+	// loading into a kind cluster.
+	KindNodes []KindNodeLoad `json:"kindNodes,omitempty"`
 }
 
-// JSON returns the JSON representation of the DockerLoadAction
+// JSON returns the JSON representation of the DockerLoadAction. Tag slices are
+// sorted and digests canonicalized so the output is stable across runs and
+// machines.
 func (d DockerLoadAction) JSON() string {
-	return json.MustToJSON(d)
+	return json.MustToJSON(d.canonicalCopy())
+}
+
+// JSONArray returns the JSON representation of a one element array holding
+// the DockerLoadAction.
+func (d DockerLoadAction) JSONArray() string {
+	return json.MustToJSON([]DockerLoadAction{d.canonicalCopy()})
+}
+
+// DaemonDigest returns the ID the image has in the daemon, which is Digest
+// unless an existing image with a different ID was found or the daemon
+// reported another ID for the loaded image.
+func (d DockerLoadAction) DaemonDigest() string {
+	if d.ExistingID != "" {
+		return d.ExistingID
+	}
+	if d.LoadedID != "" {
+		return d.LoadedID
+	}
+	return d.Digest
+}
+
+// sortedCopy returns a copy of the action with sorted tag slices.
+func (d DockerLoadAction) sortedCopy() DockerLoadAction {
+	d.TagsAdded = append([]string(nil), d.TagsAdded...)
+	d.TagsAlreadyPresent = append([]string(nil), d.TagsAlreadyPresent...)
+	d.TagsRepointed = append([]string(nil), d.TagsRepointed...)
+	d.TagsSkipped = append([]string(nil), d.TagsSkipped...)
+	d.SortTags()
+	return d
+}
+
+// canonicalCopy returns a sorted copy of the action with every digest in the
+// full "sha256:<hex>" form.
+func (d DockerLoadAction) canonicalCopy() DockerLoadAction {
+	d = d.sortedCopy()
+	d.Digest = canonicalDigest(d.Digest)
+	d.ExistingID = canonicalDigest(d.ExistingID)
+	d.LoadedID = canonicalDigest(d.LoadedID)
+	return d
+}
+
+// canonicalDigest returns the digest as "sha256:<hex>", adding the algorithm
+// when missing and lowercasing the hex. Short IDs cannot be expanded without
+// asking the daemon, so anything but a full digest is returned as is.
+func canonicalDigest(digest string) string {
+	hex := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(digest), "sha256:"))
+	if canonical := "sha256:" + hex; digestPattern.MatchString(canonical) {
+		return canonical
+	}
+	return digest
+}
+
+// SortTags sorts the tag slices of the action in place.
+func (d *DockerLoadAction) SortTags() {
+	sort.Strings(d.TagsAdded)
+	sort.Strings(d.TagsAlreadyPresent)
+	sort.Strings(d.TagsRepointed)
+	sort.Strings(d.TagsSkipped)
+}
+
+// DockerLoaderOpts controls how a DockerLoader connects to the daemon and
+// decides whether an image is already loaded.
+type DockerLoaderOpts struct {
+	// DockerHost is the daemon address. Empty means DOCKER_HOST or the
+	// auto-detected socket.
+	DockerHost string
+
+	// DockerContext is the Docker context to connect to. Empty means
+	// DOCKER_CONTEXT or the current context of the docker CLI, if any.
+	DockerContext string
+
+	// ConnFD is an inherited fd already connected to the daemon, used instead
+	// of dialing it. Zero means dialing normally.
+	ConnFD int
+
+	// DockerConfig is the config dir of the docker CLI the contexts are read
+	// from. Empty means DOCKER_CONFIG or ~/.docker.
+	DockerConfig string
+
+	// CompareFields is the set of config fields used for the loose config
+	// match. Nil means the default fields.
+	CompareFields ConfigFieldSet
+
+	// NormalizeUser compares the User fields with usersEqual instead of as
+	// raw strings.
+	NormalizeUser bool
+
+	// MatchLayers also looks for an image with the same layers and config
+	// among the images loaded by this tool under any tag, which costs
+	// listing and inspecting them.
+	MatchLayers bool
+
+	// MatchByDiffIDs also considers the image loaded if the daemon has an
+	// image with exactly the same layer diff IDs, whatever its config.
+	MatchByDiffIDs bool
+
+	// RetagOnConfigMatch considers the image tagged with the first repo tag
+	// loaded when its config matches even if its layers differ. It saves reloading images rebuilt with the same content but
+	// non-reproducible layers, at the risk of tagging an image with different
+	// files.
+	RetagOnConfigMatch bool
+
+	// RequireLabels are labels an existing image must carry, with these
+	// values, to be matched by config or layers. Matches by ID are not
+	// affected.
+	RequireLabels map[string]string
+
+	// OnConflict is what to do with a requested tag that points at another
+	// image: conflictRepoint, the default, conflictSkip or conflictFail.
+	OnConflict string
+
+	// TagIfAbsent only creates the tags missing from the daemon. Tags on
+	// another image are left untouched and reported as skipped, overriding
+	// OnConflict.
+	TagIfAbsent bool
+
+	// VerifyLoaded inspects the image after loading it, failing the load if
+	// the daemon does not have it.
+	VerifyLoaded bool
+
+	// RegistryCache is checked for the image before building it. Nil means
+	// always building it.
+	RegistryCache *RegistryCache
+
+	// NoCache loads the image even if the daemon already has it, and never
+	// pulls it from the registry cache.
+	NoCache bool
+
+	// Retry is the retry budget shared by all the operations. Nil means
+	// failing on the first error.
+	Retry *RetryBudget
+}
+
+// dockerAPI is the part of the Docker client used by DockerLoader.
+type dockerAPI interface {
+	kindAPI
+	versionGetter
+	infoGetter
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]image.Summary, error)
+	ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error)
+	ImageTag(ctx context.Context, image, ref string) error
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+	ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error)
 }
 
 // DockerLoader holds a Docker client and provides methods to interact with Docker.
 type DockerLoader struct {
-	cli *client.Client
+	cli  dockerAPI
+	opts DockerLoaderOpts
 }
 
 // NewDockerLoader creates a new DockerLoader using sensible defaults.
-func NewDockerLoader() (*DockerLoader, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+func NewDockerLoader(opts DockerLoaderOpts) (*DockerLoader, error) {
+	cli, err := newDockerClient(opts)
 	if err != nil {
 		return nil, fmt.Errorf("error creating Docker client: %w", err)
 	}
-	return &DockerLoader{cli: cli}, nil
+	return newDockerLoaderWithAPI(cli, opts), nil
+}
+
+// newDockerLoaderWithAPI creates a DockerLoader using the given client.
+func newDockerLoaderWithAPI(cli dockerAPI, opts DockerLoaderOpts) *DockerLoader {
+	if opts.CompareFields == nil {
+		opts.CompareFields = must.Must(NewConfigFieldSet(nil, nil))
+	}
+	return &DockerLoader{cli: cli, opts: opts}
+}
+
+// WithOpts returns a DockerLoader sharing the same client but using different
+// options.
+func (d *DockerLoader) WithOpts(opts DockerLoaderOpts) *DockerLoader {
+	if opts.CompareFields == nil {
+		opts.CompareFields = d.opts.CompareFields
+	}
+	if opts.Retry == nil {
+		opts.Retry = d.opts.Retry
+	}
+	return &DockerLoader{cli: d.cli, opts: opts}
+}
+
+// inspectImage inspects an image, retrying transient failures.
+func (d *DockerLoader) inspectImage(ctx context.Context, ref string) (types.ImageInspect, error) {
+	var inspect types.ImageInspect
+	err := d.opts.Retry.Do(ctx, "inspect "+ref, func() error {
+		var err error
+		inspect, _, err = d.cli.ImageInspectWithRaw(ctx, ref)
+		return err
+	})
+	return inspect, err
+}
+
+// ExistingLayerChains returns the layer diff IDs of the images currently
+// tagged with any of the given tags and of the base images loaded by
+// warm-cache.
+func (d *DockerLoader) ExistingLayerChains(ctx context.Context, repoTags []string) [][]string {
+	chains := d.warmLayerChains(ctx)
+	for _, tag := range repoTags {
+		inspect, err := d.inspectImage(ctx, tag)
+		if err != nil {
+			continue
+		}
+		chains = append(chains, inspect.RootFS.Layers)
+	}
+	return chains
+}
+
+// RequireDaemonVersion fails unless the daemon is at least the required
+// version, e.g. ">=24.0".
+func (d *DockerLoader) RequireDaemonVersion(ctx context.Context, requirement string) error {
+	return checkDaemonVersion(ctx, d.cli, requirement)
+}
+
+// KindLoader returns a KindLoader for the named cluster sharing the same
+// client.
+func (d *DockerLoader) KindLoader(cluster string) *KindLoader {
+	return NewKindLoader(d.cli, cluster)
 }
 
 // TagImage tags a Docker image with a new tag
 func (d *DockerLoader) TagImage(ctx context.Context, imageID, tag string) error {
-	err := d.cli.ImageTag(ctx, imageID, tag)
+	err := d.opts.Retry.Do(ctx, "tag "+tag, func() error {
+		return d.cli.ImageTag(ctx, imageID, tag)
+	})
 	if err != nil {
 		return fmt.Errorf("error tagging image: %w", err)
 	}
@@ -173,9 +562,17 @@ func (d *DockerLoader) TagImage(ctx context.Context, imageID, tag string) error
 func (d *DockerLoader) checkForExistingImage(ctx context.Context, imageID string, tags []string) (DockerLoadAction, error) {
 	action := DockerLoadAction{}
 
-	images, err := d.cli.ImageList(ctx, types.ImageListOptions{})
-	if err != nil {
-		return action, fmt.Errorf("error listing Docker images: %w", err)
+	// With NoCache nothing is found, so the image is loaded again.
+	var images []types.ImageSummary
+	if !d.opts.NoCache {
+		err := d.opts.Retry.Do(ctx, "image list", func() error {
+			var err error
+			images, err = d.cli.ImageList(ctx, types.ImageListOptions{})
+			return err
+		})
+		if err != nil {
+			return action, fmt.Errorf("error listing Docker images: %w", err)
+		}
 	}
 
 	tagsPresent := map[string]bool{}
@@ -194,7 +591,8 @@ func (d *DockerLoader) checkForExistingImage(ctx context.Context, imageID string
 
 	if !action.AlreadyLoaded {
 		// We'll add all tags during the load itself
-		action.TagsAdded = tags
+		action.TagsAdded = append([]string(nil), tags...)
+		action.SortTags()
 		return action, nil
 	}
 
@@ -206,77 +604,366 @@ func (d *DockerLoader) checkForExistingImage(ctx context.Context, imageID string
 		}
 	}
 
-	for tag, alreadyPresent := range tagsPresent {
-		if alreadyPresent {
+	for _, tag := range tags {
+		if tagsPresent[tag] {
 			action.TagsAlreadyPresent = append(action.TagsAlreadyPresent, tag)
 			continue
 		}
 
 		// Tag not there, we need to tag the image
-		d.TagImage(ctx, imageID, tag)
-		action.TagsAdded = append(action.TagsAlreadyPresent, tag)
+		if err := d.TagImage(ctx, imageID, tag); err != nil {
+			return action, err
+		}
+		action.TagsAdded = append(action.TagsAdded, tag)
 	}
 
 	action.Digest = imageID
+	action.SortTags()
 
 	return action, nil
 }
 
-type LoadError struct {
+// containerLister is the part of the Docker client used to look up containers.
+type containerLister interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+}
+
+// findRunningContainers returns the IDs of the running containers that were
+// created from any of the given image references.
+func findRunningContainers(ctx context.Context, cli containerLister, refs []string) ([]string, error) {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		args := filters.NewArgs(filters.Arg("ancestor", ref), filters.Arg("status", "running"))
+		containers, err := cli.ContainerList(ctx, container.ListOptions{Filters: args})
+		if client.IsErrNotFound(err) {
+			// The reference does not exist yet, so nothing can be using it.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error listing containers using %s: %w", ref, err)
+		}
+		for _, c := range containers {
+			if !seen[c.ID] {
+				seen[c.ID] = true
+				ids = append(ids, c.ID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// RunningContainers returns the IDs of running containers using an image
+// tagged with any of the given tags.
+func (d *DockerLoader) RunningContainers(ctx context.Context, repoTags []string) ([]string, error) {
+	return findRunningContainers(ctx, d.cli, repoTags)
+}
+
+// LoadMessage is one of the JSON messages streamed back by an image load.
+type LoadMessage struct {
+	Stream      string `json:"stream"`
 	ErrorDetail struct {
 		Message string `json:"message"`
 	} `json:"errorDetail"`
 }
 
+// loadedImageIDPrefix starts the message the daemon confirms the load of an
+// untagged image with, followed by its ID.
+const loadedImageIDPrefix = "Loaded image ID:"
 
+// readLoadResponse reads the messages streamed back by an image load,
+// returning the ID the daemon reported for the loaded image, if any. Tagged
+// images are only confirmed by tag. The load only succeeded if the daemon
+// confirmed it with a "Loaded image" message; a stream that ends before that,
+// e.g. because the connection dropped, is an error.
+func readLoadResponse(ctx context.Context, body io.Reader) (string, error) {
+	decoder := encodingjson.NewDecoder(body)
+	loaded := false
+	loadedID := ""
+	for {
+		msg := LoadMessage{}
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading load response: %w", err)
+		}
 
-// CheckImageExists checks if the image already exists in Docker using ID or fuzzy config match.
-// If valid, returns true and an Action with AlreadyLoaded=true (and ensures tags).
-// If invalid, returns false.
-func (d *DockerLoader) CheckImageExists(ctx context.Context, imageID string, ociConfig map[string]interface{}, repoTags []string) (bool, DockerLoadAction, error) {
-	action := DockerLoadAction{Digest: imageID}
+		if msg.ErrorDetail.Message != "" {
+			logger(ctx).Println("Load error:", msg.ErrorDetail.Message)
+			return "", &daemonReportedError{fmt.Errorf("Error loading tar file into Docker, error details: %s", msg.ErrorDetail.Message)}
+		}
+		if strings.HasPrefix(msg.Stream, loadedImageIDPrefix) {
+			loadedID = strings.TrimSpace(strings.TrimPrefix(msg.Stream, loadedImageIDPrefix))
+		}
+		if strings.HasPrefix(msg.Stream, "Loaded image") {
+			loaded = true
+		}
+	}
+
+	if !loaded {
+		return "", fmt.Errorf("load response ended without confirming the image was loaded: %w", io.ErrUnexpectedEOF)
+	}
+	return loadedID, nil
+}
+
+// daemonReportedError is an error the daemon reported in the errorDetail of a
+// response stream. The daemon already decided the operation failed, so it is
+// never retried.
+type daemonReportedError struct {
+	error
+}
 
+func (e *daemonReportedError) Unwrap() error {
+	return e.error
+}
+
+// Checks that can find the image already present in the daemon.
+const (
+	matchedByID      = "id"
+	matchedByConfig  = "config"
+	matchedByDiffIDs = "diffids"
+	matchedByContent = "content"
+)
+
+// FindExistingImage looks for the image in the daemon, first by ID, then by
+// comparing the config and layers of the image tagged with the first repo
+// tag. With MatchLayers the images loaded by this tool with the same layers
+// and config are looked for too. It returns
+// the ID of the image found and the check that matched, or an empty ID if the
+// image is not present. Nothing in the daemon is modified.
+func (d *DockerLoader) FindExistingImage(ctx context.Context, imageID string, ociConfig map[string]interface{}, repoTags []string) (string, string, error) {
 	// 1. Check Strict ID
-	_, _, err := d.cli.ImageInspectWithRaw(ctx, imageID)
+	_, err := d.inspectImage(ctx, imageID)
 	if err == nil {
-		action.AlreadyLoaded = true
-		// Ensure tags
-		if err := d.ensureTags(ctx, imageID, repoTags, &action); err != nil {
-			return true, action, err
-		}
-		return true, action, nil
+		return imageID, matchedByID, nil
 	} else if !client.IsErrNotFound(err) {
-		return false, action, fmt.Errorf("error inspecting image ID: %w", err)
+		return "", "", fmt.Errorf("error inspecting image ID: %w", err)
 	}
 
 	// 2. Check Loose Match via First Tag
-	if len(repoTags) == 0 {
-		return false, action, nil
-	}
-	firstTag := repoTags[0]
-	inspect, _, err := d.cli.ImageInspectWithRaw(ctx, firstTag)
-	if err == nil {
-		// Tag exists. Compare Configs.
-		if areConfigsEqual(ociConfig, inspect) {
-			action.AlreadyLoaded = true
-			log.Println("Found existing image with matching config (ID mismatch ignored due to normalization).")
-			if err := d.ensureTags(ctx, inspect.ID, repoTags, &action); err != nil {
-				return true, action, err
+	if len(repoTags) > 0 {
+		firstTag := repoTags[0]
+		inspect, err := d.inspectImage(ctx, firstTag)
+		if err == nil {
+			// Tag exists. Compare Configs.
+			if !areConfigsEqual(ociConfig, inspect, d.opts.CompareFields, d.opts.NormalizeUser) {
+				logger(ctx).Println("Existing image tag found but config does not match.")
+			} else if sameLayers := layersMatch(configDiffIDs(ociConfig), inspect.RootFS.Layers); !sameLayers && !d.opts.RetagOnConfigMatch {
+				logger(ctx).Println("Existing image tag found with matching config but different layers.")
+			} else if !d.hasRequiredLabels(inspect) {
+				logger(ctx).Println("Existing image tag found with matching config but without the required labels.")
+			} else if !sameLayers {
+				logger(ctx).Println("Found existing image with matching config but different layers, reusing it as requested by --retag-on-config-match.")
+				return inspect.ID, matchedByConfig, nil
+			} else {
+				logger(ctx).Println("Found existing image with matching config (ID mismatch ignored due to normalization).")
+				return inspect.ID, matchedByConfig, nil
 			}
-			return true, action, nil
-		} else {
-			log.Println("Existing image tag found but config does not match.")
+		} else if !client.IsErrNotFound(err) {
+			logger(ctx).Println("Error inspecting existing tag:", err)
+		}
+	}
+
+	// 3. Check images loaded by this tool with the same layers and config
+	if d.opts.MatchLayers {
+		existingID, matchedBy, err := d.findImageWithLayers(ctx, ociConfig, true)
+		if err != nil || existingID != "" {
+			return existingID, matchedBy, err
 		}
-	} else if !client.IsErrNotFound(err) {
-		log.Println("Error inspecting existing tag:", err)
 	}
 
-	return false, action, nil
+	// 4. Check any image with the same layers
+	if !d.opts.MatchByDiffIDs {
+		return "", "", nil
+	}
+	return d.findImageWithLayers(ctx, ociConfig, false)
 }
 
-func (d *DockerLoader) ensureTags(ctx context.Context, imageID string, repoTags []string, action *DockerLoadAction) error {
+// layersMatch reports whether two diff ID lists are the same, or unknown.
+func layersMatch(ociDiffIDs, dockerLayers []string) bool {
+	if len(ociDiffIDs) == 0 || len(dockerLayers) == 0 {
+		return true
+	}
+	return slicesEqual(ociDiffIDs, dockerLayers)
+}
+
+// hasRequiredLabels reports whether the image carries all the labels in
+// RequireLabels.
+func (d *DockerLoader) hasRequiredLabels(inspect types.ImageInspect) bool {
+	var labels map[string]string
+	if inspect.Config != nil {
+		labels = inspect.Config.Labels
+	}
+	for key, value := range d.opts.RequireLabels {
+		if got, ok := labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// findImageWithLayers looks for an image in the daemon with exactly the layers
+// of the config. With sameConfig, the config fields must match too, and only
+// the images loaded by this tool with the same oci_layers label are
+// inspected; otherwise every image is.
+func (d *DockerLoader) findImageWithLayers(ctx context.Context, ociConfig map[string]interface{}, sameConfig bool) (string, string, error) {
+	diffIDs := configDiffIDs(ociConfig)
+	if len(diffIDs) == 0 {
+		return "", "", nil
+	}
+
+	listOpts := types.ImageListOptions{Filters: filters.NewArgs()}
+	matchedBy := matchedByDiffIDs
+	if sameConfig {
+		nestedConfig, _ := ociConfig["config"].(map[string]interface{})
+		layersLabel := getMapStringString(nestedConfig, "Labels")[loadedByLabel]
+		if layersLabel == "" {
+			return "", "", nil
+		}
+		listOpts.Filters.Add("label", loadedByLabel+"="+layersLabel)
+		matchedBy = matchedByContent
+	}
+	for key, value := range d.opts.RequireLabels {
+		listOpts.Filters.Add("label", key+"="+value)
+	}
+
+	var images []types.ImageSummary
+	err := d.opts.Retry.Do(ctx, "image list", func() error {
+		var err error
+		images, err = d.cli.ImageList(ctx, listOpts)
+		return err
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("error listing Docker images: %w", err)
+	}
+
+	// Sorted so the match is deterministic when several images have the
+	// same layers.
+	sort.Slice(images, func(a, b int) bool { return images[a].ID < images[b].ID })
+	for _, summary := range images {
+		inspect, err := d.inspectImage(ctx, summary.ID)
+		if err != nil {
+			continue
+		}
+		if !slicesEqual(inspect.RootFS.Layers, diffIDs) {
+			continue
+		}
+		if sameConfig && !areConfigsEqual(ociConfig, inspect, d.opts.CompareFields, d.opts.NormalizeUser) {
+			continue
+		}
+		if !d.hasRequiredLabels(inspect) {
+			continue
+		}
+		logger(ctx).Println("Found existing image with the same layers:", inspect.ID)
+		return inspect.ID, matchedBy, nil
+	}
+	return "", "", nil
+}
+
+// CheckImageExists checks if the image already exists in Docker using ID or fuzzy config match.
+// If valid, returns true and an Action with AlreadyLoaded=true (and ensures tags).
+// If invalid, returns false.
+func (d *DockerLoader) CheckImageExists(ctx context.Context, imageID string, ociConfig map[string]interface{}, repoTags []string) (found bool, action DockerLoadAction, err error) {
+	ctx, span := startSpan(ctx, "CheckImageExists", attrDigest.String(imageID))
+	defer func() {
+		outcome := "not_found"
+		if found {
+			outcome = "found"
+		}
+		endSpan(span, outcome, err)
+	}()
+
+	action = DockerLoadAction{Digest: imageID}
+	if d.opts.NoCache {
+		return false, action, nil
+	}
+
+	existingID, _, err := d.FindExistingImage(ctx, imageID, ociConfig, repoTags)
+	if err != nil || existingID == "" {
+		return false, action, err
+	}
+
+	action.AlreadyLoaded = true
+	if existingID != imageID {
+		action.ExistingID = existingID
+	}
+	repoTags, conflicts, err := d.ResolveTagConflicts(ctx, existingID, repoTags)
+	if err != nil {
+		return true, action, err
+	}
+	conflicts.record(&action)
+	// Ensure tags
+	if err := d.ensureTags(ctx, existingID, repoTags, &action); err != nil {
+		return true, action, err
+	}
+	return true, action, nil
+}
+
+// Policies for requested tags that point at another image.
+const (
+	conflictRepoint = "repoint"
+	conflictSkip    = "skip"
+	conflictFail    = "fail"
+)
+
+// TagConflicts are the requested tags that pointed at another image.
+type TagConflicts struct {
+	Repointed []string
+	Skipped   []string
+}
+
+func (c TagConflicts) record(action *DockerLoadAction) {
+	action.TagsRepointed = append(action.TagsRepointed, c.Repointed...)
+	action.TagsSkipped = append(action.TagsSkipped, c.Skipped...)
+	action.SortTags()
+}
+
+// ResolveTagConflicts applies the OnConflict policy to the tags that already
+// point at an image other than imageID. It returns the tags to apply to the
+// image, which leave out the skipped ones, and fails for conflictFail. With
+// TagIfAbsent every such tag is skipped, whatever the policy.
+func (d *DockerLoader) ResolveTagConflicts(ctx context.Context, imageID string, repoTags []string) ([]string, TagConflicts, error) {
+	tags := []string{}
+	conflicts := TagConflicts{}
+	for _, tag := range repoTags {
+		inspect, err := d.inspectImage(ctx, tag)
+		if client.IsErrNotFound(err) || (err == nil && inspect.ID == imageID) {
+			tags = append(tags, tag)
+			continue
+		}
+		if err != nil {
+			return nil, conflicts, fmt.Errorf("error inspecting tag %s: %w", tag, err)
+		}
+		if d.opts.TagIfAbsent {
+			logger(ctx).Println("Leaving existing tag", tag, "untouched")
+			conflicts.Skipped = append(conflicts.Skipped, tag)
+			continue
+		}
+
+		switch d.opts.OnConflict {
+		case conflictFail:
+			return nil, conflicts, fmt.Errorf("tag %s already points at image %s", tag, inspect.ID)
+		case conflictSkip:
+			logger(ctx).Println("Leaving tag", tag, "on image", inspect.ID)
+			conflicts.Skipped = append(conflicts.Skipped, tag)
+		default:
+			logger(ctx).Println("Moving tag", tag, "from image", inspect.ID)
+			conflicts.Repointed = append(conflicts.Repointed, tag)
+			tags = append(tags, tag)
+		}
+	}
+	return tags, conflicts, nil
+}
+
+func (d *DockerLoader) ensureTags(ctx context.Context, imageID string, repoTags []string, action *DockerLoadAction) (err error) {
+	ctx, span := startSpan(ctx, "ensureTags", attrDigest.String(imageID))
+	defer func() { endSpan(span, "tagged", err) }()
+
 	// We need to know current tags to populate TagsAlreadyPresent
-	inspect, _, err := d.cli.ImageInspectWithRaw(ctx, imageID)
+	inspect, err := d.inspectImage(ctx, imageID)
 	if err != nil {
 		return err
 	}
@@ -296,14 +983,48 @@ func (d *DockerLoader) ensureTags(ctx context.Context, imageID string, repoTags
 			action.TagsAdded = append(action.TagsAdded, tag)
 		}
 	}
+	action.SortTags()
+	return nil
+}
+
+// CheckTagsConsistent fails unless every tag resolves to imageID, listing the
+// tags that point at another image or at none.
+func (d *DockerLoader) CheckTagsConsistent(ctx context.Context, imageID string, tags []string) error {
+	divergent := []string{}
+	for _, tag := range tags {
+		inspect, err := d.inspectImage(ctx, tag)
+		switch {
+		case client.IsErrNotFound(err):
+			divergent = append(divergent, tag+" is missing")
+		case err != nil:
+			return fmt.Errorf("error inspecting tag %s: %w", tag, err)
+		case inspect.ID != imageID:
+			divergent = append(divergent, tag+" points at "+inspect.ID)
+		}
+	}
+	if len(divergent) > 0 {
+		return fmt.Errorf("tags do not all resolve to image %s: %s", imageID, strings.Join(divergent, ", "))
+	}
 	return nil
 }
 
 // LoadTarIntoDocker ensures that the given tar is loaded and tagged with the given tags.
-func (d *DockerLoader) LoadTarIntoDocker(ctx context.Context, tarPath, imageID string, repoTags []string) (DockerLoadAction, error) {
+func (d *DockerLoader) LoadTarIntoDocker(ctx context.Context, tarPath, imageID string, repoTags []string) (action DockerLoadAction, err error) {
+	ctx, span := startSpan(ctx, "LoadTarIntoDocker", attrDigest.String(imageID))
+	if info, statErr := os.Stat(tarPath); statErr == nil {
+		span.SetAttributes(attrImageSize.Int64(info.Size()))
+	}
+	defer func() {
+		outcome := "loaded"
+		if action.AlreadyLoaded {
+			outcome = "already_loaded"
+		}
+		endSpan(span, outcome, err)
+	}()
+
 	start := time.Now()
 	// Check if the image already exists
-	action, err := d.checkForExistingImage(ctx, imageID, repoTags)
+	action, err = d.checkForExistingImage(ctx, imageID, repoTags)
 	if err != nil {
 		return action, err
 	}
@@ -319,28 +1040,68 @@ func (d *DockerLoader) LoadTarIntoDocker(ctx context.Context, tarPath, imageID s
 	}
 	defer tar.Close()
 
-	// Load the tar file into Docker
-	response, err := d.cli.ImageLoad(ctx, tar, true)
+	// Load the tar file into Docker. A retry sends the whole tar again.
+	loadedID := ""
+	err = d.opts.Retry.Do(ctx, "load", func() error {
+		if _, err := tar.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("error rewinding tar file (%s): %w", tarPath, err)
+		}
+		response, err := d.cli.ImageLoad(ctx, tar, true)
+		if err != nil {
+			return fmt.Errorf("error loading tar file into Docker: %w", err)
+		}
+		defer response.Body.Close()
+		// The whole tar was sent once the response arrives, and the daemon
+		// may be loading it, so a broken response is not retried.
+		if loadedID, err = readLoadResponse(ctx, response.Body); err != nil {
+			return &permanentError{err}
+		}
+		return nil
+	})
 	if err != nil {
-		return action, fmt.Errorf("error loading tar file into Docker: %w", err)
+		return action, err
 	}
-	defer response.Body.Close()
 
-	// Read all data from readCloser
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return action, fmt.Errorf("Error reading data: %W", err)
+	action.Digest = imageID
+	action.Forced = d.opts.NoCache
+	if loadedID != "" && canonicalDigest(loadedID) != canonicalDigest(imageID) {
+		// e.g. the containerd image store identifies images by manifest.
+		logger(ctx).Println("The daemon loaded the image as", loadedID)
+		action.LoadedID = loadedID
 	}
-
-	// Convert data to a string
-	loadErr := LoadError{}
-	json.FromJSON(string(data), &loadErr)
-	if loadErr.ErrorDetail.Message != "" {
-		log.Println("Load error:", loadErr.ErrorDetail.Message)
-		return action, fmt.Errorf("Error loading tar file into Docker, error details: %s", loadErr.ErrorDetail.Message)
+	if d.opts.VerifyLoaded {
+		if err := d.verifyLoaded(ctx, action.DaemonDigest()); err != nil {
+			return action, err
+		}
 	}
 
-	action.Digest = imageID
 	action.LoadTime = time.Since(start).String()
 	return action, nil
 }
+
+// Some remote daemons only show a loaded image a moment after the load
+// returns, so the verification looks for it a few times before failing.
+const (
+	verifyLoadedAttempts = 5
+	verifyLoadedDelay    = 100 * time.Millisecond
+)
+
+// verifyLoaded checks that the daemon has the image after a load.
+func (d *DockerLoader) verifyLoaded(ctx context.Context, imageID string) error {
+	var err error
+	for attempt := 0; attempt < verifyLoadedAttempts; attempt++ {
+		if attempt > 0 {
+			if sleepErr := sleepContext(ctx, verifyLoadedDelay); sleepErr != nil {
+				return sleepErr
+			}
+		}
+		_, err = d.inspectImage(ctx, imageID)
+		if !client.IsErrNotFound(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error verifying image %s was loaded: %w", imageID, err)
+	}
+	return nil
+}
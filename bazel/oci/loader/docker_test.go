@@ -0,0 +1,881 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	encodingjson "encoding/json"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/suite"
+)
+
+type DockerTestSuite struct {
+	suite.Suite
+}
+
+func testOCIConfig(containerConfig map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       containerConfig,
+	}
+}
+
+func testDockerImage(config *container.Config) types.ImageInspect {
+	return types.ImageInspect{
+		Architecture: "amd64",
+		Os:           "linux",
+		Config:       config,
+	}
+}
+
+func (suite *DockerTestSuite) TestConfigsEqualWithDefaultFields() {
+	ociConfig := testOCIConfig(map[string]interface{}{
+		"Env":        []interface{}{"PATH=/bin"},
+		"Cmd":        []interface{}{"/app"},
+		"WorkingDir": "/",
+		"Labels":     map[string]interface{}{"a": "b"},
+	})
+	dockerImage := testDockerImage(&container.Config{
+		Env:        []string{"PATH=/bin"},
+		Cmd:        []string{"/app"},
+		WorkingDir: "/",
+		Labels:     map[string]string{"a": "b"},
+	})
+
+	fields, err := NewConfigFieldSet(nil, nil)
+	suite.Require().NoError(err)
+	suite.True(areConfigsEqual(ociConfig, dockerImage, fields, false))
+
+	dockerImage.Config.Cmd = []string{"/other"}
+	suite.False(areConfigsEqual(ociConfig, dockerImage, fields, false))
+}
+
+func (suite *DockerTestSuite) TestIgnoredFieldDoesNotCauseMismatch() {
+	ociConfig := testOCIConfig(map[string]interface{}{
+		"Env": []interface{}{"TOKEN=a"},
+		"Cmd": []interface{}{"/app"},
+	})
+	dockerImage := testDockerImage(&container.Config{
+		Env: []string{"TOKEN=b"},
+		Cmd: []string{"/app"},
+	})
+
+	defaults, err := NewConfigFieldSet(nil, nil)
+	suite.Require().NoError(err)
+	suite.False(areConfigsEqual(ociConfig, dockerImage, defaults, false))
+
+	ignoreEnv, err := NewConfigFieldSet(nil, []string{"Env"})
+	suite.Require().NoError(err)
+	suite.True(areConfigsEqual(ociConfig, dockerImage, ignoreEnv, false))
+}
+
+func (suite *DockerTestSuite) TestCompareOnlySelectedFields() {
+	ociConfig := testOCIConfig(map[string]interface{}{
+		"Env":        []interface{}{"A=1"},
+		"Cmd":        []interface{}{"/app"},
+		"Entrypoint": []interface{}{"/entry"},
+		"User":       "root",
+	})
+	dockerImage := testDockerImage(&container.Config{
+		Env:        []string{"A=2"},
+		Cmd:        []string{"/app"},
+		Entrypoint: []string{"/entry"},
+		User:       "nobody",
+	})
+
+	fields, err := NewConfigFieldSet([]string{"Cmd", "Entrypoint"}, nil)
+	suite.Require().NoError(err)
+	suite.True(areConfigsEqual(ociConfig, dockerImage, fields, false))
+
+	dockerImage.Config.Entrypoint = []string{"/other"}
+	suite.False(areConfigsEqual(ociConfig, dockerImage, fields, false))
+}
+
+func (suite *DockerTestSuite) TestCompareNestedFields() {
+	ociConfig := testOCIConfig(map[string]interface{}{
+		"Volumes": map[string]interface{}{"/data": map[string]interface{}{}},
+		"Healthcheck": map[string]interface{}{
+			"Test":     []interface{}{"CMD", "true"},
+			"Interval": float64(30000000000),
+		},
+	})
+	dockerImage := testDockerImage(&container.Config{
+		Volumes: map[string]struct{}{"/data": {}},
+		Healthcheck: &container.HealthConfig{
+			Test:     []string{"CMD", "true"},
+			Interval: 30 * time.Second,
+		},
+	})
+
+	fields, err := NewConfigFieldSet([]string{"ExposedPorts", "Volumes", "Healthcheck"}, nil)
+	suite.Require().NoError(err)
+	suite.True(areConfigsEqual(ociConfig, dockerImage, fields, false))
+
+	dockerImage.Config.Healthcheck.Interval = time.Minute
+	suite.False(areConfigsEqual(ociConfig, dockerImage, fields, false))
+
+	ignoreHealthcheck, err := NewConfigFieldSet([]string{"ExposedPorts", "Volumes", "Healthcheck"}, []string{"Healthcheck"})
+	suite.Require().NoError(err)
+	suite.True(areConfigsEqual(ociConfig, dockerImage, ignoreHealthcheck, false))
+}
+
+func (suite *DockerTestSuite) TestUnknownConfigField() {
+	_, err := NewConfigFieldSet([]string{"Hostname"}, nil)
+	suite.Error(err)
+
+	_, err = NewConfigFieldSet(nil, []string{"Hostname"})
+	suite.Error(err)
+}
+
+func (suite *DockerTestSuite) TestActionJSONIsDeterministic() {
+	first := DockerLoadAction{
+		Digest:             "sha256:abc",
+		TagsAdded:          []string{"b:latest", "a:latest", "c:latest"},
+		TagsAlreadyPresent: []string{"z:1", "y:1"},
+	}
+	second := DockerLoadAction{
+		Digest:             "sha256:abc",
+		TagsAdded:          []string{"c:latest", "b:latest", "a:latest"},
+		TagsAlreadyPresent: []string{"y:1", "z:1"},
+	}
+
+	suite.Equal(first.JSON(), second.JSON())
+	suite.Equal(first.JSON(), first.JSON())
+
+	// Serializing must not reorder the caller's slices.
+	suite.Equal([]string{"b:latest", "a:latest", "c:latest"}, first.TagsAdded)
+
+	first.SortTags()
+	suite.Equal([]string{"a:latest", "b:latest", "c:latest"}, first.TagsAdded)
+	suite.Equal([]string{"y:1", "z:1"}, first.TagsAlreadyPresent)
+}
+
+func (suite *DockerTestSuite) TestActionJSONCanonicalizesDigests() {
+	hex := strings.Repeat("ab", 32)
+	canonical := DockerLoadAction{Digest: "sha256:" + hex, ExistingID: "sha256:" + hex}
+	for _, digest := range []string{hex, "sha256:" + strings.ToUpper(hex), " sha256:" + hex + "\n"} {
+		action := DockerLoadAction{Digest: digest, ExistingID: digest}
+		suite.Equal(canonical.JSON(), action.JSON(), digest)
+		suite.Equal(canonical.JSONArray(), action.JSONArray(), digest)
+	}
+
+	// Short IDs cannot be expanded, so they are left alone.
+	suite.Contains(DockerLoadAction{Digest: "abc123"}.JSON(), `"digest": "abc123"`)
+	suite.Equal("", canonicalDigest(""))
+}
+
+func (suite *DockerTestSuite) TestUsersEqual() {
+	suite.True(usersEqual("1000", "1000:1000"))
+	suite.True(usersEqual(" 1000 ", "1000"))
+	suite.True(usersEqual("1000:1000", "1000:1000"))
+	suite.True(usersEqual("", "root"))
+	suite.True(usersEqual("0:0", "root"))
+	suite.True(usersEqual("1000", "1000:0"))
+	suite.True(usersEqual("appuser:appuser", "appuser"))
+
+	suite.False(usersEqual("1000", "1001"))
+	suite.False(usersEqual("1000:1000", "1000:2000"))
+	// The primary group of the user is not known.
+	suite.False(usersEqual("1000", "1000:2000"))
+	suite.False(usersEqual("appuser", "appuser:staff"))
+	// Names cannot be resolved without the image's passwd file.
+	suite.False(usersEqual("appuser", "1000"))
+}
+
+func (suite *DockerTestSuite) TestNormalizeUserInConfigComparison() {
+	ociConfig := testOCIConfig(map[string]interface{}{"User": "1000"})
+	dockerImage := testDockerImage(&container.Config{User: "1000:1000"})
+	fields, err := NewConfigFieldSet([]string{"User"}, nil)
+	suite.Require().NoError(err)
+
+	suite.False(areConfigsEqual(ociConfig, dockerImage, fields, false))
+	suite.True(areConfigsEqual(ociConfig, dockerImage, fields, true))
+}
+
+// fakeContainerLister returns the running containers registered per ancestor.
+type fakeContainerLister struct {
+	running map[string][]types.Container
+}
+
+func (f fakeContainerLister) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	if options.Filters.Get("status")[0] != "running" {
+		return nil, fmt.Errorf("expected a running status filter")
+	}
+	return f.running[options.Filters.Get("ancestor")[0]], nil
+}
+
+func (suite *DockerTestSuite) TestFindRunningContainers() {
+	cli := fakeContainerLister{running: map[string][]types.Container{
+		"app:latest": {{ID: "c1", Image: "app:latest"}},
+	}}
+
+	ids, err := findRunningContainers(context.Background(), cli, []string{"other:latest", "app:latest"})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"c1"}, ids)
+
+	ids, err = findRunningContainers(context.Background(), cli, []string{"other:latest"})
+	suite.Require().NoError(err)
+	suite.Empty(ids)
+}
+
+func (suite *DockerTestSuite) TestLoadResponseWithConfirmation() {
+	body := `{"stream":"Loaded image: app:latest\n"}` + "\n" + `{"stream":"Loaded image ID: sha256:abc\n"}`
+	loadedID, err := readLoadResponse(context.Background(), strings.NewReader(body))
+	suite.NoError(err)
+	suite.Equal("sha256:abc", loadedID)
+
+	loadedID, err = readLoadResponse(context.Background(), strings.NewReader(`{"stream":"Loaded image: app:latest\n"}`))
+	suite.NoError(err)
+	suite.Empty(loadedID)
+}
+
+func (suite *DockerTestSuite) TestTruncatedLoadResponseIsAnError() {
+	for _, body := range []string{"", `{"stream":"Loading layer"}`, `{"stream":"Loaded ima`} {
+		_, err := readLoadResponse(context.Background(), strings.NewReader(body))
+		suite.Error(err, body)
+	}
+}
+
+func (suite *DockerTestSuite) TestLoadResponseWithError() {
+	body := `{"errorDetail":{"message":"no space left on device"},"error":"no space left on device"}`
+	_, err := readLoadResponse(context.Background(), strings.NewReader(body))
+	suite.ErrorContains(err, "no space left on device")
+}
+
+func (suite *DockerTestSuite) TestDaemonDigestIsTheReportedLoadedID() {
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, []byte("image tar"), 0o644))
+	cli := newFakeDockerAPI()
+	cli.loadResponse = `{"stream":"Loaded image ID: sha256:daemon\n"}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	action, err := loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", nil)
+	suite.Require().NoError(err)
+	suite.Equal("sha256:app", action.Digest)
+	suite.Equal("sha256:daemon", action.LoadedID)
+	suite.Equal("sha256:daemon", action.DaemonDigest())
+
+	cli.loadResponse = `{"stream":"Loaded image ID: sha256:app\n"}`
+	action, err = loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", nil)
+	suite.Require().NoError(err)
+	suite.Empty(action.LoadedID)
+	suite.Equal("sha256:app", action.DaemonDigest())
+}
+
+// fakeDockerAPI is an in-memory daemon holding images by ID. Methods the
+// tests do not need are left to the nil embedded interface.
+type fakeDockerAPI struct {
+	dockerAPI
+	images map[string]*types.ImageInspect
+	// loadResponse replaces the response of the loads, which otherwise
+	// confirms the loaded images like the daemon does.
+	loadResponse string
+	loadedTars   []string
+
+	// registry has the IDs of the images that can be pulled, by reference.
+	registry  map[string]string
+	pulls     []string
+	pullAuths []string
+
+	info system.Info
+
+	// running has the running containers by the image reference they were
+	// created from.
+	running map[string][]types.Container
+}
+
+func newFakeDockerAPI(images ...types.ImageInspect) *fakeDockerAPI {
+	f := &fakeDockerAPI{images: map[string]*types.ImageInspect{}}
+	for k := range images {
+		f.images[images[k].ID] = &images[k]
+	}
+	return f
+}
+
+func (f *fakeDockerAPI) find(ref string) *types.ImageInspect {
+	if img, ok := f.images[ref]; ok {
+		return img
+	}
+	for _, img := range f.images {
+		for _, tag := range append(img.RepoTags, img.RepoDigests...) {
+			if tag == ref {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeDockerAPI) ImageInspectWithRaw(ctx context.Context, ref string) (types.ImageInspect, []byte, error) {
+	img := f.find(ref)
+	if img == nil {
+		return types.ImageInspect{}, nil, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	return *img, nil, nil
+}
+
+func (f *fakeDockerAPI) ImageList(ctx context.Context, options types.ImageListOptions) ([]image.Summary, error) {
+	summaries := []image.Summary{}
+	for _, img := range f.images {
+		labels := map[string]string{}
+		if img.Config != nil {
+			labels = img.Config.Labels
+		}
+		if !options.Filters.MatchKVList("label", labels) {
+			continue
+		}
+		if options.Filters.Contains("reference") && !matchesReference(options.Filters.Get("reference"), img.RepoTags) {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339, img.Created)
+		summaries = append(summaries, image.Summary{ID: img.ID, RepoTags: img.RepoTags, Labels: labels, Created: created.Unix()})
+	}
+	return summaries, nil
+}
+
+func (f *fakeDockerAPI) ImageTag(ctx context.Context, ref, tag string) error {
+	img := f.find(ref)
+	if img == nil {
+		return errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	// The tag moves away from any other image.
+	for _, other := range f.images {
+		tags := []string{}
+		for _, t := range other.RepoTags {
+			if t != tag {
+				tags = append(tags, t)
+			}
+		}
+		other.RepoTags = tags
+	}
+	img.RepoTags = append(img.RepoTags, tag)
+	img.Metadata.LastTagTime = time.Now()
+	return nil
+}
+
+func (f *fakeDockerAPI) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+	f.loadedTars = append(f.loadedTars, string(data))
+	response := f.registerLoadedTar(data)
+	if f.loadResponse != "" {
+		response = f.loadResponse
+	}
+	return types.ImageLoadResponse{Body: io.NopCloser(strings.NewReader(response)), JSON: true}, nil
+}
+
+func (f *fakeDockerAPI) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	return fakeContainerLister{running: f.running}.ContainerList(ctx, options)
+}
+
+func (f *fakeDockerAPI) Info(ctx context.Context) (system.Info, error) {
+	return f.info, nil
+}
+
+func (f *fakeDockerAPI) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	f.pulls = append(f.pulls, ref)
+	f.pullAuths = append(f.pullAuths, options.RegistryAuth)
+	id, ok := f.registry[ref]
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("manifest for %s not found", ref))
+	}
+	if img := f.images[id]; img != nil {
+		img.RepoDigests = append(img.RepoDigests, ref)
+	} else {
+		f.images[id] = &types.ImageInspect{ID: id, RepoDigests: []string{ref}}
+	}
+	return io.NopCloser(strings.NewReader(`{"status":"Status: Downloaded newer image for ` + ref + `"}`)), nil
+}
+
+// matchesReference reports whether any of the tags is in one of the repos.
+func matchesReference(repos, tags []string) bool {
+	for _, tag := range tags {
+		repo, _, _ := strings.Cut(tag, ":")
+		for _, r := range repos {
+			if r == repo {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// registerLoadedTar adds the images in a tar built by ImageBuilder to the
+// daemon, the way a real load would. Tests loading arbitrary bytes do not
+// register anything.
+func (f *fakeDockerAPI) registerLoadedTar(data []byte) string {
+	entries := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return ""
+		}
+		entries[header.Name] = content
+	}
+
+	manifests := []OutputManifest{}
+	if err := encodingjson.Unmarshal(entries["manifest.json"], &manifests); err != nil || len(manifests) == 0 {
+		return ""
+	}
+	response := ""
+	for _, manifest := range manifests {
+		configJSON := entries[manifest.Config]
+		configData := map[string]interface{}{}
+		if err := encodingjson.Unmarshal(configJSON, &configData); err != nil {
+			return ""
+		}
+
+		sum := sha256.Sum256(configJSON)
+		id := "sha256:" + hex.EncodeToString(sum[:])
+		nestedConfig, _ := configData["config"].(map[string]interface{})
+		f.images[id] = &types.ImageInspect{
+			ID:     id,
+			RootFS: types.RootFS{Layers: configDiffIDs(configData)},
+			Config: &container.Config{Labels: getMapStringString(nestedConfig, "Labels")},
+		}
+		for _, tag := range manifest.RepoTags {
+			f.ImageTag(context.Background(), id, tag)
+			response += fmt.Sprintf("{\"stream\":\"Loaded image: %s\\n\"}\n", tag)
+		}
+		if len(manifest.RepoTags) == 0 {
+			response += fmt.Sprintf("{\"stream\":\"Loaded image ID: %s\\n\"}\n", id)
+		}
+	}
+	return response
+}
+
+func (suite *DockerTestSuite) TestCheckImageExistsByIDAddsMissingTags() {
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:app", RepoTags: []string{"app:v1"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", nil, []string{"app:v1", "app:latest"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.True(action.AlreadyLoaded)
+	suite.Equal([]string{"app:v1"}, action.TagsAlreadyPresent)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.ElementsMatch([]string{"app:v1", "app:latest"}, cli.images["sha256:app"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestCheckImageExistsByConfig() {
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}})
+	existing.ID = "sha256:normalized"
+	existing.RepoTags = []string{"app:latest"}
+	cli := newFakeDockerAPI(existing)
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest", "app:v2"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Equal([]string{"app:latest"}, action.TagsAlreadyPresent)
+	suite.Equal([]string{"app:v2"}, action.TagsAdded)
+	suite.Equal("sha256:normalized", action.ExistingID)
+	suite.ElementsMatch([]string{"app:latest", "app:v2"}, cli.images["sha256:normalized"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestCheckImageExistsConfigMismatch() {
+	existing := testDockerImage(&container.Config{Cmd: []string{"/old"}})
+	existing.ID = "sha256:old"
+	existing.RepoTags = []string{"app:latest"}
+	cli := newFakeDockerAPI(existing)
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.False(found)
+	suite.False(action.AlreadyLoaded)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:old"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestRequiredLabelScopesConfigMatch() {
+	opts := DockerLoaderOpts{CompareFields: ConfigFieldSet{"Cmd": true}, RequireLabels: map[string]string{"team": "infra"}}
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}})
+	existing.ID = "sha256:existing"
+	existing.RepoTags = []string{"app:latest"}
+
+	// An image from another team with the same config is not ours.
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(existing), opts)
+	found, _, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.False(found)
+
+	existing.Config = &container.Config{Cmd: []string{"/app"}, Labels: map[string]string{"team": "infra"}}
+	loader = newDockerLoaderWithAPI(newFakeDockerAPI(existing), opts)
+	existingID, matchedBy, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.Equal("sha256:existing", existingID)
+	suite.Equal(matchedByConfig, matchedBy)
+}
+
+func (suite *DockerTestSuite) TestRequiredLabelScopesContentMatch() {
+	layers := []string{"sha256:base", "sha256:app"}
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}, Labels: map[string]string{"oci_layers": "sha256:b1,sha256:b2"}})
+	existing.ID = "sha256:existing"
+	existing.RootFS = types.RootFS{Layers: layers}
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(existing), DockerLoaderOpts{
+		CompareFields:  ConfigFieldSet{"Cmd": true},
+		MatchByDiffIDs: true,
+		RequireLabels:  map[string]string{"team": "infra"},
+	})
+
+	ociConfig := testOCIConfig(map[string]interface{}{
+		"Cmd":    []interface{}{"/app"},
+		"Labels": map[string]interface{}{"oci_layers": "sha256:b1,sha256:b2"},
+	})
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+
+	existingID, _, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, nil)
+	suite.Require().NoError(err)
+	suite.Empty(existingID)
+}
+
+func (suite *DockerTestSuite) TestCheckImageExistsByContent() {
+	layers := []string{"sha256:base", "sha256:app"}
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}, Labels: map[string]string{"oci_layers": "sha256:b1,sha256:b2"}})
+	existing.ID = "sha256:reserialized"
+	existing.RepoTags = []string{"app:old"}
+	existing.RootFS = types.RootFS{Layers: layers}
+	other := testDockerImage(&container.Config{Cmd: []string{"/app"}})
+	other.ID = "sha256:other"
+	other.RootFS = types.RootFS{Layers: layers}
+	cli := newFakeDockerAPI(existing, other)
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	ociConfig := testOCIConfig(map[string]interface{}{
+		"Cmd":    []interface{}{"/app"},
+		"Labels": map[string]interface{}{"oci_layers": "sha256:b1,sha256:b2"},
+	})
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+
+	// The images are only listed with MatchLayers.
+	existingID, _, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.Empty(existingID)
+
+	loader = newDockerLoaderWithAPI(cli, DockerLoaderOpts{MatchLayers: true})
+	existingID, matchedBy, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.Equal("sha256:reserialized", existingID)
+	suite.Equal(matchedByContent, matchedBy)
+
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.ElementsMatch([]string{"app:old", "app:latest"}, cli.images["sha256:reserialized"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestConfigMatchWithDifferentLayers() {
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}})
+	existing.ID = "sha256:old"
+	existing.RepoTags = []string{"app:latest"}
+	existing.RootFS = types.RootFS{Layers: []string{"sha256:base", "sha256:old-app"}}
+	cli := newFakeDockerAPI(existing)
+
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+
+	// The layers of the first tag are compared without MatchLayers too.
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	existingID, _, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.Empty(existingID)
+
+	loader = newDockerLoaderWithAPI(cli, DockerLoaderOpts{MatchLayers: true})
+	found, _, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.False(found)
+}
+
+func (suite *DockerTestSuite) TestConfigMatchWithSameLayers() {
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}})
+	existing.ID = "sha256:old"
+	existing.RepoTags = []string{"app:latest"}
+	existing.RootFS = types.RootFS{Layers: []string{"sha256:base", "sha256:app"}}
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(existing), DockerLoaderOpts{})
+
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+	existingID, matchedBy, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.Equal("sha256:old", existingID)
+	suite.Equal(matchedByConfig, matchedBy)
+}
+
+func (suite *DockerTestSuite) TestRetagOnConfigMatchSkipsLoad() {
+	existing := testDockerImage(&container.Config{Cmd: []string{"/app"}})
+	existing.ID = "sha256:old"
+	existing.RepoTags = []string{"app:latest"}
+	existing.RootFS = types.RootFS{Layers: []string{"sha256:base", "sha256:old-app"}}
+	cli := newFakeDockerAPI(existing)
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{RetagOnConfigMatch: true})
+
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest", "app:v2"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.True(action.AlreadyLoaded)
+	suite.Equal("sha256:old", action.ExistingID)
+	suite.Equal([]string{"app:v2"}, action.TagsAdded)
+	suite.Equal([]string{"app:latest", "app:v2"}, cli.images["sha256:old"].RepoTags)
+	suite.Empty(cli.loadedTars)
+
+	// A different config still needs a load.
+	ociConfig = testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/other"}})
+	found, _, err = loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.False(found)
+}
+
+func (suite *DockerTestSuite) TestCheckTagsConsistent() {
+	cli := newFakeDockerAPI(
+		types.ImageInspect{ID: "sha256:app", RepoTags: []string{"app:latest", "app:v1"}},
+		types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:v2"}},
+	)
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	suite.NoError(loader.CheckTagsConsistent(context.Background(), "sha256:app", []string{"app:latest", "app:v1"}))
+	err := loader.CheckTagsConsistent(context.Background(), "sha256:app", []string{"app:latest", "app:v2", "app:v3"})
+	suite.EqualError(err, "tags do not all resolve to image sha256:app: app:v2 points at sha256:other, app:v3 is missing")
+}
+
+func (suite *DockerTestSuite) TestCheckImageExistsByDiffIDs() {
+	existing := testDockerImage(&container.Config{Cmd: []string{"/old"}})
+	existing.ID = "sha256:migrated"
+	existing.RootFS = types.RootFS{Layers: []string{"sha256:base", "sha256:app"}}
+	cli := newFakeDockerAPI(existing)
+
+	ociConfig := testOCIConfig(map[string]interface{}{"Cmd": []interface{}{"/app"}})
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	found, _, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.False(found)
+
+	loader = newDockerLoaderWithAPI(cli, DockerLoaderOpts{MatchByDiffIDs: true})
+	existingID, matchedBy, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.Equal("sha256:migrated", existingID)
+	suite.Equal(matchedByDiffIDs, matchedBy)
+
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", ociConfig, []string{"app:latest"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:migrated"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestDiffIDsMustMatchExactly() {
+	existing := types.ImageInspect{ID: "sha256:base", RootFS: types.RootFS{Layers: []string{"sha256:base"}}}
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(existing), DockerLoaderOpts{MatchByDiffIDs: true})
+
+	ociConfig := testOCIConfig(nil)
+	ociConfig["rootfs"] = map[string]interface{}{"diff_ids": []interface{}{"sha256:base", "sha256:app"}}
+	existingID, _, err := loader.FindExistingImage(context.Background(), "sha256:app", ociConfig, nil)
+	suite.Require().NoError(err)
+	suite.Empty(existingID)
+}
+
+// conflictingDaemon returns a daemon where the image is loaded as
+// sha256:app, tagged app:v1, while app:latest points at sha256:other.
+func conflictingDaemon() *fakeDockerAPI {
+	return newFakeDockerAPI(
+		types.ImageInspect{ID: "sha256:app", RepoTags: []string{"app:v1"}},
+		types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:latest"}},
+	)
+}
+
+func (suite *DockerTestSuite) TestOnConflictRepoint() {
+	cli := conflictingDaemon()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictRepoint})
+
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", nil, []string{"app:v1", "app:latest"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.Equal([]string{"app:latest"}, action.TagsRepointed)
+	suite.Empty(action.TagsSkipped)
+	suite.ElementsMatch([]string{"app:v1", "app:latest"}, cli.images["sha256:app"].RepoTags)
+	suite.Empty(cli.images["sha256:other"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestOnConflictSkip() {
+	cli := conflictingDaemon()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictSkip})
+
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", nil, []string{"app:v1", "app:latest"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Empty(action.TagsAdded)
+	suite.Equal([]string{"app:latest"}, action.TagsSkipped)
+	suite.Equal([]string{"app:v1"}, cli.images["sha256:app"].RepoTags)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:other"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestOnConflictFail() {
+	cli := conflictingDaemon()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictFail})
+
+	_, _, err := loader.CheckImageExists(context.Background(), "sha256:app", nil, []string{"app:v1", "app:latest"})
+	suite.ErrorContains(err, "tag app:latest already points at image sha256:other")
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:other"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestOnConflictSkipWhenLoading() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:latest"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictSkip})
+
+	action, err := loadImage(context.Background(), loader, image, []string{"app:latest", "app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"app:v1"}, action.TagsAdded)
+	suite.Equal([]string{"app:latest"}, action.TagsSkipped)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:other"].RepoTags)
+	suite.Len(cli.loadedTars, 1)
+}
+
+func (suite *DockerTestSuite) TestTagIfAbsentOverridesOnConflict() {
+	cli := conflictingDaemon()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictFail, TagIfAbsent: true})
+
+	found, action, err := loader.CheckImageExists(context.Background(), "sha256:app", nil, []string{"app:v1", "app:latest", "app:v2"})
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Equal([]string{"app:v2"}, action.TagsAdded)
+	suite.Equal([]string{"app:v1"}, action.TagsAlreadyPresent)
+	suite.Equal([]string{"app:latest"}, action.TagsSkipped)
+	suite.Empty(action.TagsRepointed)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:other"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestTagIfAbsentWhenLoading() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:latest"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{TagIfAbsent: true})
+
+	action, err := loadImage(context.Background(), loader, image, []string{"app:latest", "app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"app:v1"}, action.TagsAdded)
+	suite.Equal([]string{"app:latest"}, action.TagsSkipped)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:other"].RepoTags)
+}
+
+func (suite *DockerTestSuite) TestLoadTarIntoDocker() {
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, []byte("image tar"), 0o644))
+	cli := newFakeDockerAPI()
+	cli.loadResponse = `{"stream":"Loaded image: app:v1\n"}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	action, err := loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", []string{"app:v1", "app:latest"})
+	suite.Require().NoError(err)
+	suite.False(action.AlreadyLoaded)
+	suite.Equal("sha256:app", action.Digest)
+	suite.Equal([]string{"app:latest", "app:v1"}, action.TagsAdded)
+	suite.Equal([]string{"image tar"}, cli.loadedTars)
+}
+
+func (suite *DockerTestSuite) TestLoadTarIntoDockerSkipsLoadedImage() {
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:app", RepoTags: []string{"app:v1"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	action, err := loader.LoadTarIntoDocker(context.Background(), "/does/not/exist.tar", "sha256:app", []string{"app:v1", "app:latest"})
+	suite.Require().NoError(err)
+	suite.True(action.AlreadyLoaded)
+	suite.Equal([]string{"app:v1"}, action.TagsAlreadyPresent)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.Empty(cli.loadedTars)
+}
+
+func (suite *DockerTestSuite) TestLoadTarIntoDockerFailsToTagLoadedImage() {
+	cli := &flakyDockerAPI{fakeDockerAPI: newFakeDockerAPI(types.ImageInspect{ID: "sha256:app", RepoTags: []string{"app:v1"}})}
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	_, err := loader.LoadTarIntoDocker(context.Background(), "/does/not/exist.tar", "sha256:app", []string{"app:v1", "app:latest"})
+	suite.ErrorIs(err, errDaemonBusy)
+	suite.ErrorContains(err, "error tagging image")
+	suite.Equal(1, cli.tagCalls)
+}
+
+func (suite *DockerTestSuite) TestLoadTarIntoDockerWithoutConfirmation() {
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, []byte("image tar"), 0o644))
+	cli := newFakeDockerAPI()
+	cli.loadResponse = `{"stream":"Loading layer"}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	_, err := loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", []string{"app:v1"})
+	suite.Error(err)
+}
+
+// lateDockerAPI is a daemon that only shows a loaded image after it was
+// inspected a number of times.
+type lateDockerAPI struct {
+	*fakeDockerAPI
+	hiddenInspects int
+	inspects       int
+}
+
+func (f *lateDockerAPI) ImageInspectWithRaw(ctx context.Context, ref string) (types.ImageInspect, []byte, error) {
+	f.inspects++
+	if f.inspects <= f.hiddenInspects {
+		return types.ImageInspect{}, nil, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	return types.ImageInspect{ID: ref}, nil, nil
+}
+
+func (suite *DockerTestSuite) TestVerifyLoadedWaitsForImage() {
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, []byte("image tar"), 0o644))
+	cli := &lateDockerAPI{fakeDockerAPI: newFakeDockerAPI(), hiddenInspects: 1}
+	cli.loadResponse = `{"stream":"Loaded image: app:v1\n"}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{VerifyLoaded: true})
+
+	_, err := loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", []string{"app:v1"})
+	suite.Require().NoError(err)
+	suite.Equal(2, cli.inspects)
+}
+
+func (suite *DockerTestSuite) TestVerifyLoadedFailsForMissingImage() {
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, []byte("image tar"), 0o644))
+	cli := &lateDockerAPI{fakeDockerAPI: newFakeDockerAPI(), hiddenInspects: 100}
+	cli.loadResponse = `{"stream":"Loaded image: app:v1\n"}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{VerifyLoaded: true})
+
+	_, err := loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", []string{"app:v1"})
+	suite.ErrorContains(err, "error verifying image")
+	suite.Equal(verifyLoadedAttempts, cli.inspects)
+}
+
+func TestDockerTestSuite(t *testing.T) {
+	suite.Run(t, new(DockerTestSuite))
+}
@@ -0,0 +1,157 @@
+// Conversion of OCI image configs into Docker schema2 configs, for daemons
+// that only load the latter.
+package main
+
+import (
+	"context"
+	"sort"
+)
+
+// Docker schema2 media types.
+const (
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerConfigMediaType   = "application/vnd.docker.container.image.v1+json"
+)
+
+// dockerLayerMediaTypes maps the OCI layer media types to their Docker
+// schema2 equivalents. zstd layers have none and keep their media type.
+var dockerLayerMediaTypes = map[string]string{
+	"application/vnd.oci.image.layer.v1.tar":                       "application/vnd.docker.image.rootfs.diff.tar",
+	"application/vnd.oci.image.layer.v1.tar+gzip":                  "application/vnd.docker.image.rootfs.diff.tar.gzip",
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+}
+
+// dockerConfigFields are the fields of the Docker image config, and
+// dockerContainerConfigFields those of its nested config object.
+var (
+	dockerConfigFields = map[string]bool{
+		"architecture":     true,
+		"author":           true,
+		"comment":          true,
+		"config":           true,
+		"container":        true,
+		"container_config": true,
+		"created":          true,
+		"docker_version":   true,
+		"history":          true,
+		"os":               true,
+		"os.features":      true,
+		"os.version":       true,
+		"rootfs":           true,
+		"variant":          true,
+	}
+	dockerContainerConfigFields = map[string]bool{
+		"ArgsEscaped":     true,
+		"AttachStderr":    true,
+		"AttachStdin":     true,
+		"AttachStdout":    true,
+		"Cmd":             true,
+		"Domainname":      true,
+		"Entrypoint":      true,
+		"Env":             true,
+		"ExposedPorts":    true,
+		"Healthcheck":     true,
+		"Hostname":        true,
+		"Image":           true,
+		"Labels":          true,
+		"MacAddress":      true,
+		"NetworkDisabled": true,
+		"OnBuild":         true,
+		"OpenStdin":       true,
+		"Shell":           true,
+		"StdinOnce":       true,
+		"StopSignal":      true,
+		"StopTimeout":     true,
+		"Tty":             true,
+		"User":            true,
+		"Volumes":         true,
+		"WorkingDir":      true,
+	}
+)
+
+// dockerCompatConfig turns the config data into a Docker schema2 config. The
+// fields Docker does not know are dropped, and the history is made to have
+// exactly one entry that is not an empty_layer for each layer. The runtime
+// config is left as is.
+func dockerCompatConfig(ctx context.Context, configData map[string]interface{}) error {
+	dropUnknownFields(ctx, configData, dockerConfigFields, "")
+	dropUnknownFields(ctx, configData["config"].(map[string]interface{}), dockerContainerConfigFields, "config.")
+
+	rootfs, _ := configData["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		rootfs = map[string]interface{}{}
+		configData["rootfs"] = rootfs
+	}
+	rootfs["type"] = "layers"
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	if diffIDs == nil {
+		rootfs["diff_ids"] = []interface{}{}
+	}
+
+	if _, ok := configData["history"]; ok {
+		configData["history"] = alignHistory(ctx, configData["history"], len(diffIDs), configData["created"])
+	}
+	return nil
+}
+
+// dropUnknownFields deletes the keys of fields missing from known.
+func dropUnknownFields(ctx context.Context, fields map[string]interface{}, known map[string]bool, prefix string) {
+	dropped := []string{}
+	for name := range fields {
+		if !known[name] {
+			dropped = append(dropped, prefix+name)
+			delete(fields, name)
+		}
+	}
+	sort.Strings(dropped)
+	for _, name := range dropped {
+		logger(ctx).Println("Dropped config field", name, "unknown to Docker")
+	}
+}
+
+// alignHistory returns the history entries with exactly layers entries that
+// are not empty_layer. Extra layer entries become empty_layer entries, and
+// missing ones are added at the end with the image creation time.
+func alignHistory(ctx context.Context, history interface{}, layers int, created interface{}) []interface{} {
+	entries, _ := history.([]interface{})
+	aligned := []interface{}{}
+	count := 0
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if emptyLayer, _ := fields["empty_layer"].(bool); !emptyLayer {
+			if count == layers {
+				fields["empty_layer"] = true
+			} else {
+				count++
+			}
+		}
+		aligned = append(aligned, fields)
+	}
+	if count != layers {
+		logger(ctx).Println("Adding", layers-count, "history entries to match the layers")
+	}
+	for ; count < layers; count++ {
+		entry := map[string]interface{}{}
+		if created != nil {
+			entry["created"] = created
+		}
+		aligned = append(aligned, entry)
+	}
+	return aligned
+}
+
+// useDockerMediaTypes switches the config and layer descriptors to the
+// Docker schema2 media types.
+func (i *Image) useDockerMediaTypes() {
+	i.Manifest.Config.MediaType = dockerConfigMediaType
+	// The layers are shared with the unmodified image.
+	i.Manifest.Layers = append([]Descriptor(nil), i.Manifest.Layers...)
+	for k, layer := range i.Manifest.Layers {
+		if mediaType, ok := dockerLayerMediaTypes[layer.MediaType]; ok {
+			i.Manifest.Layers[k].MediaType = mediaType
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+// schema2OnlyDockerAPI is a daemon rejecting the configs that are not valid
+// Docker schema2 configs.
+type schema2OnlyDockerAPI struct {
+	*fakeDockerAPI
+}
+
+func (f schema2OnlyDockerAPI) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+	if err := checkSchema2Tar(data); err != nil {
+		body := fmt.Sprintf(`{"errorDetail":{"message":%q},"error":%q}`, err.Error(), err.Error())
+		return types.ImageLoadResponse{Body: io.NopCloser(strings.NewReader(body)), JSON: true}, nil
+	}
+	return f.fakeDockerAPI.ImageLoad(ctx, bytes.NewReader(data), quiet)
+}
+
+// checkSchema2Tar fails unless every config in the docker-archive tar only
+// has schema2 fields and a history entry for each layer.
+func checkSchema2Tar(data []byte) error {
+	entries := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entries[header.Name], err = io.ReadAll(tr); err != nil {
+			return err
+		}
+	}
+
+	manifests := []OutputManifest{}
+	if err := encodingjson.Unmarshal(entries["manifest.json"], &manifests); err != nil {
+		return err
+	}
+	for _, manifest := range manifests {
+		configData := map[string]interface{}{}
+		if err := encodingjson.Unmarshal(entries[manifest.Config], &configData); err != nil {
+			return err
+		}
+		for name := range configData {
+			if !dockerConfigFields[name] {
+				return fmt.Errorf("invalid image config: unknown field %q", name)
+			}
+		}
+		history, _ := configData["history"].([]interface{})
+		layers := 0
+		for _, entry := range history {
+			if emptyLayer, _ := entry.(map[string]interface{})["empty_layer"].(bool); !emptyLayer {
+				layers++
+			}
+		}
+		if diffIDs := configDiffIDs(configData); len(history) > 0 && layers != len(diffIDs) {
+			return fmt.Errorf("invalid image config: %d history entries for %d layers", layers, len(diffIDs))
+		}
+	}
+	return nil
+}
+
+// writeOCIConfigImage writes an image whose config has a field Docker does
+// not know and a history entry for only one of its two layers.
+func writeOCIConfigImage(t *testing.T) Image {
+	image := writeTestImage(t, t.TempDir(), map[string]interface{}{"Cmd": []interface{}{"/app"}},
+		testLayer{"etc/os-release": "debian"}, testLayer{"app": "binary"})
+	setTestHistory(t, &image, []interface{}{
+		map[string]interface{}{"created_by": "ADD rootfs.tar /"},
+		map[string]interface{}{"created_by": "CMD /app", "empty_layer": true},
+	})
+	require.NoError(t, image.UpdateConfig(filepath.Join(image.Path, "blobs", "sha256"), func(configData map[string]interface{}) error {
+		configData["annotations"] = map[string]interface{}{"org.opencontainers.image.source": "https://example.com"}
+		configData["created"] = "2024-01-01T00:00:00Z"
+		return nil
+	}))
+	return image
+}
+
+func TestDockerCompatConfigLoadsIntoSchema2Daemon(t *testing.T) {
+	image := writeOCIConfigImage(t)
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(schema2OnlyDockerAPI{cli}, DockerLoaderOpts{})
+
+	_, err := loadImage(context.Background(), loader, image, []string{"app"}, Options{})
+	require.ErrorContains(t, err, "invalid image config")
+	require.Empty(t, cli.images)
+
+	action, err := loadImage(context.Background(), loader, image, []string{"app"}, Options{DockerCompatConfig: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"app:latest"}, action.TagsAdded)
+	loaded := cli.find("app:latest")
+	require.NotNil(t, loaded)
+	require.Equal(t, action.Digest, loaded.ID)
+}
+
+func TestDockerCompatConfigKeepsRuntimeConfig(t *testing.T) {
+	image := writeOCIConfigImage(t)
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{DockerCompat: true}
+	require.NoError(t, builder.Prepare(context.Background(), &image))
+	require.Equal(t, dockerConfigMediaType, image.Manifest.Config.MediaType)
+	for _, layer := range image.Manifest.Layers {
+		require.Equal(t, "application/vnd.docker.image.rootfs.diff.tar.gzip", layer.MediaType)
+	}
+
+	configData := map[string]interface{}{}
+	configJSON, err := os.ReadFile(builder.ConfigPath)
+	require.NoError(t, err)
+	require.NoError(t, encodingjson.Unmarshal(configJSON, &configData))
+	require.NotContains(t, configData, "annotations")
+	require.Equal(t, []interface{}{"/app"}, configData["config"].(map[string]interface{})["Cmd"])
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"created_by": "ADD rootfs.tar /"},
+		map[string]interface{}{"created_by": "CMD /app", "empty_layer": true},
+		map[string]interface{}{"created": "2024-01-01T00:00:00Z"},
+	}, configData["history"])
+}
+
+func TestAlignHistoryMarksExtraLayerEntriesEmpty(t *testing.T) {
+	history := []interface{}{
+		map[string]interface{}{"created_by": "ADD rootfs.tar /"},
+		map[string]interface{}{"created_by": "RUN rm -rf /tmp"},
+	}
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"created_by": "ADD rootfs.tar /"},
+		map[string]interface{}{"created_by": "RUN rm -rf /tmp", "empty_layer": true},
+	}, alignHistory(context.Background(), history, 1, nil))
+}
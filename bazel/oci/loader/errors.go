@@ -0,0 +1,75 @@
+// Failures tagged with the phase of the load they happened in.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/juanique/monorepo/salsa/go/json"
+)
+
+// Exit codes of a failed load with --output=json, by phase. Failures outside
+// of any phase, e.g. invalid flags, exit with exitCodeError.
+const (
+	exitCodeError   = 1
+	exitCodePrepare = 2
+	exitCodeCheck   = 3
+	exitCodeLoad    = 4
+	exitCodeBuild   = 5
+)
+
+var phaseExitCodes = map[string]int{
+	PhasePrepare: exitCodePrepare,
+	PhaseCheck:   exitCodeCheck,
+	PhaseBuild:   exitCodeBuild,
+	PhaseLoad:    exitCodeLoad,
+}
+
+// LoadError is a failure in one of the phases of loadImage.
+type LoadError struct {
+	Phase string
+	Err   error
+}
+
+func (e *LoadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// inPhase returns err as a LoadError of the phase, or nil if err is nil.
+func inPhase(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &LoadError{Phase: phase, Err: err}
+}
+
+// ErrorOutput is written on stdout when a load fails with --output=json, and
+// closes the stream with --output=jsonl.
+type ErrorOutput struct {
+	Error string `json:"error"`
+	Phase string `json:"phase,omitempty"`
+	Code  int    `json:"code"`
+}
+
+// newErrorOutput describes err, using the phase of a LoadError.
+func newErrorOutput(err error) ErrorOutput {
+	out := ErrorOutput{Error: err.Error(), Code: exitCodeError}
+	var loadErr *LoadError
+	if errors.As(err, &loadErr) {
+		out.Phase = loadErr.Phase
+		out.Code = phaseExitCodes[loadErr.Phase]
+	}
+	return out
+}
+
+// writeJSONError writes err as an ErrorOutput to w, returning the exit code.
+func writeJSONError(w io.Writer, err error) int {
+	out := newErrorOutput(err)
+	fmt.Fprintln(w, json.MustToJSON(out))
+	return out.Code
+}
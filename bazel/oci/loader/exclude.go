@@ -0,0 +1,236 @@
+// Removal of files from the image layers.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Layer media types excludeFromLayer can rewrite.
+var (
+	gzipLayerMediaTypes = map[string]bool{
+		"application/vnd.oci.image.layer.v1.tar+gzip":                  true,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":            true,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    true,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": true,
+	}
+	tarLayerMediaTypes = map[string]bool{
+		"application/vnd.oci.image.layer.v1.tar":                  true,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar": true,
+	}
+)
+
+// excludedPath reports whether the file at name, or any directory above it,
+// matches one of the patterns. Names are matched without a leading "./" or
+// "/", the way they appear in the image filesystem. Patterns without a slash
+// also match the base name at any depth, so *.pyc matches lib/app.pyc.
+func excludedPath(patterns []string, name string) (bool, error) {
+	baseNamePatterns := []string{}
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			baseNamePatterns = append(baseNamePatterns, pattern)
+		}
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for name != "" && name != "." {
+		matched, err := matchesAny(patterns, name)
+		if err == nil && !matched {
+			matched, err = matchesAny(baseNamePatterns, path.Base(name))
+		}
+		if err != nil || matched {
+			return matched, err
+		}
+		name = path.Dir(name)
+	}
+	return false, nil
+}
+
+// excludedEntry reports whether the tar entry is excluded by the patterns.
+// Hard links to excluded files are excluded too, since their target is gone.
+func excludedEntry(patterns []string, header *tar.Header) (bool, error) {
+	excluded, err := excludedPath(patterns, header.Name)
+	if err == nil && !excluded && header.Typeflag == tar.TypeLink {
+		excluded, err = excludedPath(patterns, header.Linkname)
+	}
+	return excluded, err
+}
+
+// errExcludedEntry stops the scan of a layer at its first excluded entry.
+var errExcludedEntry = errors.New("layer has excluded entries")
+
+// hasExcludedEntries reports whether any entry of the layer is excluded by
+// the patterns, only reading the layer.
+func hasExcludedEntries(layerPath string, patterns []string) (bool, error) {
+	err := readLayerEntries(layerPath, func(header *tar.Header, _ io.Reader) error {
+		excluded, err := excludedEntry(patterns, header)
+		if err == nil && excluded {
+			return errExcludedEntry
+		}
+		return err
+	})
+	if errors.Is(err, errExcludedEntry) {
+		return true, nil
+	}
+	return false, err
+}
+
+// excludeFromLayer writes a copy of the layer without the files matching the
+// patterns into blobsDir. Removing files changes the digest and diff ID of
+// the layer, which are returned along with whether anything was removed. A
+// layer without matching files is left as is, without writing a copy.
+func excludeFromLayer(ctx context.Context, layer Descriptor, layerPath string, patterns []string, blobsDir string) (Descriptor, string, bool, error) {
+	compressed := gzipLayerMediaTypes[layer.MediaType]
+	if !compressed && !tarLayerMediaTypes[layer.MediaType] {
+		return layer, "", false, fmt.Errorf("cannot exclude paths from layer %s with media type %q", layer.Digest, layer.MediaType)
+	}
+	if found, err := hasExcludedEntries(layerPath, patterns); err != nil || !found {
+		if err != nil {
+			err = fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+		}
+		return layer, "", false, err
+	}
+
+	in, err := os.Open(layerPath)
+	if err != nil {
+		return layer, "", false, err
+	}
+	defer in.Close()
+	var src io.Reader = in
+	if compressed {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return layer, "", false, fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	out, err := os.CreateTemp(blobsDir, "layer-*")
+	if err != nil {
+		return layer, "", false, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// The digest covers the blob as written, the diff ID the uncompressed tar.
+	blobHash := sha256.New()
+	diffHash := sha256.New()
+	blob := io.MultiWriter(out, blobHash)
+	var gz *gzip.Writer
+	dst := io.MultiWriter(blob, diffHash)
+	if compressed {
+		gz = gzip.NewWriter(blob)
+		dst = io.MultiWriter(gz, diffHash)
+	}
+
+	removed, err := copyLayerExcluding(tar.NewReader(src), tar.NewWriter(dst), patterns)
+	if err != nil {
+		return layer, "", false, fmt.Errorf("error rewriting layer %s: %w", layer.Digest, err)
+	}
+	if removed == 0 {
+		return layer, "", false, nil
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return layer, "", false, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return layer, "", false, err
+	}
+
+	newLayer := layer
+	newLayer.Digest = hashDigest(blobHash)
+	if info, err := os.Stat(out.Name()); err == nil {
+		newLayer.Size = int(info.Size())
+	}
+	if err := os.Rename(out.Name(), filepath.Join(blobsDir, strings.TrimPrefix(newLayer.Digest, "sha256:"))); err != nil {
+		return layer, "", false, err
+	}
+	logger(ctx).Println("Excluded", removed, "files from layer", layer.Digest, "now", newLayer.Digest)
+	return newLayer, hashDigest(diffHash), true, nil
+}
+
+// copyLayerExcluding copies the tar entries not excluded by the patterns,
+// returning how many were left out.
+func copyLayerExcluding(tr *tar.Reader, tw *tar.Writer, patterns []string) (int, error) {
+	removed := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return removed, err
+		}
+
+		excluded, err := excludedEntry(patterns, header)
+		if err != nil {
+			return removed, err
+		}
+		if excluded {
+			removed++
+			continue
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return removed, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return removed, err
+		}
+	}
+	return removed, tw.Close()
+}
+
+func hashDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// excludePaths removes the files matching the patterns from the image layers,
+// writing the changed layers into blobsDir. It returns the config update
+// replacing the diff IDs of the changed layers.
+func (i *Image) excludePaths(ctx context.Context, patterns []string, blobsDir string) (func(map[string]interface{}) error, error) {
+	diffIDs := map[int]string{}
+	// The layers are shared with the unmodified image.
+	i.Manifest.Layers = append([]Descriptor(nil), i.Manifest.Layers...)
+	// Layers appended later have no diff ID in the config yet.
+	layers := len(i.Manifest.Layers)
+	for k, layer := range i.Manifest.Layers {
+		newLayer, diffID, changed, err := excludeFromLayer(ctx, layer, i.BlobPath(layer.Digest), patterns, blobsDir)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			i.Manifest.Layers[k] = newLayer
+			diffIDs[k] = diffID
+		}
+	}
+	i.PreparedBlobsDir = blobsDir
+
+	return func(configData map[string]interface{}) error {
+		rootfs, ok := configData["rootfs"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config json missing rootfs key")
+		}
+		ids, ok := rootfs["diff_ids"].([]interface{})
+		if !ok || len(ids) != layers {
+			return fmt.Errorf("config rootfs does not have a diff ID for every layer")
+		}
+		for k, diffID := range diffIDs {
+			ids[k] = diffID
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/stretchr/testify/suite"
+)
+
+type ExcludeTestSuite struct {
+	suite.Suite
+}
+
+// layerFiles returns the names of the files in a gzipped layer blob and the
+// diff ID of the layer.
+func (suite *ExcludeTestSuite) layerFiles(blobPath string) ([]string, string) {
+	f, err := os.Open(blobPath)
+	suite.Require().NoError(err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	suite.Require().NoError(err)
+	data, err := io.ReadAll(gz)
+	suite.Require().NoError(err)
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		suite.Require().NoError(err)
+		names = append(names, header.Name)
+	}
+	sum := sha256.Sum256(data)
+	return names, "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (suite *ExcludeTestSuite) TestExcludedPathIsRemovedFromLayer() {
+	original := writeTestImage(suite.T(), suite.T().TempDir(), nil,
+		testLayer{"etc/os-release": "debian"},
+		testLayer{"app": "binary", "root/.cache/pip/wheel": "big", "root/.cache/go": "bigger"},
+	)
+	image := original
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{ExcludePaths: []string{"root/.cache"}}
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+
+	suite.Equal(original.Manifest.Layers[0], image.Manifest.Layers[0])
+	suite.NotEqual(original.Manifest.Layers[1].Digest, image.Manifest.Layers[1].Digest)
+	suite.NotEqual(original.Manifest.Config.Digest, image.Manifest.Config.Digest)
+
+	names, diffID := suite.layerFiles(image.BlobPath(image.Manifest.Layers[1].Digest))
+	suite.Equal([]string{"app"}, names)
+
+	configData := map[string]interface{}{}
+	suite.Require().NoError(json.FromFile(builder.ConfigPath, &configData))
+	suite.Equal(diffID, configDiffIDs(configData)[1])
+
+	// The unmodified image still points at the original layer.
+	names, _ = suite.layerFiles(original.BlobPath(original.Manifest.Layers[1].Digest))
+	suite.Len(names, 3)
+}
+
+func (suite *ExcludeTestSuite) TestNothingExcludedKeepsLayers() {
+	original := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	image := original
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{ExcludePaths: []string{"root/.cache"}}
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+
+	suite.Equal(original.Manifest.Layers, image.Manifest.Layers)
+}
+
+func (suite *ExcludeTestSuite) TestUnchangedLayerIsNotRewritten() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	layer := image.Manifest.Layers[0]
+	blobsDir := suite.T().TempDir()
+
+	newLayer, _, changed, err := excludeFromLayer(context.Background(), layer, image.BlobPath(layer.Digest), []string{"*.pyc"}, blobsDir)
+	suite.Require().NoError(err)
+	suite.False(changed)
+	suite.Equal(layer, newLayer)
+	written, err := os.ReadDir(blobsDir)
+	suite.Require().NoError(err)
+	suite.Empty(written)
+}
+
+func (suite *ExcludeTestSuite) TestExcludedPath() {
+	patterns := []string{"root/.cache", "*.pyc", "__pycache__"}
+	for name, want := range map[string]bool{
+		"root/.cache":         true,
+		"./root/.cache/pip/x": true,
+		"/root/.cache/go":     true,
+		"root/.cachedir":      false,
+		"app.pyc":             true,
+		"lib/app.pyc":         true,
+		"lib/__pycache__/x":   true,
+		"lib/pycache/x":       false,
+		"usr/lib/python/x.py": false,
+	} {
+		excluded, err := excludedPath(patterns, name)
+		suite.Require().NoError(err)
+		suite.Equal(want, excluded, name)
+	}
+}
+
+func TestExcludeTestSuite(t *testing.T) {
+	suite.Run(t, new(ExcludeTestSuite))
+}
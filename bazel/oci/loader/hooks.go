@@ -0,0 +1,62 @@
+// User commands run around the load.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// hookEnv is the environment of a hook: the loader environment plus the
+// image digest, the space separated repo tags and, after the load, the
+// action as JSON.
+func hookEnv(digest string, repoTags []string, action *DockerLoadAction) []string {
+	env := append(os.Environ(), "LOADER_DIGEST="+digest, "LOADER_TAGS="+strings.Join(repoTags, " "))
+	if action != nil {
+		env = append(env, "LOADER_ACTION_JSON="+action.JSON())
+	}
+	return env
+}
+
+// runHook runs the command with sh, sending its output to the logs so that
+// it never mixes with the loader output.
+func runHook(ctx context.Context, name, command string, env []string) error {
+	logger(ctx).Println("Running", name, "hook:", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = env
+	cmd.Stdout = logger(ctx).Writer()
+	cmd.Stderr = logger(ctx).Writer()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
+
+// runPreLoadHook runs the --pre-load-hook, if any, once the image ID is known.
+// A failing hook aborts the load.
+func runPreLoadHook(ctx context.Context, o Options, digest string, repoTags []string) error {
+	if o.PreLoadHook == "" {
+		return nil
+	}
+	return runHook(ctx, "pre-load", o.PreLoadHook, hookEnv(digest, repoTags, nil))
+}
+
+// runPostLoadHook runs the --post-load-hook, if any, after a successful load,
+// with the tags the image ended up with. A failing hook is only logged unless
+// --fail-on-post-load-hook is set.
+func runPostLoadHook(ctx context.Context, o Options, action DockerLoadAction) error {
+	if o.PostLoadHook == "" {
+		return nil
+	}
+	tags := append(append([]string(nil), action.TagsAlreadyPresent...), action.TagsAdded...)
+	sort.Strings(tags)
+	err := runHook(ctx, "post-load", o.PostLoadHook, hookEnv(action.Digest, tags, &action))
+	if err != nil && !o.FailOnPostLoadHook {
+		logger(ctx).Println("Ignoring error:", err)
+		return nil
+	}
+	return err
+}
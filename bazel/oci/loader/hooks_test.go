@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/stretchr/testify/suite"
+)
+
+type HooksTestSuite struct {
+	suite.Suite
+	image  Image
+	dir    string
+	cli    *fakeDockerAPI
+	loader *DockerLoader
+}
+
+func (suite *HooksTestSuite) SetupTest() {
+	suite.dir = suite.T().TempDir()
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	suite.cli = newFakeDockerAPI()
+	suite.loader = newDockerLoaderWithAPI(suite.cli, DockerLoaderOpts{})
+}
+
+// recordEnv returns a hook command writing the hook environment into the
+// named file.
+func (suite *HooksTestSuite) recordEnv(name string) string {
+	return `printf '%s\n%s\n%s\n' "$LOADER_DIGEST" "$LOADER_TAGS" "$LOADER_ACTION_JSON" > ` + filepath.Join(suite.dir, name)
+}
+
+// recordedEnv returns the digest, tags and action JSON recorded by a hook.
+func (suite *HooksTestSuite) recordedEnv(name string) []string {
+	data, err := os.ReadFile(filepath.Join(suite.dir, name))
+	suite.Require().NoError(err)
+	// The action JSON takes the rest of the lines.
+	return strings.SplitN(strings.TrimSuffix(string(data), "\n"), "\n", 3)
+}
+
+func (suite *HooksTestSuite) TestHooksEnvironment() {
+	o := Options{PreLoadHook: suite.recordEnv("pre"), PostLoadHook: suite.recordEnv("post")}
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, suite.loader, suite.image, []string{"app", "app:v1"}, o))
+
+	post := suite.recordedEnv("post")
+	suite.Require().Len(post, 3)
+	action := DockerLoadAction{}
+	suite.Require().NoError(json.FromJSON(post[2], &action))
+	suite.Equal([]string{"app:latest", "app:v1"}, action.TagsAdded)
+	suite.Equal([]string{action.Digest, "app:latest app:v1"}, post[:2])
+
+	// The pre-load hook already gets the digest the image is loaded as.
+	suite.Equal([]string{action.Digest, "app:latest app:v1", ""}, suite.recordedEnv("pre"))
+}
+
+func (suite *HooksTestSuite) TestFailingPreLoadHookAbortsLoad() {
+	o := Options{PreLoadHook: "exit 3", PostLoadHook: suite.recordEnv("post")}
+	err := runLoad(context.Background(), io.Discard, suite.loader, suite.image, []string{"app"}, o)
+	suite.ErrorContains(err, "pre-load hook failed")
+	suite.Equal(exitCodePrepare, newErrorOutput(err).Code)
+	suite.Empty(suite.cli.loadedTars)
+	suite.NoFileExists(filepath.Join(suite.dir, "post"))
+}
+
+func (suite *HooksTestSuite) TestFailingPostLoadHook() {
+	o := Options{PostLoadHook: "exit 1"}
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, suite.loader, suite.image, []string{"app"}, o))
+	suite.Len(suite.cli.loadedTars, 1)
+
+	o.FailOnPostLoadHook = true
+	err := runLoad(context.Background(), io.Discard, suite.loader, suite.image, []string{"app"}, o)
+	suite.ErrorContains(err, "post-load hook failed")
+}
+
+func (suite *HooksTestSuite) TestHooksOnlyRunFromRunLoad() {
+	o := Options{PreLoadHook: suite.recordEnv("pre"), PostLoadHook: suite.recordEnv("post")}
+	_, err := loadImage(context.Background(), suite.loader, suite.image, []string{"app"}, o)
+	suite.Require().NoError(err)
+	suite.Len(suite.cli.loadedTars, 1)
+	suite.NoFileExists(filepath.Join(suite.dir, "pre"))
+	suite.NoFileExists(filepath.Join(suite.dir, "post"))
+}
+
+func TestHooksTestSuite(t *testing.T) {
+	suite.Run(t, new(HooksTestSuite))
+}
@@ -0,0 +1,65 @@
+// The --output=jsonl event stream, for tools following the load as it runs.
+package main
+
+import (
+	encodingjson "encoding/json"
+	"io"
+	"sync"
+)
+
+// outputJSONL streams the progress events, then the action or the error, as
+// JSON Lines.
+const outputJSONL = "jsonl"
+
+// Types of the JSON Lines closing the stream, next to the ProgressEventTypes.
+const (
+	jsonlAction = "action"
+	jsonlError  = "error"
+)
+
+// jsonlActionLine is the last line of a successful run.
+type jsonlActionLine struct {
+	Type   string           `json:"type"`
+	Action DockerLoadAction `json:"action"`
+}
+
+// jsonlErrorLine is the last line of a failed run.
+type jsonlErrorLine struct {
+	Type string `json:"type"`
+	ErrorOutput
+}
+
+// writeJSONLine writes v as a single line. The line goes out in a single
+// write, so an interrupted run never leaves half a line behind.
+func writeJSONLine(w io.Writer, v interface{}) error {
+	data, err := encodingjson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// writeJSONLProgress returns a ProgressFunc writing every event to w as a
+// line.
+func writeJSONLProgress(w io.Writer) ProgressFunc {
+	var mu sync.Mutex
+	return func(event ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		writeJSONLine(w, event)
+	}
+}
+
+// writeJSONLAction writes the line closing a successful run.
+func writeJSONLAction(w io.Writer, action DockerLoadAction) {
+	writeJSONLine(w, jsonlActionLine{Type: jsonlAction, Action: action.canonicalCopy()})
+}
+
+// writeJSONLError writes the line closing a failed run, returning the exit
+// code.
+func writeJSONLError(w io.Writer, err error) int {
+	out := newErrorOutput(err)
+	writeJSONLine(w, jsonlErrorLine{Type: jsonlError, ErrorOutput: out})
+	return out.Code
+}
@@ -0,0 +1,166 @@
+// Loading of images into the nodes of a kind cluster.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// kindClusterLabel is set by kind on every node container of a cluster, and
+// kindRoleLabel to the role of the node.
+const (
+	kindClusterLabel = "io.x-k8s.kind.cluster"
+	kindRoleLabel    = "io.x-k8s.kind.role"
+)
+
+// kindImageRoles are the roles of the nodes running Kubernetes, and so the
+// ones the image is imported into. The external-load-balancer node of HA
+// clusters only runs a proxy in front of the control planes.
+var kindImageRoles = map[string]bool{"control-plane": true, "worker": true}
+
+// kindImportCmd imports an image tar from stdin into the node's containerd,
+// the same way `kind load` does.
+var kindImportCmd = []string{"ctr", "--namespace=k8s.io", "images", "import", "--all-platforms", "--digests", "-"}
+
+// kindAPI is the part of the Docker client used to import images into kind
+// nodes.
+type kindAPI interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error)
+	ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error)
+}
+
+// KindNodeLoad is the result of importing the image into one kind node.
+type KindNodeLoad struct {
+	Node  string `json:"node"`
+	Error string `json:"error,omitempty"`
+}
+
+// KindLoader imports image tars into the nodes of a kind cluster by running
+// containerd's ctr inside each node container.
+type KindLoader struct {
+	cli     kindAPI
+	cluster string
+}
+
+// NewKindLoader creates a KindLoader for the named cluster.
+func NewKindLoader(cli kindAPI, cluster string) *KindLoader {
+	return &KindLoader{cli: cli, cluster: cluster}
+}
+
+// Nodes returns the names of the node containers of the cluster that run
+// Kubernetes.
+func (k *KindLoader) Nodes(ctx context.Context) ([]string, error) {
+	args := filters.NewArgs(filters.Arg("label", kindClusterLabel+"="+k.cluster))
+	containers, err := k.cli.ContainerList(ctx, container.ListOptions{Filters: args})
+	if err != nil {
+		return nil, fmt.Errorf("error listing kind nodes: %w", err)
+	}
+
+	nodes := []string{}
+	for _, c := range containers {
+		if !kindImageRoles[c.Labels[kindRoleLabel]] {
+			continue
+		}
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		nodes = append(nodes, name)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// LoadTar imports the tar into every node of the cluster. Nodes that fail are
+// reported in the result, and an error is returned if any of them failed.
+func (k *KindLoader) LoadTar(ctx context.Context, tarPath string) ([]KindNodeLoad, error) {
+	nodes, err := k.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes found for kind cluster %q", k.cluster)
+	}
+
+	results := []KindNodeLoad{}
+	failed := 0
+	for _, node := range nodes {
+		result := KindNodeLoad{Node: node}
+		if err := k.loadIntoNode(ctx, node, tarPath); err != nil {
+			logger(ctx).Println("Could not load image into kind node", node+":", err)
+			result.Error = err.Error()
+			failed++
+		} else {
+			logger(ctx).Println("Loaded image into kind node", node)
+		}
+		results = append(results, result)
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("failed to load image into %d of %d kind nodes", failed, len(nodes))
+	}
+	return results, nil
+}
+
+func (k *KindLoader) loadIntoNode(ctx context.Context, node, tarPath string) error {
+	tar, err := os.Open(tarPath)
+	if err != nil {
+		return fmt.Errorf("error opening tar file (%s): %w", tarPath, err)
+	}
+	defer tar.Close()
+
+	exec, err := k.cli.ContainerExecCreate(ctx, node, types.ExecConfig{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          kindImportCmd,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating import exec: %w", err)
+	}
+
+	resp, err := k.cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return fmt.Errorf("error attaching to import exec: %w", err)
+	}
+	defer resp.Close()
+
+	// Stream the tar while reading the output so neither side blocks.
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(resp.Conn, tar)
+		if closeErr := resp.CloseWrite(); err == nil {
+			err = closeErr
+		}
+		copyErr <- err
+	}()
+
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, resp.Reader); err != nil {
+		return fmt.Errorf("error reading import output: %w", err)
+	}
+	if err := <-copyErr; err != nil {
+		return fmt.Errorf("error sending image to node: %w", err)
+	}
+
+	inspect, err := k.cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return fmt.Errorf("error inspecting import exec: %w", err)
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("ctr import exited with %d: %s", inspect.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
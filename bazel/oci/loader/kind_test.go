@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/suite"
+)
+
+type KindTestSuite struct {
+	suite.Suite
+	tarPath string
+}
+
+func (suite *KindTestSuite) SetupTest() {
+	suite.tarPath = filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(suite.tarPath, []byte("image tar"), 0644))
+}
+
+// fakeExecConn records what is written to the exec's stdin.
+type fakeExecConn struct {
+	net.Conn
+	stdin bytes.Buffer
+}
+
+func (c *fakeExecConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+func (c *fakeExecConn) CloseWrite() error           { return nil }
+func (c *fakeExecConn) Close() error                { return nil }
+
+// fakeKindAPI simulates kind node containers, failing the import on the nodes
+// listed in failing.
+type fakeKindAPI struct {
+	nodes   []types.Container
+	failing map[string]bool
+
+	execNodes map[string]string
+	stdin     map[string]*fakeExecConn
+	cmds      map[string][]string
+}
+
+func newFakeKindAPI(nodes ...string) *fakeKindAPI {
+	f := &fakeKindAPI{
+		failing:   map[string]bool{},
+		execNodes: map[string]string{},
+		stdin:     map[string]*fakeExecConn{},
+		cmds:      map[string][]string{},
+	}
+	for _, node := range nodes {
+		// kind names the nodes after their role.
+		role := "worker"
+		for _, r := range []string{"control-plane", "external-load-balancer"} {
+			if strings.Contains(node, r) {
+				role = r
+			}
+		}
+		f.nodes = append(f.nodes, types.Container{ID: "id-" + node, Names: []string{"/" + node}, Labels: map[string]string{kindClusterLabel: "dev", kindRoleLabel: role}})
+	}
+	return f
+}
+
+func (f *fakeKindAPI) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	if options.Filters.Get("label")[0] != kindClusterLabel+"=dev" {
+		return nil, nil
+	}
+	return f.nodes, nil
+}
+
+func (f *fakeKindAPI) ContainerExecCreate(ctx context.Context, node string, config types.ExecConfig) (types.IDResponse, error) {
+	id := fmt.Sprintf("exec-%d", len(f.execNodes))
+	f.execNodes[id] = node
+	f.cmds[node] = config.Cmd
+	return types.IDResponse{ID: id}, nil
+}
+
+func (f *fakeKindAPI) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	node := f.execNodes[execID]
+	output := bytes.Buffer{}
+	if f.failing[node] {
+		fmt.Fprint(stdcopy.NewStdWriter(&output, stdcopy.Stderr), "ctr: image import failed\n")
+	} else {
+		fmt.Fprint(stdcopy.NewStdWriter(&output, stdcopy.Stdout), "unpacking image...done\n")
+	}
+
+	conn := &fakeExecConn{}
+	f.stdin[node] = conn
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(&output)}, nil
+}
+
+func (f *fakeKindAPI) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	if f.failing[f.execNodes[execID]] {
+		return types.ContainerExecInspect{ExitCode: 1}, nil
+	}
+	return types.ContainerExecInspect{}, nil
+}
+
+func (suite *KindTestSuite) TestLoadTarImportsIntoEveryNode() {
+	cli := newFakeKindAPI("dev-worker", "dev-control-plane")
+
+	results, err := NewKindLoader(cli, "dev").LoadTar(context.Background(), suite.tarPath)
+	suite.Require().NoError(err)
+	suite.Equal([]KindNodeLoad{{Node: "dev-control-plane"}, {Node: "dev-worker"}}, results)
+
+	for _, node := range []string{"dev-control-plane", "dev-worker"} {
+		suite.Equal(kindImportCmd, cli.cmds[node])
+		suite.Equal("image tar", cli.stdin[node].stdin.String())
+	}
+}
+
+func (suite *KindTestSuite) TestLoadTarSkipsLoadBalancer() {
+	cli := newFakeKindAPI("dev-control-plane", "dev-control-plane2", "dev-external-load-balancer", "dev-worker")
+
+	results, err := NewKindLoader(cli, "dev").LoadTar(context.Background(), suite.tarPath)
+	suite.Require().NoError(err)
+	suite.Equal([]KindNodeLoad{{Node: "dev-control-plane"}, {Node: "dev-control-plane2"}, {Node: "dev-worker"}}, results)
+	suite.NotContains(cli.cmds, "dev-external-load-balancer")
+}
+
+func (suite *KindTestSuite) TestLoadTarReportsFailedNodes() {
+	cli := newFakeKindAPI("dev-control-plane", "dev-worker")
+	cli.failing["dev-worker"] = true
+
+	results, err := NewKindLoader(cli, "dev").LoadTar(context.Background(), suite.tarPath)
+	suite.Require().Error(err)
+	suite.Equal([]KindNodeLoad{
+		{Node: "dev-control-plane"},
+		{Node: "dev-worker", Error: "ctr import exited with 1: ctr: image import failed"},
+	}, results)
+}
+
+func (suite *KindTestSuite) TestLoadTarFailsWithoutNodes() {
+	cli := newFakeKindAPI("dev-control-plane")
+
+	_, err := NewKindLoader(cli, "other").LoadTar(context.Background(), suite.tarPath)
+	suite.Require().Error(err)
+}
+
+func TestKindTestSuite(t *testing.T) {
+	suite.Run(t, new(KindTestSuite))
+}
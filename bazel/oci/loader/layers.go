@@ -0,0 +1,49 @@
+// Statistics on how many image layers the daemon already had.
+package main
+
+// LayerStats reports how many of the image layers were already present in the
+// daemon and how many had to be loaded. Bytes are the compressed layer sizes.
+type LayerStats struct {
+	LayersReused int   `json:"layersReused"`
+	LayersLoaded int   `json:"layersLoaded"`
+	BytesReused  int64 `json:"bytesReused"`
+	BytesLoaded  int64 `json:"bytesLoaded"`
+}
+
+// computeLayerStats compares the image layers, identified by their diff IDs,
+// with the layers of images already in the daemon. Docker stores layers as a
+// chain, so a layer can only be reused if every layer below it is shared too:
+// the reused layers are the longest common prefix with any existing image.
+func computeLayerStats(layers []Descriptor, diffIDs []string, existing [][]string) LayerStats {
+	reused := 0
+	for _, chain := range existing {
+		shared := 0
+		for shared < len(chain) && shared < len(diffIDs) && chain[shared] == diffIDs[shared] {
+			shared++
+		}
+		if shared > reused {
+			reused = shared
+		}
+	}
+
+	stats := LayerStats{}
+	for k, layer := range layers {
+		if k < reused {
+			stats.LayersReused++
+			stats.BytesReused += int64(layer.Size)
+		} else {
+			stats.LayersLoaded++
+			stats.BytesLoaded += int64(layer.Size)
+		}
+	}
+	return stats
+}
+
+// configDiffIDs returns the layer diff IDs listed in the image config.
+func configDiffIDs(configData map[string]interface{}) []string {
+	rootfs, ok := configData["rootfs"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return getStringSlice(rootfs, "diff_ids")
+}
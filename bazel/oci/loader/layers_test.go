@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LayersTestSuite struct {
+	suite.Suite
+}
+
+func testLayers(sizes ...int) []Descriptor {
+	layers := []Descriptor{}
+	for _, size := range sizes {
+		layers = append(layers, Descriptor{Size: size})
+	}
+	return layers
+}
+
+func (suite *LayersTestSuite) TestDerivedImageReusesBaseLayers() {
+	base := []string{"sha256:os", "sha256:runtime"}
+	derived := []string{"sha256:os", "sha256:runtime", "sha256:app"}
+
+	stats := computeLayerStats(testLayers(100, 50, 10), derived, [][]string{base})
+	suite.Equal(LayerStats{LayersReused: 2, LayersLoaded: 1, BytesReused: 150, BytesLoaded: 10}, stats)
+}
+
+func (suite *LayersTestSuite) TestLayersAboveADifferentLayerAreNotReused() {
+	existing := []string{"sha256:os", "sha256:old-runtime", "sha256:app"}
+	image := []string{"sha256:os", "sha256:runtime", "sha256:app"}
+
+	stats := computeLayerStats(testLayers(100, 50, 10), image, [][]string{existing})
+	suite.Equal(LayerStats{LayersReused: 1, LayersLoaded: 2, BytesReused: 100, BytesLoaded: 60}, stats)
+}
+
+func (suite *LayersTestSuite) TestFullLoadReusesNothing() {
+	stats := computeLayerStats(testLayers(100, 10), []string{"sha256:os", "sha256:app"}, nil)
+	suite.Equal(LayerStats{LayersLoaded: 2, BytesLoaded: 110}, stats)
+}
+
+func (suite *LayersTestSuite) TestConfigDiffIDs() {
+	configData := map[string]interface{}{
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []interface{}{"sha256:os", "sha256:app"},
+		},
+	}
+	suite.Equal([]string{"sha256:os", "sha256:app"}, configDiffIDs(configData))
+	suite.Nil(configDiffIDs(map[string]interface{}{}))
+}
+
+func TestLayersTestSuite(t *testing.T) {
+	suite.Run(t, new(LayersTestSuite))
+}
@@ -0,0 +1,125 @@
+// Listing of the images loaded by this tool.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/spf13/cobra"
+)
+
+// Labels set by Prepare on the images this tool loads. loadedByLabel lists the
+// layers, and sourceLabel, only set with --label-source, names the OCI image
+// directory the image was loaded from.
+const (
+	loadedByLabel = "oci_layers"
+	sourceLabel   = "loader.source"
+)
+
+var listOutput string
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list prints the images in the daemon that were loaded by this tool",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		loaderOpts, err := newDockerLoaderOpts(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		loader, err := NewDockerLoader(loaderOpts)
+		if err != nil {
+			return err
+		}
+
+		images, err := loader.LoadedImages(context.Background())
+		if err != nil {
+			return err
+		}
+		return writeLoadedImages(cmd.OutOrStdout(), images, listOutput)
+	},
+}
+
+// LoadedImage is an image in the daemon that was loaded by this tool. Loaded
+// is when the daemon last tagged it, which every load does, and Source is
+// empty for the images loaded without --label-source.
+type LoadedImage struct {
+	ID       string   `json:"id"`
+	RepoTags []string `json:"repoTags"`
+	Loaded   string   `json:"loaded"`
+	Source   string   `json:"source"`
+	Layers   int      `json:"layers"`
+}
+
+// imageLister is the part of the Docker client used to list images.
+type imageLister interface {
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]image.Summary, error)
+	ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error)
+}
+
+// listLoadedImages returns the images carrying the label Prepare adds, sorted
+// by load time, newest first. The load time is not in the summaries, so every
+// image is inspected.
+func listLoadedImages(ctx context.Context, cli imageLister) ([]LoadedImage, error) {
+	summaries, err := cli.ImageList(ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("label", loadedByLabel))})
+	if err != nil {
+		return nil, fmt.Errorf("error listing Docker images: %w", err)
+	}
+
+	images := []LoadedImage{}
+	loaded := map[string]time.Time{}
+	for _, summary := range summaries {
+		layers := summary.Labels[loadedByLabel]
+		if layers == "" {
+			continue
+		}
+		inspect, _, err := cli.ImageInspectWithRaw(ctx, summary.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting Docker image %s: %w", summary.ID, err)
+		}
+		tags := append([]string{}, summary.RepoTags...)
+		sort.Strings(tags)
+		img := LoadedImage{
+			ID:       summary.ID,
+			RepoTags: tags,
+			Source:   summary.Labels[sourceLabel],
+			Layers:   len(strings.Split(layers, ",")),
+		}
+		if lastTagTime := inspect.Metadata.LastTagTime; !lastTagTime.IsZero() {
+			img.Loaded = lastTagTime.UTC().Format(time.RFC3339)
+		}
+		loaded[img.ID] = inspect.Metadata.LastTagTime
+		images = append(images, img)
+	}
+	sort.SliceStable(images, func(a, b int) bool { return loaded[images[a].ID].After(loaded[images[b].ID]) })
+	return images, nil
+}
+
+// LoadedImages returns the images in the daemon loaded by this tool.
+func (d *DockerLoader) LoadedImages(ctx context.Context) ([]LoadedImage, error) {
+	return listLoadedImages(ctx, d.cli)
+}
+
+// writeLoadedImages writes the images as JSON or as a table.
+func writeLoadedImages(w io.Writer, images []LoadedImage, output string) error {
+	if output == "json" {
+		_, err := fmt.Fprintln(w, json.MustToJSON(images))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tLOADED\tLAYERS\tSOURCE\tTAGS")
+	for _, img := range images {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", img.ID, img.Loaded, img.Layers, img.Source, strings.Join(img.RepoTags, ","))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/stretchr/testify/suite"
+)
+
+type ListTestSuite struct {
+	suite.Suite
+}
+
+func testImage(id, loaded string, labels map[string]string, tags ...string) types.ImageInspect {
+	lastTagTime, _ := time.Parse(time.RFC3339, loaded)
+	return types.ImageInspect{ID: id, RepoTags: tags, Config: &container.Config{Labels: labels}, Metadata: image.Metadata{LastTagTime: lastTagTime}}
+}
+
+func (suite *ListTestSuite) TestOnlyLabeledImagesAreListed() {
+	cli := newFakeDockerAPI(
+		testImage("sha256:old", "2026-01-01T00:00:00Z", map[string]string{loadedByLabel: "a,b"}, "app:v1"),
+		testImage("sha256:new", "2026-02-01T00:00:00Z", map[string]string{loadedByLabel: "a,b,c", sourceLabel: "app/image"}, "app:v2", "app:latest"),
+		testImage("sha256:pulled", "2026-03-01T00:00:00Z", map[string]string{"team": "infra"}, "postgres:16"),
+		testImage("sha256:bare", "2026-03-01T00:00:00Z", nil, "busybox:latest"),
+	)
+
+	images, err := listLoadedImages(context.Background(), cli)
+	suite.Require().NoError(err)
+	suite.Equal([]LoadedImage{
+		{ID: "sha256:new", RepoTags: []string{"app:latest", "app:v2"}, Loaded: "2026-02-01T00:00:00Z", Source: "app/image", Layers: 3},
+		{ID: "sha256:old", RepoTags: []string{"app:v1"}, Loaded: "2026-01-01T00:00:00Z", Layers: 2},
+	}, images)
+}
+
+func (suite *ListTestSuite) TestLoadedImageRecordsSource() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	path := filepath.Join(suite.T().TempDir(), "bazel-out", "k8-fastbuild", "bin", "app", "image")
+	suite.Require().NoError(os.MkdirAll(path, 0755))
+	_, err := loadImage(context.Background(), loader, writeTestImage(suite.T(), path, nil, testLayer{"app": "binary"}), []string{"app"}, Options{LabelSource: true})
+	suite.Require().NoError(err)
+
+	images, err := listLoadedImages(context.Background(), cli)
+	suite.Require().NoError(err)
+	suite.Require().Len(images, 1)
+	suite.Equal("app/image", images[0].Source)
+}
+
+func (suite *ListTestSuite) TestSourceIsNotRecordedByDefault() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	load := func(target string) DockerLoadAction {
+		path := filepath.Join(suite.T().TempDir(), "bazel-out", "k8-fastbuild", "bin", target)
+		suite.Require().NoError(os.MkdirAll(path, 0755))
+		action, err := loadImage(context.Background(), loader, writeTestImage(suite.T(), path, nil, testLayer{"app": "binary"}), []string{"app"}, Options{})
+		suite.Require().NoError(err)
+		return action
+	}
+
+	first := load("app/image")
+	second := load("other/image")
+	suite.True(second.AlreadyLoaded)
+	suite.Equal(first.DaemonDigest(), second.DaemonDigest())
+	suite.Len(cli.loadedTars, 1)
+
+	images, err := listLoadedImages(context.Background(), cli)
+	suite.Require().NoError(err)
+	suite.Require().Len(images, 1)
+	suite.Empty(images[0].Source)
+}
+
+func (suite *ListTestSuite) TestImageSource() {
+	suite.Equal("app/image", imageSource("/home/me/.cache/bazel/execroot/_main/bazel-out/k8-fastbuild/bin/app/image"))
+	suite.Equal("app/image", imageSource("/tmp/loader.runfiles/_main/app/image"))
+	suite.Equal("images/app", imageSource("./images/app/"))
+}
+
+func (suite *ListTestSuite) TestTableOutput() {
+	out := bytes.Buffer{}
+	suite.Require().NoError(writeLoadedImages(&out, []LoadedImage{
+		{ID: "sha256:new", RepoTags: []string{"app:latest", "app:v2"}, Loaded: "2026-02-01T00:00:00Z", Source: "app/image", Layers: 3},
+	}, ""))
+	suite.Equal("ID          LOADED                LAYERS  SOURCE     TAGS\n"+
+		"sha256:new  2026-02-01T00:00:00Z  3       app/image  app:latest,app:v2\n", out.String())
+}
+
+func TestListTestSuite(t *testing.T) {
+	suite.Run(t, new(ListTestSuite))
+}
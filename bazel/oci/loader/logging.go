@@ -0,0 +1,23 @@
+// Loggers of the loads, so concurrent loads can each capture their own logs.
+package main
+
+import (
+	"context"
+	"log"
+)
+
+type loggerKey struct{}
+
+// withLogger returns a context whose loads log to logger.
+func withLogger(ctx context.Context, logger *log.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// logger returns the logger of the load, the standard logger unless another
+// one was set with withLogger.
+func logger(ctx context.Context) *log.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*log.Logger); ok {
+		return l
+	}
+	return log.Default()
+}
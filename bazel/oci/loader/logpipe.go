@@ -0,0 +1,98 @@
+// Logging to a named pipe for Bazel persistent workers.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// logPipeBuffer is how many log writes are held while the reader of the
+	// pipe is behind. Further writes are dropped.
+	logPipeBuffer = 1024
+	// logPipeDrainTimeout bounds how long Close waits for the held writes.
+	logPipeDrainTimeout = time.Second
+)
+
+// pipeLogWriter writes the logs to a named pipe, or any file, without ever
+// blocking the caller: writes are queued and written in the background, and
+// dropped if the queue is full because nobody is reading.
+type pipeLogWriter struct {
+	file    *os.File
+	queue   chan []byte
+	done    chan struct{}
+	mu      sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// openLogPipe opens the pipe or file at path, e.g. a FIFO or /dev/fd/3.
+func openLogPipe(path string) (*pipeLogWriter, error) {
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		// Opening a FIFO write only blocks until there is a reader, opening
+		// it read-write does not.
+		flags = os.O_RDWR
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log pipe: %w", err)
+	}
+
+	w := &pipeLogWriter{
+		file:  file,
+		queue: make(chan []byte, logPipeBuffer),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *pipeLogWriter) run() {
+	defer close(w.done)
+	for p := range w.queue {
+		w.file.Write(p)
+	}
+}
+
+// Write queues p, dropping it if the queue is full.
+func (w *pipeLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	select {
+	case w.queue <- append([]byte(nil), p...):
+	default:
+		w.dropped++
+	}
+	return len(p), nil
+}
+
+// Close writes the queued logs, waiting for a reader at most
+// logPipeDrainTimeout, and closes the pipe.
+func (w *pipeLogWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	if w.dropped > 0 {
+		select {
+		case w.queue <- []byte(fmt.Sprintf("Dropped %d log messages while the log pipe was full\n", w.dropped)):
+		default:
+		}
+	}
+	close(w.queue)
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(logPipeDrainTimeout):
+	}
+	return w.file.Close()
+}
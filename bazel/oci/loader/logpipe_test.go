@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LogPipeTestSuite struct {
+	suite.Suite
+	fifo string
+}
+
+func (suite *LogPipeTestSuite) SetupTest() {
+	suite.fifo = filepath.Join(suite.T().TempDir(), "logs")
+	suite.Require().NoError(syscall.Mkfifo(suite.fifo, 0o600))
+}
+
+// captureStdout returns what f writes to stdout.
+func (suite *LogPipeTestSuite) captureStdout(f func()) string {
+	r, w, err := os.Pipe()
+	suite.Require().NoError(err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	f()
+	suite.Require().NoError(w.Close())
+	out, err := io.ReadAll(r)
+	suite.Require().NoError(err)
+	return string(out)
+}
+
+func (suite *LogPipeTestSuite) TestLogsLandInPipe() {
+	w, err := openLogPipe(suite.fifo)
+	suite.Require().NoError(err)
+
+	// Opened before the writer closes the pipe, or it would wait for
+	// another writer forever.
+	reader, err := os.Open(suite.fifo)
+	suite.Require().NoError(err)
+	defer reader.Close()
+	received := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		received <- string(data)
+	}()
+
+	stdout := suite.captureStdout(func() {
+		log.SetOutput(w)
+		defer log.SetOutput(os.Stderr)
+		log.Println("Loading image")
+		suite.Require().NoError(w.Close())
+	})
+
+	suite.Contains(<-received, "Loading image")
+	suite.Empty(stdout)
+}
+
+func (suite *LogPipeTestSuite) TestWritesDoNotBlockWithoutReader() {
+	w, err := openLogPipe(suite.fifo)
+	suite.Require().NoError(err)
+
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	start := time.Now()
+	for k := 0; k < 4*logPipeBuffer; k++ {
+		_, err := w.Write(line)
+		suite.Require().NoError(err)
+	}
+	suite.Less(time.Since(start), logPipeDrainTimeout)
+
+	suite.Require().NoError(w.Close())
+	suite.Less(time.Since(start), 3*logPipeDrainTimeout)
+	suite.Positive(w.dropped)
+}
+
+func TestLogPipeTestSuite(t *testing.T) {
+	suite.Run(t, new(LogPipeTestSuite))
+}
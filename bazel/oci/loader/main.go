@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"time"
@@ -10,91 +11,566 @@ import (
 	"github.com/juanique/monorepo/salsa/go/json"
 	"github.com/juanique/monorepo/salsa/go/must"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type Options struct {
 	Output                string
 	OnlyGetImageID        bool
 	LogToFile             string
+	LogPipe               string
+	PersistentWorker      bool
+	OtelEndpoint          string
+	MaxLayerSize          int64
+	WarnLayerSize         int64
 	NoReuseExistingLayers bool
 	NoRun                 bool // backwards compatibilty with rules_dockerk
+	CompareFields         []string
+	IgnoreFields          []string
+	SkipIfRunning         bool
+	Compat                string
+	DockerHost            string
+	DockerConnFD          int
+	DockerContext         string
+	DockerConfig          string
+	KindCluster           string
+	VerifyLayers          bool
+	VerifyCacheDir        string
+	FailOnEmptyLayers     bool
+	StripEnv              []string
+	StripLabels           []string
+	DropHistory           bool
+	DockerCompatConfig    bool
+	DigestFile            string
+	TagFromDigestFile     string
+	ComparisonReport      string
+	PreLoadHook           string
+	PostLoadHook          string
+	FailOnPostLoadHook    bool
+	SpeculativeBuild      bool
+	NoCache               bool
+	RequireDaemonVersion  string
+	CheckDiskSpace        bool
+	ConfigOverlay         string
+	OverlayArrayMerge     map[string]string
+	CheckOnly             bool
+	ConfigFile            string
+	NormalizeUser         bool
+	MatchLayers           bool
+	MatchByDiffIDs        bool
+	RetagOnConfigMatch    bool
+	RequireLabels         map[string]string
+	VerifyLoaded          bool
+	OnConflict            string
+	TagIfAbsent           bool
+	AssertTagsConsistent  bool
+	RegistryCache         string
+	ImportBase            string
+	TarFormat             string
+	ExcludePaths          []string
+	AppendLayers          []string
+	Squash                bool
+	LabelSource           bool
+	WrapArray             bool
+	Vars                  map[string]string
+	AllowUnsetVars        bool
+	StrictManifest        bool
+	ResolveSymlinks       bool
+	ShowProgress          bool
+	MaxRetries            int
+	RetryBudget           time.Duration
+	RetryableErrors       []string
+
+	// Progress receives the progress events of the load, if set.
+	Progress ProgressFunc `json:"-"`
 }
 
 var opts = Options{}
 
+// logPipe receives the logs if --log-pipe is set.
+var logPipe *pipeLogWriter
+
 var rootCmd = &cobra.Command{
-	Use:   "loader",
+	Use:   "loader <image> [repo tags...]",
 	Short: "loader is a tool that loads images into docker incrementally",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if opts.PersistentWorker {
+			// The arguments come in the work requests.
+			return nil
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := applyFlagDefaults(cmd.Flags(), opts.ConfigFile, os.Getenv); err != nil {
+			return err
+		}
+		if opts.LogPipe != "" {
+			w, err := openLogPipe(opts.LogPipe)
+			if err != nil {
+				return err
+			}
+			logPipe = w
+			log.SetOutput(w)
+		}
+		if opts.OtelEndpoint != "" {
+			return setupTracing(opts.OtelEndpoint)
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
+		if opts.PersistentWorker {
+			must.NoError(runPersistentWorker(os.Stdin, os.Stdout))
+			return
+		}
+
 		imagePath := args[0]
 		repoTags := args[1:]
 
-		image := must.Must(NewImage(imagePath))
+		if opts.Compat == compatRulesDocker {
+			// The legacy loader reported failures on stderr and exited with 1.
+			image, err := OpenImage(imagePath, opts.StrictManifest, opts.ResolveSymlinks)
+			if err == nil {
+				err = buildAndLoadImage(image, repoTags)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				exit(1)
+			}
+			return
+		}
+
+		if (opts.Output == "json" || opts.Output == outputJSONL) && !opts.CheckOnly {
+			// Failures are reported on stdout too, for the tools parsing it.
+			image, err := OpenImage(imagePath, opts.StrictManifest, opts.ResolveSymlinks)
+			if err != nil {
+				err = inPhase(PhasePrepare, err)
+			} else {
+				err = buildAndLoadImage(image, repoTags)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				if opts.Output == outputJSONL {
+					exit(writeJSONLError(os.Stdout, err))
+				}
+				exit(writeJSONError(os.Stdout, err))
+			}
+			return
+		}
+
+		image := must.Must(OpenImage(imagePath, opts.StrictManifest, opts.ResolveSymlinks))
+		if opts.CheckOnly {
+			// Fail when the image is missing, so CI can assert it was cached.
+			if exitCode := must.Must(checkOnly(image, repoTags)); exitCode != 0 {
+				exit(exitCode)
+			}
+			return
+		}
 		must.NoError(buildAndLoadImage(image, repoTags))
 	},
 }
 
 func buildAndLoadImage(i Image, repoTags []string) error {
-	ctx := context.Background()
+	var loader *DockerLoader
+	if !opts.OnlyGetImageID {
+		loaderOpts, err := newDockerLoaderOpts(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		loader, err = NewDockerLoader(loaderOpts)
+		if err != nil {
+			return err
+		}
+	}
+	return runLoad(context.Background(), os.Stdout, loader, i, repoTags, opts)
+}
+
+// runLoad loads the image as requested by o, writing the outcome to w. The
+// loader is not used with OnlyGetImageID.
+func runLoad(ctx context.Context, w io.Writer, loader *DockerLoader, i Image, repoTags []string, o Options) error {
+	if o.Compat != "" && o.Compat != compatRulesDocker {
+		return fmt.Errorf("unsupported compat mode %q", o.Compat)
+	}
+	repoTags, err := resolveRepoTags(ctx, repoTags, o)
+	if err != nil {
+		return inPhase(PhasePrepare, err)
+	}
+
+	if o.OnlyGetImageID {
+		edits, err := configEdits(o)
+		if err != nil {
+			return err
+		}
+		i, _, err = prepareImage(ctx, i, repoTags, edits)
+		if err != nil {
+			return err
+		}
+		if o.DigestFile != "" {
+			if err := writeDigestFile(o.DigestFile, i.Manifest.Config.Digest); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(w, i.Manifest.Config.Digest)
+		return nil
+	}
+
+	tagDigest := ""
+	if o.TagFromDigestFile != "" {
+		if tagDigest, err = readDigestFile(o.TagFromDigestFile); err != nil {
+			return inPhase(PhasePrepare, err)
+		}
+		if len(repoTags) == 0 {
+			return inPhase(PhasePrepare, fmt.Errorf("--tag-from-digest-file needs a repo tag to name the repository"))
+		}
+	}
+
+	if o.RequireDaemonVersion != "" {
+		if err := loader.RequireDaemonVersion(ctx, o.RequireDaemonVersion); err != nil {
+			return inPhase(PhaseCheck, err)
+		}
+	}
+
+	if o.ImportBase != "" {
+		// The base layers must be present before the derived image is
+		// checked, so that its layers are found already loaded.
+		if err := warmCache(ctx, loader, []string{o.ImportBase}, logger(ctx).Writer()); err != nil {
+			return err
+		}
+	}
+
+	if o.ShowProgress {
+		o.Progress = writeProgress(logger(ctx).Writer())
+	}
+	if o.Output == outputJSONL {
+		logProgress, stream := o.Progress, writeJSONLProgress(w)
+		o.Progress = func(event ProgressEvent) {
+			if logProgress != nil {
+				logProgress(event)
+			}
+			stream(event)
+		}
+	}
+	p, err := prepareImageForLoad(ctx, i, repoTags, o)
+	if err != nil {
+		return err
+	}
+	if tagDigest != "" {
+		// The tag names the digest, so it may only go to that image. The
+		// --digest-file of a load holds the ID the image is looked up by,
+		// or the one of the config with the layer labels it is loaded with.
+		if tagDigest != p.ID && tagDigest != p.Image.Manifest.Config.Digest {
+			return inPhase(PhasePrepare, fmt.Errorf("digest file %s holds %s, but the loaded image is %s", o.TagFromDigestFile, tagDigest, p.Image.Manifest.Config.Digest))
+		}
+		p.RepoTags = append(p.RepoTags, digestTags(p.RepoTags, tagDigest)...)
+	}
+	// The hooks only run around the loads of the command line.
+	if err := runPreLoadHook(ctx, o, p.Image.Manifest.Config.Digest, p.RepoTags); err != nil {
+		return inPhase(PhasePrepare, err)
+	}
+	action, err := loadPrepared(ctx, loader, p, o)
+	if err != nil {
+		return err
+	}
+
+	if o.DigestFile != "" {
+		if err := writeDigestFile(o.DigestFile, action.Digest); err != nil {
+			return err
+		}
+	}
+	if o.ComparisonReport != "" {
+		if err := recordOutcome(o.ComparisonReport, action, repoTags); err != nil {
+			return err
+		}
+	}
+	if err := runPostLoadHook(ctx, o, action); err != nil {
+		return err
+	}
+	if o.AssertTagsConsistent {
+		// Every requested tag, including the ones skipped on conflicts.
+		tags := append(append(append([]string(nil), action.TagsAdded...), action.TagsAlreadyPresent...), action.TagsSkipped...)
+		if err := loader.CheckTagsConsistent(ctx, action.DaemonDigest(), tags); err != nil {
+			return err
+		}
+	}
+
+	writeAction(ctx, w, action, o)
+	return nil
+}
+
+// checkOnly checks whether the image is already loaded without modifying the
+// daemon, returning the exit code of --check-only.
+func checkOnly(i Image, repoTags []string) (int, error) {
+	loaderOpts, err := newDockerLoaderOpts(context.Background(), opts)
+	if err != nil {
+		return 0, err
+	}
+	loader, err := NewDockerLoader(loaderOpts)
+	if err != nil {
+		return 0, err
+	}
+	return checkOnlyExitCode(context.Background(), loader, i, repoTags, opts, os.Stdout)
+}
+
+// newDockerLoaderOpts derives the DockerLoader settings from the command line options.
+func newDockerLoaderOpts(ctx context.Context, o Options) (DockerLoaderOpts, error) {
+	compareFields, err := NewConfigFieldSet(o.CompareFields, o.IgnoreFields)
+	if err != nil {
+		return DockerLoaderOpts{}, err
+	}
+	switch o.OnConflict {
+	case "", conflictRepoint, conflictSkip, conflictFail:
+	default:
+		return DockerLoaderOpts{}, fmt.Errorf("invalid --on-conflict %q, must be %q, %q or %q", o.OnConflict, conflictRepoint, conflictSkip, conflictFail)
+	}
+	var cache *RegistryCache
+	if o.RegistryCache != "" {
+		if cache, err = NewRegistryCache(o.RegistryCache); err != nil {
+			return DockerLoaderOpts{}, fmt.Errorf("invalid --registry-cache: %w", err)
+		}
+		if cache.auth, err = loadRegistryAuth(ctx, dockerConfigDir(o.DockerConfig, os.Getenv), cache.host); err != nil {
+			return DockerLoaderOpts{}, err
+		}
+	}
+	maxRetries := o.MaxRetries
+	if o.DockerConnFD != 0 && maxRetries > 0 {
+		// A failed request may have closed the inherited connection, which
+		// cannot be dialed again.
+		logger(ctx).Println("Not retrying Docker failures with --docker-conn-fd")
+		maxRetries = 0
+	}
+	retry := NewRetryBudget(maxRetries, o.RetryBudget)
+	if err := retry.RetryOn(o.RetryableErrors); err != nil {
+		return DockerLoaderOpts{}, err
+	}
+	return DockerLoaderOpts{
+		DockerHost:         o.DockerHost,
+		ConnFD:             o.DockerConnFD,
+		DockerContext:      o.DockerContext,
+		DockerConfig:       o.DockerConfig,
+		CompareFields:      compareFields,
+		NormalizeUser:      o.NormalizeUser,
+		MatchLayers:        o.MatchLayers,
+		MatchByDiffIDs:     o.MatchByDiffIDs,
+		RetagOnConfigMatch: o.RetagOnConfigMatch,
+		RequireLabels:      o.RequireLabels,
+		VerifyLoaded:       o.VerifyLoaded,
+		NoCache:            o.NoCache,
+		OnConflict:         o.OnConflict,
+		TagIfAbsent:        o.TagIfAbsent,
+		RegistryCache:      cache,
+		Retry:              retry,
+	}, nil
+}
+
+// buildIntoKind imports an image that is already in the daemon into the kind
+// cluster, if any. The kind nodes do not share the Docker image store, so
+// they still need the tar.
+func buildIntoKind(ctx context.Context, loader *DockerLoader, build func() (string, error), o Options, action DockerLoadAction) (DockerLoadAction, error) {
+	if o.KindCluster == "" {
+		return action, nil
+	}
+	tarPath, err := build()
+	if err != nil {
+		return action, inPhase(PhaseBuild, err)
+	}
+	action, err = loadIntoKind(ctx, loader, o.KindCluster, tarPath, action)
+	return action, inPhase(PhaseLoad, err)
+}
+
+// prepareImage applies the image modifications done before loading. If they
+// fail, the unmodified image is returned so it can still be loaded as is,
+// unless config edits were requested.
+func prepareImage(ctx context.Context, i Image, repoTags []string, edits ConfigEdits) (Image, ImageBuilder, error) {
 	originalImage := i
 
-	dockerImageId := i.Manifest.Config.Digest
-	log.Println("Computed Image ID:", dockerImageId)
-	builder := NewImageBuilder(dockerImageId, repoTags)
-	if err := builder.Prepare(&i); err != nil {
-		log.Println("Could not prepare image:", err)
+	logger(ctx).Println("Computed Image ID:", i.Manifest.Config.Digest)
+	builder := NewImageBuilder(i.Manifest.Config.Digest, repoTags)
+	logger(ctx).Println("Staging dir is ", builder.stagingDir)
+	builder.Edits = edits
+	if err := builder.Prepare(ctx, &i); err != nil {
+		if !edits.Empty() {
+			return i, builder, fmt.Errorf("could not edit image config: %w", err)
+		}
+		logger(ctx).Println("Could not prepare image:", err)
 
 		// Undo any attempts to modify the image
 		i = originalImage
 	}
+	return i, builder, nil
+}
 
-	if opts.OnlyGetImageID {
-		fmt.Println(i.Manifest.Config.Digest)
-		return nil
+// configEdits returns the config changes requested by the options.
+func configEdits(o Options) (ConfigEdits, error) {
+	edits := ConfigEdits{
+		Strip:        StripOpts{Env: o.StripEnv, Labels: o.StripLabels},
+		DropHistory:  o.DropHistory,
+		DockerCompat: o.DockerCompatConfig,
+		ExcludePaths: o.ExcludePaths,
+		AppendLayers: o.AppendLayers,
+		Squash:       o.Squash,
+		LabelSource:  o.LabelSource,
 	}
+	if o.ConfigOverlay != "" {
+		overlay, err := LoadConfigOverlay(o.ConfigOverlay, o.OverlayArrayMerge)
+		if err != nil {
+			return ConfigEdits{}, err
+		}
+		edits.Overlay = overlay
+	}
+	return edits, nil
+}
+
+// preparedImage is an image ready to be checked against the daemon and built.
+type preparedImage struct {
+	Image    Image
+	Builder  ImageBuilder
+	RepoTags []string
+
+	// ID is the image ID looked up in the daemon.
+	ID         string
+	ConfigData map[string]interface{}
 
-	loader, err := NewDockerLoader()
+	// ManifestDigest is the digest of the manifest of the image as found in
+	// the OCI image directory, empty if the image is edited before loading.
+	// The registry cache is only looked up by it, as the cache cannot have
+	// the edited image. An image pulled from the cache has the original
+	// config, so the next run finds it in the daemon by ID.
+	ManifestDigest string
+}
+
+// prepareForLoad normalizes the tags and prepares the image the way it will
+// be loaded, without touching the daemon.
+func prepareForLoad(ctx context.Context, i Image, repoTags []string, o Options) (preparedImage, error) {
+	p := preparedImage{ID: i.Manifest.Config.Digest, RepoTags: normalizeRepoTags(ctx, repoTags)}
+	edits, err := configEdits(o)
 	if err != nil {
-		return err
+		return p, err
+	}
+	p.Image, p.Builder, err = prepareImage(ctx, i, p.RepoTags, edits)
+	if err != nil {
+		return p, err
+	}
+	if !edits.Empty() {
+		// An image loaded under the original ID does not have the edits.
+		p.ID = p.Image.Manifest.Config.Digest
+	} else if len(i.Index.Manifests) > 0 {
+		p.ManifestDigest = i.Index.Manifests[0].Digest
 	}
 
-	if len(repoTags) == 0 {
-		return fmt.Errorf("No repo tags specified")
+	if len(p.RepoTags) == 0 {
+		return p, fmt.Errorf("No repo tags specified")
 	}
 
-	// 1. Check if Image is already loaded (Strict ID or Loose Config match)
-	var configData map[string]interface{}
-	if err := json.FromFile(builder.ConfigPath, &configData); err != nil {
-		return fmt.Errorf("failed to read config: %w", err)
+	if err := json.FromFile(p.Builder.ConfigPath, &p.ConfigData); err != nil {
+		return p, fmt.Errorf("failed to read config: %w", err)
+	}
+	return p, nil
+}
+
+// imageFinder looks up whether an image is already in the daemon.
+type imageFinder interface {
+	FindExistingImage(ctx context.Context, imageID string, ociConfig map[string]interface{}, repoTags []string) (string, string, error)
+}
+
+// checkImagePresent reports whether the image is already loaded, writing which
+// check found it to w. Nothing is built, loaded or tagged.
+func checkImagePresent(ctx context.Context, finder imageFinder, i Image, repoTags []string, o Options, w io.Writer) (bool, error) {
+	repoTags, err := resolveRepoTags(ctx, repoTags, o)
+	if err != nil {
+		return false, err
+	}
+	p, err := prepareForLoad(ctx, i, repoTags, o)
+	if err != nil {
+		return false, err
+	}
+
+	existingID, matchedBy, err := finder.FindExistingImage(ctx, p.ID, p.ConfigData, p.RepoTags)
+	if err != nil {
+		return false, err
+	}
+	if existingID == "" {
+		fmt.Fprintln(w, "Image ID", p.ID, "is not loaded")
+		return false, nil
+	}
+	fmt.Fprintln(w, "Image ID", p.ID, "is loaded as", existingID, "(matched by "+matchedBy+")")
+	return true, nil
+}
+
+// checkOnlyExitCode returns the exit code of --check-only: 0 if the image is
+// already loaded, 1 if it is not.
+func checkOnlyExitCode(ctx context.Context, finder imageFinder, i Image, repoTags []string, o Options, w io.Writer) (int, error) {
+	present, err := checkImagePresent(ctx, finder, i, repoTags, o, w)
+	if err != nil || present {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// loadImage makes sure the image is loaded into the daemon and tagged with the
+// given repo tags, returning what had to be done.
+func loadImage(ctx context.Context, loader *DockerLoader, i Image, repoTags []string, o Options) (DockerLoadAction, error) {
+	p, err := prepareImageForLoad(ctx, i, repoTags, o)
+	if err != nil {
+		return DockerLoadAction{}, err
+	}
+	return loadPrepared(ctx, loader, p, o)
+}
+
+// prepareImageForLoad runs prepareForLoad as the prepare phase of the load.
+func prepareImageForLoad(ctx context.Context, i Image, repoTags []string, o Options) (preparedImage, error) {
+	endPrepare := o.emitPhase(PhasePrepare)
+	p, err := prepareForLoad(ctx, i, repoTags, o)
+	if err != nil {
+		return p, inPhase(PhasePrepare, err)
+	}
+	endPrepare()
+	return p, nil
+}
+
+// loadPrepared makes sure the prepared image is loaded into the daemon and
+// tagged, returning what had to be done.
+func loadPrepared(ctx context.Context, loader *DockerLoader, p preparedImage, o Options) (DockerLoadAction, error) {
+	i, builder, repoTags, dockerImageId, configData := p.Image, p.Builder, p.RepoTags, p.ID, p.ConfigData
+
+	var spec *speculativeBuild
+	if o.SpeculativeBuild {
+		spec = startSpeculativeBuild(ctx, i, builder, o)
+	}
+	// A speculative tar that ends up unused is removed.
+	defer spec.discard()
+	build := func() (string, error) {
+		if tarPath, ok := spec.take(builder.repoTags); ok {
+			o.emitPhase(PhaseBuild)()
+			return tarPath, nil
+		}
+		return buildTar(ctx, i, &builder, o)
 	}
 
+	// 1. Check if Image is already loaded (Strict ID or Loose Config match)
+	endCheck := o.emitPhase(PhaseCheck)
 	found, action, err := loader.CheckImageExists(ctx, dockerImageId, configData, repoTags)
-	log.Println("Checking for ID:", dockerImageId)
+	logger(ctx).Println("Checking for ID:", dockerImageId)
 	if err != nil {
-		return err
+		return action, inPhase(PhaseCheck, err)
 	}
+	endCheck()
 
+	diffIDs := configDiffIDs(configData)
 	if found {
-		log.Println("Image already loaded.")
-		// We still print the action JSON for bazel consumption if needed?
-		// Existing code prints action JSON if opts.Output == "json"
-		if opts.Output == "json" {
-			fmt.Println(action.JSON())
-		}
-		// Print legacy logs
-		if action.AlreadyLoaded {
-			log.Println("Image ID", dockerImageId, "was already loaded.")
-			fmt.Println("Image ID", dockerImageId, "was already loaded.")
-		}
-		for _, tag := range action.TagsAlreadyPresent {
-			log.Println("Image was already tagged with", tag)
-			fmt.Println("Image was already tagged with", tag)
+		logger(ctx).Println("Image already loaded.")
+		o.emitTags(action)
+		action.LayerStats = computeLayerStats(i.Manifest.Layers, diffIDs, [][]string{diffIDs})
+		return buildIntoKind(ctx, loader, build, o, action)
+	}
+
+	if o.SkipIfRunning {
+		containers, err := loader.RunningContainers(ctx, repoTags)
+		if err != nil {
+			return action, inPhase(PhaseCheck, err)
 		}
-		for _, tag := range action.TagsAdded {
-			log.Println("Tagged image with", tag)
-			fmt.Println("Tagged image with", tag)
+		if len(containers) > 0 {
+			logger(ctx).Println("Image is in use by running containers", containers)
+			return DockerLoadAction{Digest: dockerImageId, SkippedReason: "image in use by running container"}, nil
 		}
-		return nil
 	}
 
 	// 2. If not loaded, we must load.
@@ -105,49 +581,197 @@ func buildAndLoadImage(i Image, repoTags []string) error {
 	// If it returned false, it means content (config) is effectively different or strict check failed and loose check failed.
 	// So we are treating it as a new image -> Full Load.
 
-	tarPath, err := builder.Build(i, BuildOpts{SkipLayers: nil})
+	// The tar carries the tags, so the conflicts are resolved before building
+	// it.
+	loadTags, conflicts, err := loader.ResolveTagConflicts(ctx, dockerImageId, repoTags)
 	if err != nil {
-		return err
+		return action, inPhase(PhaseCheck, err)
+	}
+	builder.SetRepoTags(loadTags)
+
+	// Look at the layers of the currently tagged images before the load
+	// moves the tags.
+	existingLayers := loader.ExistingLayerChains(ctx, repoTags)
+
+	// The registry cache may save building the tar at all.
+	pulled, pullAction, err := loader.PullFromCache(ctx, p.ManifestDigest, dockerImageId, loadTags)
+	if err != nil {
+		return pullAction, inPhase(PhaseLoad, err)
+	}
+	if pulled {
+		conflicts.record(&pullAction)
+		o.emitTags(pullAction)
+		pullAction.LayerStats = computeLayerStats(i.Manifest.Layers, diffIDs, existingLayers)
+		return buildIntoKind(ctx, loader, build, o, pullAction)
+	}
+
+	if o.CheckDiskSpace {
+		if err := loader.CheckDiskSpace(ctx, unpackedImageSize(i)); err != nil {
+			return action, inPhase(PhaseCheck, err)
+		}
+	}
+
+	tarPath, err := build()
+	if err != nil {
+		return action, inPhase(PhaseBuild, err)
 	}
 
 	// LoadTarIntoDocker will check for existing image strictly by ID again,
 	// but we already know it's not there by ID (from CheckImageExists strict check).
 	// So it should proceed to load.
-	action = must.Must(loader.LoadTarIntoDocker(context.Background(), tarPath, i.Manifest.Config.Digest, repoTags))
-
-	if opts.Output == "json" {
-		fmt.Println(action.JSON())
-		log.Println(action.JSON())
+	endLoad := o.emitPhase(PhaseLoad)
+	action, err = loader.LoadTarIntoDocker(ctx, tarPath, i.Manifest.Config.Digest, loadTags)
+	if err != nil {
+		return action, inPhase(PhaseLoad, err)
 	}
+	conflicts.record(&action)
+	endLoad()
+	o.emitTags(action)
 
-	if action.AlreadyLoaded {
-		log.Println("Image ID", dockerImageId, "was already loaded.")
-		fmt.Println("Image ID", dockerImageId, "was already loaded.")
+	action.LayerStats = computeLayerStats(i.Manifest.Layers, diffIDs, existingLayers)
+	if o.KindCluster == "" {
+		return action, nil
 	}
+	action, err = loadIntoKind(ctx, loader, o.KindCluster, tarPath, action)
+	return action, inPhase(PhaseLoad, err)
+}
 
-	for _, tag := range action.TagsAlreadyPresent {
-		log.Println("Image was already tagged with", tag)
-		fmt.Println("Image was already tagged with", tag)
-	}
+// buildTar builds the full image tar, verifying the layers first if requested.
+func buildTar(ctx context.Context, i Image, builder *ImageBuilder, o Options) (tarPath string, err error) {
+	_, span := startSpan(ctx, "Build", attrDigest.String(i.Manifest.Config.Digest), attrImageSize.Int64(imageSize(i)))
+	defer func() { endSpan(span, "built", err) }()
 
-	for _, tag := range action.TagsAdded {
-		log.Println("Tagged image with", tag)
-		fmt.Println("Tagged image with", tag)
+	if o.VerifyLayers {
+		cacheDir := o.VerifyCacheDir
+		if o.NoCache {
+			cacheDir = ""
+		}
+		if err := NewLayerVerifier(cacheDir).Verify(ctx, i); err != nil {
+			return "", err
+		}
 	}
+	defer o.emitPhase(PhaseBuild)()
+	return builder.Build(ctx, i, BuildOpts{
+		SkipLayers:        nil,
+		NoCache:           o.NoCache,
+		FailOnEmptyLayers: o.FailOnEmptyLayers,
+		TarFormat:         o.TarFormat,
+		MaxLayerSize:      o.MaxLayerSize,
+		WarnLayerSize:     o.WarnLayerSize,
+		Progress:          o.emit,
+	})
+}
 
-	return nil
+// loadIntoKind imports the built tar into the nodes of the kind cluster,
+// recording the per-node results in the action.
+func loadIntoKind(ctx context.Context, loader *DockerLoader, cluster, tarPath string, action DockerLoadAction) (DockerLoadAction, error) {
+	nodes, err := loader.KindLoader(cluster).LoadTar(ctx, tarPath)
+	action.KindNodes = nodes
+	return action, err
+}
+
+// registerFlags binds the command line flags to the options.
+func registerFlags(flags *pflag.FlagSet, o *Options) {
+	flags.StringVar(&o.ConfigFile, "config", "", "YAML file with default values for the flags, keyed by flag name")
+	flags.StringVar(&o.Output, "output", "", "Format for the output, either \"json\", \"jsonl\" for a stream of progress events closed by the action, \"env\" for shell variable assignments or \"digest\" for only the image digest")
+	flags.BoolVar(&o.WrapArray, "wrap-array", false, "with --output=json, print the result as a one element JSON array")
+	flags.BoolVar(&o.ShowProgress, "progress", false, "print the progress of the load to the logs")
+	flags.BoolVar(&o.OnlyGetImageID, "only-get-image-id", false, "Only print the image ID, not build it")
+	flags.BoolVar(&o.NoRun, "norun", false, "unused - only here for backwards compatibility with rules_docker")
+	flags.BoolVar(&o.NoReuseExistingLayers, "noreusexistinglayers", false, "do not reuse existing layers")
+	flags.BoolVar(&o.PersistentWorker, "persistent_worker", false, "run as a Bazel persistent worker, reading work requests from stdin")
+	flags.StringVar(&o.LogPipe, "log-pipe", "", "write the logs to this named pipe or file, e.g. /dev/fd/3, keeping stdout and stderr free for a Bazel worker protocol")
+	flags.StringVar(&o.OtelEndpoint, "otel-endpoint", "", "export OpenTelemetry spans of the load over OTLP/HTTP to this collector, e.g. http://localhost:4318; TRACEPARENT is used as the parent span if set")
+	flags.StringVar(&o.LogToFile, "log-to-file", "", "whether to print logs to a file")
+	flags.StringSliceVar(&o.CompareFields, "compare-fields", nil, "config fields to compare when matching an existing image by config (default Env,Entrypoint,Cmd,WorkingDir,User,Labels)")
+	flags.StringSliceVar(&o.IgnoreFields, "ignore-fields", nil, "config fields to ignore when matching an existing image by config")
+	flags.StringToStringVar(&o.Vars, "var", nil, "values for ${VAR} references in the repo tags, taking precedence over the environment")
+	flags.BoolVar(&o.AllowUnsetVars, "allow-unset-vars", false, "expand unset variables in the repo tags to empty instead of failing")
+	flags.BoolVar(&o.NormalizeUser, "normalize-user", false, "treat a \"uid\" user as equal to \"uid:0\" and \"uid:uid\" when matching an existing image by config")
+	flags.BoolVar(&o.MatchLayers, "match-layers", false, "also look for an image with the same layers and config under any tag, not only the first repo tag; costs listing and inspecting the images loaded by this tool")
+	flags.BoolVar(&o.MatchByDiffIDs, "match-by-diffids", false, "also treat the image as loaded if the daemon has an image with exactly the same layers, whatever its config")
+	flags.BoolVar(&o.RetagOnConfigMatch, "retag-on-config-match", false, "still treat the image tagged with the first repo tag as loaded when its config matches but its layers differ, and only apply the tags; saves reloading non-reproducible rebuilds, but the tags may end up on an image with different files")
+	flags.StringToStringVar(&o.RequireLabels, "require-label", nil, "only treat an existing image as loaded by a config or layers match if it has this label, e.g. team=infra, can be repeated; matches by ID are not affected")
+	flags.StringVar(&o.OnConflict, "on-conflict", conflictRepoint, "what to do with a tag already pointing at another image: \"repoint\" it to this image, \"skip\" it or \"fail\"")
+	flags.BoolVar(&o.TagIfAbsent, "tag-if-absent", false, "only create the tags missing from the daemon, leaving any tag on another image untouched and reporting it as skipped, whatever --on-conflict says")
+	flags.BoolVar(&o.AssertTagsConsistent, "assert-tags-consistent", false, "once everything is done, fail unless every requested tag resolves to the loaded image, reporting the tags skipped on conflicts or moved by another process")
+	flags.StringVar(&o.RegistryCache, "registry-cache", "", "pull-through registry cache to pull the image from by manifest digest, e.g. cache.example.com:5000, building it locally only if the cache does not have it")
+	flags.StringVar(&o.ImportBase, "import-base", "", "OCI layout of the base image to load first, as warm-cache does, so the layers it shares with the image are already present; a no-op once the base is loaded")
+	flags.BoolVar(&o.SkipIfRunning, "skip-if-running", false, "do not load the image if a running container uses any of the repo tags")
+	flags.StringVar(&o.DockerHost, "docker-host", "", "address of the Docker daemon, takes precedence over DOCKER_HOST")
+	flags.StringVar(&o.DockerContext, "context", "", "name of the Docker context to connect to, as listed by `docker context ls`; defaults to DOCKER_CONTEXT, then the context selected with `docker context use`")
+	flags.StringVar(&o.DockerConfig, "docker-config", "", "config dir of the docker CLI to read the registry credentials and contexts from, takes precedence over DOCKER_CONFIG; defaults to ~/.docker")
+	flags.IntVar(&o.DockerConnFD, "docker-conn-fd", 0, "inherited fd already connected to the Docker daemon, for sandboxes that cannot open the socket; failures are not retried, since the connection cannot be re-established")
+	flags.IntVar(&o.MaxRetries, "max-retries", 0, "retries of transient Docker failures allowed across all the operations of the invocation")
+	flags.StringArrayVar(&o.RetryableErrors, "retryable-error-pattern", nil, "also retry the Docker errors whose message matches this regular expression, e.g. \"proxy: connection reset\"; errors reported by the daemon are never retried; can be repeated")
+	flags.DurationVar(&o.RetryBudget, "retry-budget", 30*time.Second, "total time the retries of all the Docker operations may take, 0 for no limit")
+	flags.StringVar(&o.KindCluster, "kind-cluster", "", "also import the image into the nodes of the named kind cluster")
+	flags.BoolVar(&o.VerifyLayers, "verify-layers", false, "check that every layer blob matches its digest before building the tar")
+	flags.StringVar(&o.VerifyCacheDir, "verify-cache-dir", "", "directory to remember verified layers in, so unchanged layers are not hashed again")
+	flags.BoolVar(&o.VerifyLoaded, "verify-loaded", false, "check that the daemon has the image after loading it")
+	flags.BoolVar(&o.StrictManifest, "strict-manifest", false, "validate the consistency of the manifest before doing anything else")
+	flags.BoolVar(&o.ResolveSymlinks, "resolve-symlinks", false, "resolve the symlinks of the OCI layout before doing anything else, failing with the missing blob when one dangles")
+	flags.StringVar(&o.TarFormat, "tar-format", TarFormatDocker, "layout of the loaded tar, \"docker\" for every Docker version or \"oci\" for Docker 25.0 and later")
+	flags.Var((*byteSize)(&o.MaxLayerSize), "max-layer-size", "fail before loading if any layer is larger than this, e.g. \"10GB\"")
+	flags.Var((*byteSize)(&o.WarnLayerSize), "warn-layer-size", "warn about layers larger than this, e.g. \"2GB\"")
+	flags.BoolVar(&o.NoCache, "no-cache", false, "build the full tar and load it as if for the first time, ignoring the images in the daemon, the registry cache and the --verify-cache-dir")
+	flags.BoolVar(&o.SpeculativeBuild, "speculative-build", false, "start building the tar while checking whether the image is already loaded, discarding it if it is")
+	flags.BoolVar(&o.FailOnEmptyLayers, "fail-on-empty-layers", false, "fail instead of loading an image without layers")
+	flags.StringArrayVar(&o.StripEnv, "strip-env", nil, "remove env vars matching this glob from the image config, can be repeated")
+	flags.StringArrayVar(&o.StripLabels, "strip-label", nil, "remove labels matching this glob from the image config, can be repeated")
+	flags.BoolVar(&o.DropHistory, "drop-history", false, "remove the build commands from the history of the image config, keeping one entry with the creation time per layer; the image gets a new ID")
+	flags.BoolVar(&o.DockerCompatConfig, "docker-compat-config", false, "convert the image config into a Docker schema2 config for daemons rejecting OCI configs: Docker media types, one history entry per layer and no fields unknown to Docker; the image gets a new ID")
+	flags.StringArrayVar(&o.ExcludePaths, "exclude-path", nil, "remove files matching this glob, and everything under matching directories, from the layers; globs without a slash match the base name at any depth, can be repeated; the changed layers get new digests, so the image ID changes too")
+	flags.StringArrayVar(&o.AppendLayers, "append-layer", nil, "add this layer tar, gzipped or not, on top of the image layers, can be repeated; the image gets a new ID")
+	flags.BoolVar(&o.Squash, "squash", false, "flatten the layers, including the appended ones, into a single layer before loading; the image gets a new ID and shares no layers with other images, so every change reloads the whole filesystem")
+	flags.BoolVar(&o.LabelSource, "label-source", false, "label the image with the image directory it was loaded from, shown by `list`; the image ID then depends on the directory, so the same image loaded from another target is loaded again and gets the tags moved to it")
+	flags.StringVar(&o.ConfigOverlay, "config-overlay", "", "JSON file with a partial image config to merge over the image config")
+	flags.StringToStringVar(&o.OverlayArrayMerge, "overlay-array-merge", nil, "how overlay arrays are merged, e.g. config.Cmd=append (default config.Env=append, others replace)")
+	flags.BoolVar(&o.CheckOnly, "check-only", false, "only check whether the image is already loaded, exiting with 1 if it is not")
+	flags.StringVar(&o.DigestFile, "digest-file", "", "write the image digest to this file, e.g. for Bazel stamping")
+	flags.StringVar(&o.TagFromDigestFile, "tag-from-digest-file", "", "also tag the image by the digest in this file, as written by --digest-file, as <repo>:sha256-<hex> in every repository of the repo tags; fails unless the digest is the one of the loaded image")
+	flags.StringVar(&o.ComparisonReport, "comparison-report", "", "add the outcome of the load to this report, counting the images loaded, already loaded, reloaded, loaded leaving conflicting tags, forced with --no-cache, pulled or skipped across invocations; written as CSV if it ends in .csv, JSON otherwise")
+	flags.StringVar(&o.PreLoadHook, "pre-load-hook", "", "shell command run before checking and loading the image, with LOADER_DIGEST and LOADER_TAGS set; the load is aborted if it fails")
+	flags.StringVar(&o.PostLoadHook, "post-load-hook", "", "shell command run after a successful load, with LOADER_DIGEST, LOADER_TAGS and LOADER_ACTION_JSON set")
+	flags.BoolVar(&o.FailOnPostLoadHook, "fail-on-post-load-hook", false, "fail the run if the --post-load-hook fails, instead of only logging it")
+	flags.BoolVar(&o.CheckDiskSpace, "check-disk-space", false, "abort before loading if the filesystem of the daemon data root has less space available than the image takes once unpacked")
+	flags.StringVar(&o.RequireDaemonVersion, "require-daemon-version", "", "abort unless the Docker daemon is at least this version, e.g. \">=24.0\"")
+	flags.StringVar(&o.Compat, "compat", "", "emulate the output and exit codes of another loader, only \"rules_docker\" is supported")
 }
 
 func main() {
 	startTime := time.Now()
-	rootCmd.Flags().StringVar(&opts.Output, "output", "", "Format for the output")
-	rootCmd.Flags().BoolVar(&opts.OnlyGetImageID, "only-get-image-id", false, "Only print the image ID, not build it")
-	rootCmd.Flags().BoolVar(&opts.NoRun, "norun", false, "unused - only here for backwards compatibility with rules_docker")
-	rootCmd.Flags().BoolVar(&opts.NoReuseExistingLayers, "noreusexistinglayers", false, "do not reuse existing layers")
-	rootCmd.Flags().StringVar(&opts.LogToFile, "log-to-file", "", "whether to print logs to a file")
+	// The subcommands connect to the daemon as set by the root flags.
+	registerFlags(rootCmd.PersistentFlags(), &opts)
 
-	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
-	}
+	serveCmd.Flags().StringVar(&serveAddr, "addr", defaultServeAddr, "address to listen on, keep it on localhost unless you know what you are doing")
+	rootCmd.AddCommand(serveCmd)
+	listCmd.Flags().StringVar(&listOutput, "output", "", "Format for the output, \"json\" or a table by default")
+	rootCmd.AddCommand(listCmd)
+	analyzeCmd.Flags().StringVar(&analyzeOutput, "output", "", "Format for the output, \"json\" or a table by default")
+	rootCmd.AddCommand(analyzeCmd)
+	warmCacheCmd.Flags().BoolVar(&warmDedupLayers, "dedup-layers", false, "load the missing base images from a single tar that packs the layers they share once")
+	rootCmd.AddCommand(warmCacheCmd)
+
+	// The spans are also flushed when a must panics.
+	defer flushTracing()
+	err := rootCmd.Execute()
 	log.Println("Total time:", time.Since(startTime))
+	if err != nil {
+		exit(1)
+	}
+	flushTracing()
+	if logPipe != nil {
+		logPipe.Close()
+	}
+}
+
+// exit leaves with the exit code once the pending spans are exported, which
+// os.Exit alone would drop.
+func exit(code int) {
+	flushTracing()
+	if logPipe != nil {
+		logPipe.Close()
+	}
+	os.Exit(code)
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	encodingjson "encoding/json"
+
+	"github.com/docker/docker/api/types"
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/stretchr/testify/suite"
+)
+
+type MainTestSuite struct {
+	suite.Suite
+	image Image
+}
+
+func (suite *MainTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+}
+
+// fakeImageFinder finds the image through the configured check, recording the
+// lookups.
+type fakeImageFinder struct {
+	matchedBy string
+	lookups   []string
+}
+
+func (f *fakeImageFinder) FindExistingImage(ctx context.Context, imageID string, ociConfig map[string]interface{}, repoTags []string) (string, string, error) {
+	f.lookups = append(f.lookups, imageID)
+	if f.matchedBy == "" {
+		return "", "", nil
+	}
+	return "sha256:existing", f.matchedBy, nil
+}
+
+func (suite *MainTestSuite) TestCheckOnlyPresentByID() {
+	finder := &fakeImageFinder{matchedBy: matchedByID}
+	out := bytes.Buffer{}
+
+	exitCode, err := checkOnlyExitCode(context.Background(), finder, suite.image, []string{"app"}, Options{}, &out)
+	suite.Require().NoError(err)
+	suite.Equal(0, exitCode)
+	suite.Contains(out.String(), "matched by id")
+	suite.Equal([]string{suite.image.Manifest.Config.Digest}, finder.lookups)
+}
+
+func (suite *MainTestSuite) TestCheckOnlyPresentByConfig() {
+	out := bytes.Buffer{}
+
+	exitCode, err := checkOnlyExitCode(context.Background(), &fakeImageFinder{matchedBy: matchedByConfig}, suite.image, []string{"app"}, Options{}, &out)
+	suite.Require().NoError(err)
+	suite.Equal(0, exitCode)
+	suite.Contains(out.String(), "matched by config")
+}
+
+func (suite *MainTestSuite) TestCheckOnlyAbsent() {
+	out := bytes.Buffer{}
+
+	exitCode, err := checkOnlyExitCode(context.Background(), &fakeImageFinder{}, suite.image, []string{"app"}, Options{}, &out)
+	suite.Require().NoError(err)
+	suite.Equal(1, exitCode)
+	suite.Contains(out.String(), "is not loaded")
+}
+
+func (suite *MainTestSuite) TestLoadImageProgress() {
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(), DockerLoaderOpts{})
+	events := []ProgressEvent{}
+	opts := Options{Progress: func(event ProgressEvent) { events = append(events, event) }}
+
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, opts)
+	suite.Require().NoError(err)
+	suite.Equal([]ProgressEvent{
+		{Type: ProgressPhaseStart, Phase: PhasePrepare},
+		{Type: ProgressPhaseEnd, Phase: PhasePrepare},
+		{Type: ProgressPhaseStart, Phase: PhaseCheck},
+		{Type: ProgressPhaseEnd, Phase: PhaseCheck},
+		{Type: ProgressPhaseStart, Phase: PhaseBuild},
+		{Type: ProgressLayer, Layer: filepath.Base(suite.image.GetLayerBlobPaths()[0]), Index: 1, Total: 1},
+		{Type: ProgressPhaseEnd, Phase: PhaseBuild},
+		{Type: ProgressPhaseStart, Phase: PhaseLoad},
+		{Type: ProgressPhaseEnd, Phase: PhaseLoad},
+		{Type: ProgressTag, Tag: "app:latest"},
+	}, events)
+}
+
+func (suite *MainTestSuite) TestJSONLStream() {
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(), DockerLoaderOpts{})
+	out := bytes.Buffer{}
+	suite.Require().NoError(runLoad(context.Background(), &out, loader, suite.image, []string{"app"}, Options{Output: outputJSONL}))
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	types := []string{}
+	for _, line := range lines {
+		event := map[string]interface{}{}
+		suite.Require().NoError(encodingjson.Unmarshal([]byte(line), &event), line)
+		types = append(types, event["type"].(string)+" "+fmt.Sprint(event["phase"]))
+	}
+	suite.Equal([]string{
+		"phaseStart prepare", "phaseEnd prepare",
+		"phaseStart check", "phaseEnd check",
+		"phaseStart build", "layer <nil>", "phaseEnd build",
+		"phaseStart load", "phaseEnd load",
+		"tag <nil>",
+		"action <nil>",
+	}, types)
+
+	last := jsonlActionLine{}
+	suite.Require().NoError(encodingjson.Unmarshal([]byte(lines[len(lines)-1]), &last))
+	suite.True(strings.HasPrefix(last.Action.Digest, "sha256:"))
+	suite.Equal([]string{"app:latest"}, last.Action.TagsAdded)
+}
+
+func (suite *MainTestSuite) TestJSONLErrorLine() {
+	out := bytes.Buffer{}
+	code := writeJSONLError(&out, inPhase(PhaseLoad, errors.New("daemon went away")))
+	suite.Equal(exitCodeLoad, code)
+	suite.Equal(`{"type":"error","error":"daemon went away","phase":"load","code":4}`+"\n", out.String())
+}
+
+func (suite *MainTestSuite) TestTagFromDigestFile() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	digestFile := filepath.Join(suite.T().TempDir(), "image.digest")
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, loader, suite.image, []string{"app"}, Options{DigestFile: digestFile}))
+	digest, err := readDigestFile(digestFile)
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, loader, suite.image, []string{"app"}, Options{TagFromDigestFile: digestFile}))
+	tagged := cli.find("app:" + strings.Replace(digest, ":", "-", 1))
+	suite.Require().NotNil(tagged)
+	suite.Equal(digest, tagged.ID)
+
+	err = runLoad(context.Background(), io.Discard, loader, suite.image, []string{"app"}, Options{TagFromDigestFile: digestFile + ".missing"})
+	suite.ErrorContains(err, "error reading digest file")
+}
+
+func (suite *MainTestSuite) TestTagFromDigestFileOfAnotherImage() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	digestFile := filepath.Join(suite.T().TempDir(), "image.digest")
+	suite.Require().NoError(writeDigestFile(digestFile, testDigest))
+
+	err := runLoad(context.Background(), io.Discard, loader, suite.image, []string{"app"}, Options{TagFromDigestFile: digestFile})
+	suite.ErrorContains(err, "holds "+testDigest+", but the loaded image is")
+	suite.Equal(exitCodePrepare, newErrorOutput(err).Code)
+	suite.Empty(cli.images)
+}
+
+func (suite *MainTestSuite) TestAssertTagsConsistentReportsSkippedTag() {
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:v1"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictSkip})
+
+	tags := []string{"app:latest", "app:v1"}
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, loader, suite.image, tags, Options{}))
+	err := runLoad(context.Background(), io.Discard, loader, suite.image, tags, Options{AssertTagsConsistent: true})
+	suite.ErrorContains(err, "app:v1 points at sha256:other")
+
+	loader = newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	suite.NoError(runLoad(context.Background(), io.Discard, loader, suite.image, tags, Options{AssertTagsConsistent: true}))
+}
+
+func (suite *MainTestSuite) TestImportBaseLoadsBaseFirst() {
+	base := testLayer{"etc/os-release": "debian"}
+	baseImage := writeTestImage(suite.T(), suite.T().TempDir(), nil, base)
+	derived := writeTestImage(suite.T(), suite.T().TempDir(), nil, base, testLayer{"app": "binary"})
+
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	o := Options{Output: "json", ImportBase: baseImage.Path}
+	out := bytes.Buffer{}
+	suite.Require().NoError(runLoad(context.Background(), &out, loader, derived, []string{"app"}, o))
+	suite.Require().Len(cli.loadedTars, 2)
+	suite.NotNil(cli.find(warmCacheTag(baseImage)))
+
+	// The JSON is followed by the human readable summary.
+	action := DockerLoadAction{}
+	suite.Require().NoError(encodingjson.NewDecoder(&out).Decode(&action))
+	suite.Equal(1, action.LayersReused)
+	suite.Equal(1, action.LayersLoaded)
+
+	// The base is only loaded once.
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, loader, derived, []string{"app:v2"}, o))
+	suite.Len(cli.loadedTars, 2)
+
+	o.ImportBase = filepath.Join(suite.T().TempDir(), "missing")
+	suite.Error(runLoad(context.Background(), io.Discard, loader, derived, []string{"app"}, o))
+}
+
+func (suite *MainTestSuite) TestSkipIfRunning() {
+	cli := newFakeDockerAPI()
+	cli.running = map[string][]types.Container{"app:latest": {{ID: "c1", Image: "app:latest"}}}
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	events := []ProgressEvent{}
+	opts := Options{SkipIfRunning: true, Progress: func(event ProgressEvent) { events = append(events, event) }}
+
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, opts)
+	suite.Require().NoError(err)
+	suite.Equal("image in use by running container", action.SkippedReason)
+	suite.Empty(action.TagsAdded)
+	suite.Empty(cli.loadedTars)
+	suite.Empty(cli.images)
+	suite.NotContains(events, ProgressEvent{Type: ProgressPhaseStart, Phase: PhaseBuild})
+}
+
+func (suite *MainTestSuite) TestSkipIfRunningLoadsWithoutContainers() {
+	cli := newFakeDockerAPI()
+	cli.running = map[string][]types.Container{"other:latest": {{ID: "c1", Image: "other:latest"}}}
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{SkipIfRunning: true})
+	suite.Require().NoError(err)
+	suite.Empty(action.SkippedReason)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.Len(cli.loadedTars, 1)
+}
+
+func (suite *MainTestSuite) TestSpeculativeBuildIsUsed() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	events := []ProgressEvent{}
+	opts := Options{SpeculativeBuild: true, Progress: func(event ProgressEvent) { events = append(events, event) }}
+
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, opts)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.Len(cli.loadedTars, 1)
+	// The tar was built along with the check, so the build reports no layers.
+	suite.Contains(events, ProgressEvent{Type: ProgressPhaseEnd, Phase: PhaseBuild})
+	suite.NotContains(events, ProgressEvent{Type: ProgressLayer, Layer: filepath.Base(suite.image.GetLayerBlobPaths()[0]), Index: 1, Total: 1})
+}
+
+func (suite *MainTestSuite) TestSpeculativeBuildIsDiscardedWhenLoaded() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{})
+	suite.Require().NoError(err)
+
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{SpeculativeBuild: true})
+	suite.Require().NoError(err)
+	suite.True(action.AlreadyLoaded)
+	suite.Len(cli.loadedTars, 1)
+}
+
+func (suite *MainTestSuite) TestSpeculativeBuildWithOtherTagsIsRebuilt() {
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:latest"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictSkip})
+
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app:latest", "app:v1"}, Options{SpeculativeBuild: true})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"app:v1"}, action.TagsAdded)
+	suite.Equal([]string{"app:latest"}, cli.images["sha256:other"].RepoTags)
+}
+
+func (suite *MainTestSuite) TestDiscardSpeculativeBuild() {
+	image := suite.image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+
+	// The build is cancelled, or its tar removed once it completes.
+	spec := startSpeculativeBuild(context.Background(), image, builder, Options{})
+	spec.discard()
+	suite.Eventually(func() bool {
+		_, err := os.Stat(builder.GetOutputPath("image.tar"))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+	<-spec.done
+
+	spec = startSpeculativeBuild(context.Background(), image, builder, Options{})
+	tarPath, ok := spec.take([]string{"app:latest"})
+	suite.Require().True(ok)
+	spec.discard()
+	suite.FileExists(tarPath)
+}
+
+func (suite *MainTestSuite) TestNoCacheLoadsFullImageAgain() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{})
+	suite.Require().NoError(err)
+
+	cacheDir := suite.T().TempDir()
+	o := Options{NoCache: true, VerifyLayers: true, VerifyCacheDir: cacheDir}
+	loaderOpts, err := newDockerLoaderOpts(context.Background(), o)
+	suite.Require().NoError(err)
+	action, err := loadImage(context.Background(), loader.WithOpts(loaderOpts), suite.image, []string{"app"}, o)
+	suite.Require().NoError(err)
+	suite.False(action.AlreadyLoaded)
+	suite.Equal([]string{"app:latest"}, action.TagsAdded)
+	suite.Len(cli.loadedTars, 2)
+
+	// The verification cache is neither read nor written.
+	entries, err := os.ReadDir(cacheDir)
+	suite.Require().NoError(err)
+	suite.Empty(entries)
+}
+
+func (suite *MainTestSuite) TestLoadImageErrorOutput() {
+	cli := newFakeDockerAPI(types.ImageInspect{ID: "sha256:other", RepoTags: []string{"app:latest"}})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{OnConflict: conflictFail})
+	out := bytes.Buffer{}
+
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app:latest"}, Options{})
+	suite.Require().Error(err)
+	suite.Equal(exitCodeCheck, writeJSONError(&out, err))
+
+	got := ErrorOutput{}
+	suite.Require().NoError(json.FromJSON(out.String(), &got))
+	suite.Equal(ErrorOutput{Error: err.Error(), Phase: PhaseCheck, Code: exitCodeCheck}, got)
+	suite.Len(cli.loadedTars, 0)
+}
+
+func (suite *MainTestSuite) TestErrorOutputWithoutPhase() {
+	suite.Equal(ErrorOutput{Error: "bad flag", Code: exitCodeError}, newErrorOutput(errors.New("bad flag")))
+}
+
+func TestMainTestSuite(t *testing.T) {
+	suite.Run(t, new(MainTestSuite))
+}
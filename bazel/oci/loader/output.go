@@ -0,0 +1,179 @@
+// Rendering of the load results for the different output modes.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// compatRulesDocker selects the output of the rules_docker incremental loader.
+const compatRulesDocker = "rules_docker"
+
+// reportAction prints the outcome of the load, both to the logs and to w.
+func reportAction(w io.Writer, action DockerLoadAction) {
+	writeAction(context.Background(), w, action, opts)
+}
+
+// writeAction prints the outcome of the load in the output mode selected by o.
+func writeAction(ctx context.Context, w io.Writer, action DockerLoadAction, o Options) {
+	if o.Compat == compatRulesDocker {
+		writeRulesDockerOutput(w, action)
+		return
+	}
+	if o.Output == "env" {
+		writeEnvOutput(w, action)
+		return
+	}
+	if o.Output == outputJSONL {
+		// The progress events were already streamed to w.
+		writeJSONLAction(w, action)
+		return
+	}
+	if o.Output == "digest" {
+		// Nothing but the digest, so scripts can capture it as is.
+		fmt.Fprintln(w, action.DaemonDigest())
+		return
+	}
+
+	dockerImageId := action.Digest
+	if o.Output == "json" {
+		out := action.JSON()
+		if o.WrapArray {
+			out = action.JSONArray()
+		}
+		fmt.Fprintln(w, out)
+		logger(ctx).Println(out)
+	}
+
+	if action.SkippedReason != "" {
+		logger(ctx).Println("Skipped loading image ID", dockerImageId+":", action.SkippedReason)
+		fmt.Fprintln(w, "Skipped loading image ID", dockerImageId+":", action.SkippedReason)
+	}
+
+	if action.PulledFrom != "" {
+		logger(ctx).Println("Pulled image ID", dockerImageId, "from", action.PulledFrom)
+		fmt.Fprintln(w, "Pulled image ID", dockerImageId, "from", action.PulledFrom)
+	}
+
+	if action.AlreadyLoaded {
+		logger(ctx).Println("Image ID", dockerImageId, "was already loaded.")
+		fmt.Fprintln(w, "Image ID", dockerImageId, "was already loaded.")
+	}
+
+	for _, tag := range action.TagsAlreadyPresent {
+		logger(ctx).Println("Image was already tagged with", tag)
+		fmt.Fprintln(w, "Image was already tagged with", tag)
+	}
+
+	for _, tag := range action.TagsAdded {
+		logger(ctx).Println("Tagged image with", tag)
+		fmt.Fprintln(w, "Tagged image with", tag)
+	}
+
+	for _, tag := range action.TagsRepointed {
+		fmt.Fprintln(w, "Moved tag", tag, "from another image")
+	}
+
+	for _, tag := range action.TagsSkipped {
+		fmt.Fprintln(w, "Left tag", tag, "on another image")
+	}
+
+	if action.LayersReused+action.LayersLoaded > 0 {
+		summary := fmt.Sprintf("Reused %d layers (%d bytes), loaded %d layers (%d bytes)",
+			action.LayersReused, action.BytesReused, action.LayersLoaded, action.BytesLoaded)
+		logger(ctx).Println(summary)
+		fmt.Fprintln(w, summary)
+	}
+
+	for _, node := range action.KindNodes {
+		if node.Error != "" {
+			fmt.Fprintln(w, "Could not load image into kind node", node.Node+":", node.Error)
+			continue
+		}
+		fmt.Fprintln(w, "Loaded image into kind node", node.Node)
+	}
+}
+
+// writeRulesDockerOutput writes the action the way the rules_docker
+// incremental_load.sh script reported it, so scripts parsing that output keep
+// working. The emulated behaviors are:
+//
+//   - The script always piped the image into `docker load`, so stdout always
+//     starts with docker's "Loaded image ID: <digest>" line, even when the image
+//     was already present.
+//   - It then ran `docker tag` for every requested tag, announcing each one
+//     with "Tagging <digest> as <tag>", whether the tag existed or not.
+//   - Nothing else is written to stdout: no JSON and no "already loaded"
+//     summaries, regardless of --output.
+//   - Failures are printed on stderr and exit with status 1.
+//
+// The digest is the ID the image has in the daemon, which is what docker
+// printed, rather than the config digest. Skipped loads have no legacy
+// equivalent and produce no output. The goldens in testdata/rules_docker
+// follow this description and are not captures of a rules_docker run.
+func writeRulesDockerOutput(w io.Writer, action DockerLoadAction) {
+	if action.SkippedReason != "" {
+		return
+	}
+
+	digest := action.DaemonDigest()
+	fmt.Fprintln(w, "Loaded image ID:", digest)
+
+	tags := append([]string{}, action.TagsAlreadyPresent...)
+	tags = append(tags, action.TagsAdded...)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		fmt.Fprintln(w, "Tagging", digest, "as", tag)
+	}
+}
+
+// writeEnvOutput writes the action as shell variable assignments, so scripts
+// can capture it with `eval "$(loader ... --output=env)"`. Lists are joined
+// with commas.
+func writeEnvOutput(w io.Writer, action DockerLoadAction) {
+	action.TagsAdded = append([]string(nil), action.TagsAdded...)
+	action.TagsAlreadyPresent = append([]string(nil), action.TagsAlreadyPresent...)
+	action.SortTags()
+
+	fmt.Fprintf(w, "LOADER_DIGEST=%s\n", shellQuote(action.Digest))
+	fmt.Fprintf(w, "LOADER_ALREADY_LOADED=%t\n", action.AlreadyLoaded)
+	fmt.Fprintf(w, "LOADER_TAGS_ADDED=%s\n", shellQuote(strings.Join(action.TagsAdded, ",")))
+	fmt.Fprintf(w, "LOADER_TAGS_ALREADY_PRESENT=%s\n", shellQuote(strings.Join(action.TagsAlreadyPresent, ",")))
+	fmt.Fprintf(w, "LOADER_LOAD_TIME=%s\n", shellQuote(action.LoadTime))
+	fmt.Fprintf(w, "LOADER_SKIPPED_REASON=%s\n", shellQuote(action.SkippedReason))
+}
+
+// shellQuote quotes s so the shell reads it back verbatim.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeDigestFile atomically writes the digest, newline terminated, to path.
+func writeDigestFile(path, digest string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing digest file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing digest file: %w", err)
+	}
+	if _, err := fmt.Fprintln(tmp, digest); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing digest file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing digest file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing digest file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const testDigest = "sha256:3c2f6b3c1a7c0c4e0d7d7f9f2a1b5e6d8c9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c"
+
+type OutputTestSuite struct {
+	suite.Suite
+}
+
+func (suite *OutputTestSuite) SetupTest() {
+	opts = Options{}
+}
+
+func (suite *OutputTestSuite) TearDownTest() {
+	opts = Options{}
+}
+
+func (suite *OutputTestSuite) assertGolden(name string, got string) {
+	want, err := os.ReadFile(filepath.Join("testdata", name))
+	suite.Require().NoError(err)
+	suite.Equal(string(want), got)
+}
+
+func (suite *OutputTestSuite) TestRulesDockerNewImage() {
+	opts.Compat = compatRulesDocker
+	opts.Output = "json"
+
+	out := bytes.Buffer{}
+	// The containerd image store reports the manifest digest as the ID.
+	reportAction(&out, DockerLoadAction{
+		Digest:    testDigest,
+		LoadedID:  "sha256:9f8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c5b4a39281706f5e4d3c2b1a0",
+		TagsAdded: []string{"app:v1", "app:latest"},
+	})
+	suite.assertGolden("rules_docker/new_image.golden", out.String())
+}
+
+func (suite *OutputTestSuite) TestRulesDockerAlreadyLoaded() {
+	opts.Compat = compatRulesDocker
+
+	out := bytes.Buffer{}
+	reportAction(&out, DockerLoadAction{
+		Digest:             testDigest,
+		ExistingID:         "sha256:0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9",
+		AlreadyLoaded:      true,
+		TagsAdded:          []string{"app:v1"},
+		TagsAlreadyPresent: []string{"app:latest"},
+	})
+	suite.assertGolden("rules_docker/already_loaded.golden", out.String())
+}
+
+func (suite *OutputTestSuite) TestRulesDockerSkipped() {
+	opts.Compat = compatRulesDocker
+
+	out := bytes.Buffer{}
+	reportAction(&out, DockerLoadAction{Digest: testDigest, SkippedReason: "image in use by running container"})
+	suite.Empty(out.String())
+}
+
+// evalEnv evaluates the env output in a shell and returns the resulting value
+// of each of the given variables.
+func (suite *OutputTestSuite) evalEnv(output string, names ...string) map[string]string {
+	script := output
+	for _, name := range names {
+		script += fmt.Sprintf("printf '%%s\\0' \"$%s\"\n", name)
+	}
+	out, err := exec.Command("sh", "-c", script).Output()
+	suite.Require().NoError(err)
+
+	values := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	suite.Require().Len(values, len(names))
+	vars := map[string]string{}
+	for i, name := range names {
+		vars[name] = values[i]
+	}
+	return vars
+}
+
+func (suite *OutputTestSuite) TestEnvOutput() {
+	opts.Output = "env"
+
+	out := bytes.Buffer{}
+	reportAction(&out, DockerLoadAction{
+		Digest:             testDigest,
+		AlreadyLoaded:      true,
+		TagsAdded:          []string{"app:v1", "app:latest"},
+		TagsAlreadyPresent: []string{"app:stable"},
+	})
+
+	vars := suite.evalEnv(out.String(), "LOADER_DIGEST", "LOADER_ALREADY_LOADED", "LOADER_TAGS_ADDED", "LOADER_TAGS_ALREADY_PRESENT", "LOADER_SKIPPED_REASON")
+	suite.Equal(map[string]string{
+		"LOADER_DIGEST":               testDigest,
+		"LOADER_ALREADY_LOADED":       "true",
+		"LOADER_TAGS_ADDED":           "app:latest,app:v1",
+		"LOADER_TAGS_ALREADY_PRESENT": "app:stable",
+		"LOADER_SKIPPED_REASON":       "",
+	}, vars)
+}
+
+func (suite *OutputTestSuite) TestEnvOutputQuotesSpecialCharacters() {
+	opts.Output = "env"
+	marker := filepath.Join(suite.T().TempDir(), "pwned")
+	tag := fmt.Sprintf("app:$(touch %s)`touch %s`'\"; touch %s", marker, marker, marker)
+
+	out := bytes.Buffer{}
+	reportAction(&out, DockerLoadAction{Digest: testDigest, TagsAdded: []string{tag}})
+
+	vars := suite.evalEnv(out.String(), "LOADER_TAGS_ADDED")
+	suite.Equal(tag, vars["LOADER_TAGS_ADDED"])
+	suite.NoFileExists(marker)
+}
+
+func (suite *OutputTestSuite) TestDigestFile() {
+	path := filepath.Join(suite.T().TempDir(), "image.digest")
+	suite.Require().NoError(os.WriteFile(path, []byte("stale contents\n"), 0o644))
+
+	suite.Require().NoError(writeDigestFile(path, testDigest))
+	data, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Equal(testDigest+"\n", string(data))
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	suite.Require().NoError(err)
+	suite.Len(entries, 1)
+}
+
+func (suite *OutputTestSuite) TestWrapArray() {
+	action := DockerLoadAction{Digest: testDigest, TagsAdded: []string{"app:v1", "app:latest"}}
+	opts.Output = "json"
+
+	plain := bytes.Buffer{}
+	reportAction(&plain, action)
+	unwrapped := DockerLoadAction{}
+	suite.Require().NoError(encodingjson.NewDecoder(&plain).Decode(&unwrapped))
+
+	opts.WrapArray = true
+	wrapped := bytes.Buffer{}
+	reportAction(&wrapped, action)
+	actions := []DockerLoadAction{}
+	suite.Require().NoError(encodingjson.NewDecoder(&wrapped).Decode(&actions))
+
+	suite.Equal([]DockerLoadAction{unwrapped}, actions)
+}
+
+func (suite *OutputTestSuite) TestDigestOutput() {
+	opts.Output = "digest"
+
+	out := bytes.Buffer{}
+	reportAction(&out, DockerLoadAction{
+		Digest:     testDigest,
+		TagsAdded:  []string{"app:latest"},
+		LayerStats: LayerStats{LayersLoaded: 1},
+	})
+	suite.Equal(testDigest+"\n", out.String())
+}
+
+func (suite *OutputTestSuite) TestDigestOutputPrefersDaemonID() {
+	opts.Output = "digest"
+
+	out := bytes.Buffer{}
+	reportAction(&out, DockerLoadAction{Digest: testDigest, ExistingID: "sha256:existing", AlreadyLoaded: true})
+	suite.Equal("sha256:existing\n", out.String())
+}
+
+func TestOutputTestSuite(t *testing.T) {
+	suite.Run(t, new(OutputTestSuite))
+}
@@ -0,0 +1,109 @@
+// Merging of a partial config file over the image config.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juanique/monorepo/salsa/go/json"
+)
+
+const (
+	// arrayMergeReplace makes an overlay array replace the image array.
+	arrayMergeReplace = "replace"
+	// arrayMergeAppend appends the overlay array to the image array. For Env,
+	// variables already in the image are overridden in place instead.
+	arrayMergeAppend = "append"
+)
+
+// defaultArrayMerge is how arrays are merged unless overridden. Every array
+// not listed here is replaced.
+var defaultArrayMerge = map[string]string{
+	"config.Env": arrayMergeAppend,
+}
+
+// ConfigOverlay is a partial OCI image config merged over the image config.
+// Objects are merged key by key, scalars are replaced and arrays are merged
+// according to ArrayMerge, keyed by the dotted path of the array such as
+// "config.Cmd".
+type ConfigOverlay struct {
+	Values     map[string]interface{}
+	ArrayMerge map[string]string
+}
+
+// LoadConfigOverlay reads the overlay from a JSON file. arrayMerge overrides
+// the default merge mode of individual arrays.
+func LoadConfigOverlay(path string, arrayMerge map[string]string) (*ConfigOverlay, error) {
+	overlay := &ConfigOverlay{ArrayMerge: map[string]string{}}
+	for key, mode := range defaultArrayMerge {
+		overlay.ArrayMerge[key] = mode
+	}
+	for key, mode := range arrayMerge {
+		if mode != arrayMergeReplace && mode != arrayMergeAppend {
+			return nil, fmt.Errorf("invalid merge mode %q for %s, must be %q or %q", mode, key, arrayMergeReplace, arrayMergeAppend)
+		}
+		overlay.ArrayMerge[key] = mode
+	}
+
+	if err := json.FromFile(path, &overlay.Values); err != nil {
+		return nil, fmt.Errorf("error reading config overlay: %w", err)
+	}
+	return overlay, nil
+}
+
+// apply merges the overlay into the config data.
+func (o *ConfigOverlay) apply(configData map[string]interface{}) error {
+	if o == nil {
+		return nil
+	}
+	o.mergeObject(configData, o.Values, "")
+	return nil
+}
+
+func (o *ConfigOverlay) mergeObject(dst, src map[string]interface{}, path string) {
+	for key, value := range src {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		switch overlayValue := value.(type) {
+		case map[string]interface{}:
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				o.mergeObject(existing, overlayValue, keyPath)
+				continue
+			}
+		case []interface{}:
+			if existing, ok := dst[key].([]interface{}); ok && o.ArrayMerge[keyPath] == arrayMergeAppend {
+				if keyPath == "config.Env" {
+					dst[key] = mergeEnv(existing, overlayValue)
+				} else {
+					dst[key] = append(existing, overlayValue...)
+				}
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// mergeEnv appends the overlay variables, overriding the ones already set.
+func mergeEnv(env, overlay []interface{}) []interface{} {
+	index := map[string]int{}
+	merged := []interface{}{}
+	for _, entry := range env {
+		name, _, _ := strings.Cut(fmt.Sprint(entry), "=")
+		index[name] = len(merged)
+		merged = append(merged, entry)
+	}
+	for _, entry := range overlay {
+		name, _, _ := strings.Cut(fmt.Sprint(entry), "=")
+		if k, ok := index[name]; ok {
+			merged[k] = entry
+			continue
+		}
+		index[name] = len(merged)
+		merged = append(merged, entry)
+	}
+	return merged
+}
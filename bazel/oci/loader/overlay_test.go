@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OverlayTestSuite struct {
+	suite.Suite
+	image Image
+}
+
+func (suite *OverlayTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), map[string]interface{}{
+		"Env":    []interface{}{"PATH=/bin", "MODE=prod"},
+		"Cmd":    []interface{}{"/app", "--port=80"},
+		"Labels": map[string]interface{}{"team": "infra"},
+	}, testLayer{"app": "binary"})
+}
+
+// prepareWithOverlay prepares the test image with the overlay and returns the
+// resulting container config and config digest.
+func (suite *OverlayTestSuite) prepareWithOverlay(overlayJSON string, arrayMerge map[string]string) (map[string]interface{}, string) {
+	path := filepath.Join(suite.T().TempDir(), "overlay.json")
+	suite.Require().NoError(os.WriteFile(path, []byte(overlayJSON), 0o644))
+	overlay, err := LoadConfigOverlay(path, arrayMerge)
+	suite.Require().NoError(err)
+
+	image := suite.image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{Overlay: overlay}
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+
+	configJSON, err := os.ReadFile(builder.ConfigPath)
+	suite.Require().NoError(err)
+	configData := map[string]interface{}{}
+	suite.Require().NoError(encodingjson.Unmarshal(configJSON, &configData))
+	return configData["config"].(map[string]interface{}), image.Manifest.Config.Digest
+}
+
+// unmodifiedDigest returns the config digest of the test image prepared
+// without any edits.
+func (suite *OverlayTestSuite) unmodifiedDigest() string {
+	image := suite.image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+	return image.Manifest.Config.Digest
+}
+
+func (suite *OverlayTestSuite) TestEnvIsAppended() {
+	config, digest := suite.prepareWithOverlay(`{"config": {"Env": ["MODE=staging", "DEBUG=1"]}}`, nil)
+	suite.Equal([]interface{}{"PATH=/bin", "MODE=staging", "DEBUG=1"}, config["Env"])
+	suite.NotEqual(suite.unmodifiedDigest(), digest)
+}
+
+func (suite *OverlayTestSuite) TestCmdIsReplaced() {
+	config, digest := suite.prepareWithOverlay(`{"config": {"Cmd": ["/app", "--port=8080"]}}`, nil)
+	suite.Equal([]interface{}{"/app", "--port=8080"}, config["Cmd"])
+	suite.NotEqual(suite.unmodifiedDigest(), digest)
+}
+
+func (suite *OverlayTestSuite) TestCmdCanBeAppended() {
+	config, _ := suite.prepareWithOverlay(`{"config": {"Cmd": ["--verbose"]}}`, map[string]string{"config.Cmd": "append"})
+	suite.Equal([]interface{}{"/app", "--port=80", "--verbose"}, config["Cmd"])
+}
+
+func (suite *OverlayTestSuite) TestLabelsAreMerged() {
+	config, digest := suite.prepareWithOverlay(`{"config": {"Labels": {"env": "staging"}}}`, nil)
+	labels := config["Labels"].(map[string]interface{})
+	suite.Equal("infra", labels["team"])
+	suite.Equal("staging", labels["env"])
+	suite.Contains(labels, "oci_layers")
+	suite.NotEqual(suite.unmodifiedDigest(), digest)
+}
+
+func (suite *OverlayTestSuite) TestInvalidMergeMode() {
+	_, err := LoadConfigOverlay(filepath.Join(suite.T().TempDir(), "overlay.json"), map[string]string{"config.Cmd": "prepend"})
+	suite.Error(err)
+}
+
+func TestOverlayTestSuite(t *testing.T) {
+	suite.Run(t, new(OverlayTestSuite))
+}
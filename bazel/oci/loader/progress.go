@@ -0,0 +1,76 @@
+// Structured progress reporting for the load pipeline.
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// ProgressEventType identifies what a ProgressEvent reports.
+type ProgressEventType string
+
+const (
+	ProgressPhaseStart ProgressEventType = "phaseStart"
+	ProgressPhaseEnd   ProgressEventType = "phaseEnd"
+	ProgressLayer      ProgressEventType = "layer"
+	ProgressTag        ProgressEventType = "tag"
+)
+
+// Phases of loadImage reported in progress events.
+const (
+	PhasePrepare = "prepare"
+	PhaseCheck   = "check"
+	PhaseBuild   = "build"
+	PhaseLoad    = "load"
+)
+
+// ProgressEvent is a step of loadImage. Layer events are sent for every layer
+// added to the tar, with Index counting from 1 up to Total.
+type ProgressEvent struct {
+	Type  ProgressEventType `json:"type"`
+	Phase string            `json:"phase,omitempty"`
+	Layer string            `json:"layer,omitempty"`
+	Index int               `json:"index,omitempty"`
+	Total int               `json:"total,omitempty"`
+	Tag   string            `json:"tag,omitempty"`
+}
+
+// ProgressFunc receives the progress events of a load.
+type ProgressFunc func(ProgressEvent)
+
+// emit sends the event to the progress callback, if any.
+func (o Options) emit(event ProgressEvent) {
+	if o.Progress != nil {
+		o.Progress(event)
+	}
+}
+
+// emitPhase sends the start event of a phase and returns a function sending
+// its end event.
+func (o Options) emitPhase(phase string) func() {
+	o.emit(ProgressEvent{Type: ProgressPhaseStart, Phase: phase})
+	return func() { o.emit(ProgressEvent{Type: ProgressPhaseEnd, Phase: phase}) }
+}
+
+// emitTags sends a tag event for every tag applied to the image.
+func (o Options) emitTags(action DockerLoadAction) {
+	for _, tag := range action.TagsAdded {
+		o.emit(ProgressEvent{Type: ProgressTag, Tag: tag})
+	}
+}
+
+// writeProgress returns a ProgressFunc printing the events to w, one per line.
+func writeProgress(w io.Writer) ProgressFunc {
+	return func(event ProgressEvent) {
+		switch event.Type {
+		case ProgressPhaseStart:
+			fmt.Fprintln(w, "Starting", event.Phase)
+		case ProgressPhaseEnd:
+			fmt.Fprintln(w, "Finished", event.Phase)
+		case ProgressLayer:
+			fmt.Fprintf(w, "Adding layer %d/%d %s\n", event.Index, event.Total, event.Layer)
+		case ProgressTag:
+			fmt.Fprintln(w, "Tagged", event.Tag)
+		}
+	}
+}
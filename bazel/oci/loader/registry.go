@@ -0,0 +1,345 @@
+// Pulling images from a pull-through registry cache instead of building them.
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	encodingjson "encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// registryCacheTimeout bounds the lookup of an image in the registry cache,
+// which must not take longer than building the image locally.
+const registryCacheTimeout = 10 * time.Second
+
+// registryManifestTypes are the media types accepted when looking up a
+// manifest in the registry cache.
+var registryManifestTypes = []string{
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// RegistryCache is a pull-through registry cache that may already have the
+// image, by the digest of its manifest.
+type RegistryCache struct {
+	scheme string
+	host   string
+	// prefix is the path of the repositories in the registry, if any.
+	prefix string
+	client *http.Client
+	// auth are the credentials for the cache, nil to access it anonymously.
+	auth *registry.AuthConfig
+}
+
+// NewRegistryCache returns the cache at rawURL, e.g.
+// https://cache.example.com:5000/mirror. The scheme defaults to https.
+func NewRegistryCache(rawURL string) (*RegistryCache, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry cache URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid registry cache URL %q, the scheme must be http or https", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid registry cache URL %q, it has no host", rawURL)
+	}
+	return &RegistryCache{
+		scheme: u.Scheme,
+		host:   u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		client: &http.Client{Timeout: registryCacheTimeout},
+	}, nil
+}
+
+// repoName returns the repository of a repo tag, without the tag or digest.
+func repoName(tag string) string {
+	if name, _, ok := strings.Cut(tag, "@"); ok {
+		return name
+	}
+	// A colon before the last slash belongs to the registry port.
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		return tag[:i]
+	}
+	return tag
+}
+
+// cacheRepo returns the path of the repository of a repo tag in the cache,
+// which mirrors it without its registry host: foo:latest is looked up as
+// library/foo, like the daemon pulls it from Docker Hub.
+func cacheRepo(tag string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return "", fmt.Errorf("invalid repo tag %q: %w", tag, err)
+	}
+	return reference.Path(named), nil
+}
+
+// Reference returns the reference the daemon pulls the manifest of the
+// repository from the cache with.
+func (c *RegistryCache) Reference(repo, digest string) string {
+	return path.Join(c.host, c.prefix, repo) + "@" + digest
+}
+
+// Has reports whether the cache has the manifest in the repository. A
+// registry requiring authentication is answered with its credentials, if any.
+func (c *RegistryCache) Has(ctx context.Context, repo, digest string) (bool, error) {
+	u := url.URL{Scheme: c.scheme, Host: c.host, Path: path.Join("/v2", c.prefix, repo, "manifests", digest)}
+	status, challenge, err := c.headManifest(ctx, u.String(), "")
+	if err == nil && status == http.StatusUnauthorized {
+		authorization, authErr := c.authorize(ctx, challenge)
+		if authErr != nil {
+			return false, fmt.Errorf("error authenticating to the registry cache: %w", authErr)
+		}
+		status, _, err = c.headManifest(ctx, u.String(), authorization)
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up %s in the registry cache: %w", digest, err)
+	}
+
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("error looking up %s in the registry cache: %s", digest, http.StatusText(status))
+	}
+}
+
+// headManifest sends a HEAD request for the manifest at manifestURL, with the
+// Authorization header if not empty. It returns the response status and the
+// authentication challenge of the registry.
+func (c *RegistryCache) headManifest(ctx context.Context, manifestURL, authorization string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Accept", strings.Join(registryManifestTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("WWW-Authenticate"), nil
+}
+
+// authorize returns the Authorization header answering the challenge of the
+// registry: the credentials for Basic, or a token from the realm for Bearer.
+// Identity tokens are only sent to the daemon, so a registry only accepting
+// those is accessed without credentials.
+func (c *RegistryCache) authorize(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.auth == nil || c.auth.Username == "" {
+			return "", fmt.Errorf("the registry requires credentials, log into %s with docker login", c.host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.auth.Username+":"+c.auth.Password)), nil
+	case "bearer":
+		token, err := c.fetchToken(ctx, params)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+}
+
+// tokenResponse is the response of a registry token server, which sets
+// either field.
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// fetchToken gets a token from the realm of a Bearer challenge, for the
+// service and scope it asked for. The credentials, if any, authenticate the
+// request; without them the token is an anonymous one.
+func (c *RegistryCache) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.auth != nil && c.auth.Username != "" {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error getting a registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting a registry token: %s", resp.Status)
+	}
+	token := tokenResponse{}
+	if err := encodingjson.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error reading the registry token: %w", err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("the token server returned no token")
+}
+
+// parseAuthChallenge splits a WWW-Authenticate challenge, e.g.
+// `Bearer realm="https://auth.example.com/token",service="registry"`, into its
+// scheme and parameters.
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			// Quoted values may have commas.
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(params[key])
+		}
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return scheme, params
+}
+
+// pullOptions returns the options of the pull from the cache, sending its
+// credentials to the daemon, which does not read them on its own.
+func (c *RegistryCache) pullOptions() (types.ImagePullOptions, error) {
+	if c.auth == nil {
+		return types.ImagePullOptions{}, nil
+	}
+	encoded, err := registry.EncodeAuthConfig(*c.auth)
+	if err != nil {
+		return types.ImagePullOptions{}, fmt.Errorf("error encoding the registry cache credentials: %w", err)
+	}
+	return types.ImagePullOptions{RegistryAuth: encoded}, nil
+}
+
+// PullMessage is one of the JSON messages streamed back by an image pull.
+type PullMessage struct {
+	Status      string `json:"status"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// readPullResponse reads the messages streamed back by an image pull, failing
+// on the first error reported by the daemon.
+func readPullResponse(body io.Reader) error {
+	decoder := encodingjson.NewDecoder(body)
+	for {
+		msg := PullMessage{}
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading pull response: %w", err)
+		}
+		if msg.ErrorDetail.Message != "" {
+			return &daemonReportedError{fmt.Errorf("error pulling image: %s", msg.ErrorDetail.Message)}
+		}
+	}
+}
+
+// PullFromCache pulls the image with the manifest digest from the registry
+// cache and tags it, reporting whether it did. The image is looked up in the
+// repository of the first repo tag. A miss, or any failure to get the image
+// from the cache, only means the image has to be built locally; only failing
+// to tag the pulled image is an error.
+func (d *DockerLoader) PullFromCache(ctx context.Context, manifestDigest, imageID string, repoTags []string) (bool, DockerLoadAction, error) {
+	cache := d.opts.RegistryCache
+	if cache == nil || d.opts.NoCache || manifestDigest == "" || len(repoTags) == 0 {
+		return false, DockerLoadAction{}, nil
+	}
+	start := time.Now()
+	repo, err := cacheRepo(repoTags[0])
+	if err != nil {
+		logger(ctx).Println("Building the image locally:", err)
+		return false, DockerLoadAction{}, nil
+	}
+
+	found, err := cache.Has(ctx, repo, manifestDigest)
+	if err != nil {
+		logger(ctx).Println("Building the image locally:", err)
+		return false, DockerLoadAction{}, nil
+	}
+	if !found {
+		logger(ctx).Println("Image", manifestDigest, "is not in the registry cache")
+		return false, DockerLoadAction{}, nil
+	}
+
+	ref := cache.Reference(repo, manifestDigest)
+	pullOpts, err := cache.pullOptions()
+	if err != nil {
+		return false, DockerLoadAction{}, err
+	}
+	logger(ctx).Println("Pulling image from the registry cache:", ref)
+	err = d.opts.Retry.Do(ctx, "pull", func() error {
+		body, err := d.cli.ImagePull(ctx, ref, pullOpts)
+		if err != nil {
+			return fmt.Errorf("error pulling %s: %w", ref, err)
+		}
+		defer body.Close()
+		return readPullResponse(body)
+	})
+	if err != nil {
+		logger(ctx).Println("Building the image locally:", err)
+		return false, DockerLoadAction{}, nil
+	}
+
+	inspect, err := d.inspectImage(ctx, ref)
+	if err != nil {
+		return false, DockerLoadAction{}, fmt.Errorf("error inspecting image pulled from the registry cache: %w", err)
+	}
+	action := DockerLoadAction{Digest: imageID, PulledFrom: ref}
+	if inspect.ID != imageID {
+		action.ExistingID = inspect.ID
+	}
+	if err := d.ensureTags(ctx, inspect.ID, repoTags, &action); err != nil {
+		return false, action, err
+	}
+	action.LoadTime = time.Since(start).String()
+	return true, action, nil
+}
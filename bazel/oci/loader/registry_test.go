@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	image    Image
+	manifest string
+	// cached are the manifest paths the stub registry has.
+	cached   map[string]bool
+	requests []string
+	server   *httptest.Server
+}
+
+func (suite *RegistryTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	suite.manifest = suite.image.Index.Manifests[0].Digest
+	suite.cached = map[string]bool{}
+	suite.requests = nil
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.requests = append(suite.requests, r.Method+" "+r.URL.Path)
+		if !suite.cached[r.URL.Path] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	suite.T().Cleanup(suite.server.Close)
+}
+
+// loader returns a loader using the stub registry as the cache.
+func (suite *RegistryTestSuite) loader(cli *fakeDockerAPI) *DockerLoader {
+	loaderOpts, err := newDockerLoaderOpts(context.Background(), Options{RegistryCache: suite.server.URL + "/mirror"})
+	suite.Require().NoError(err)
+	return newDockerLoaderWithAPI(cli, loaderOpts)
+}
+
+func (suite *RegistryTestSuite) TestPullsImageFromCache() {
+	suite.cached["/v2/mirror/library/app/manifests/"+suite.manifest] = true
+	ref := strings.TrimPrefix(suite.server.URL, "http://") + "/mirror/library/app@" + suite.manifest
+	cli := newFakeDockerAPI()
+	cli.registry = map[string]string{ref: suite.image.Manifest.Config.Digest}
+
+	action, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.Equal(ref, action.PulledFrom)
+	suite.Equal(suite.image.Manifest.Config.Digest, action.Digest)
+	suite.Empty(action.ExistingID)
+	suite.Equal([]string{"app:v1"}, action.TagsAdded)
+	suite.Equal([]string{ref}, cli.pulls)
+	suite.Empty(cli.loadedTars)
+	suite.Equal([]string{"app:v1"}, cli.images[suite.image.Manifest.Config.Digest].RepoTags)
+}
+
+func (suite *RegistryTestSuite) TestPulledImageIsFoundByIDNextRun() {
+	suite.cached["/v2/mirror/library/app/manifests/"+suite.manifest] = true
+	ref := strings.TrimPrefix(suite.server.URL, "http://") + "/mirror/library/app@" + suite.manifest
+	cli := newFakeDockerAPI()
+	cli.registry = map[string]string{ref: suite.image.Manifest.Config.Digest}
+
+	_, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.requests = nil
+
+	action, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.True(action.AlreadyLoaded)
+	suite.Equal(suite.image.Manifest.Config.Digest, action.DaemonDigest())
+	suite.Empty(suite.requests)
+	suite.Len(cli.pulls, 1)
+}
+
+func (suite *RegistryTestSuite) TestCacheRepoIsNormalized() {
+	suite.cached["/v2/mirror/library/foo/manifests/"+suite.manifest] = true
+	ref := strings.TrimPrefix(suite.server.URL, "http://") + "/mirror/library/foo@" + suite.manifest
+	cli := newFakeDockerAPI()
+	cli.registry = map[string]string{ref: suite.image.Manifest.Config.Digest}
+
+	action, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"foo:latest"}, Options{})
+	suite.Require().NoError(err)
+	suite.Equal(ref, action.PulledFrom)
+	suite.Empty(cli.loadedTars)
+}
+
+func (suite *RegistryTestSuite) TestCacheRepoDropsRegistryHost() {
+	for tag, repo := range map[string]string{
+		"foo:latest":                           "library/foo",
+		"foo":                                  "library/foo",
+		"org/app:v1":                           "org/app",
+		"registry.example.com:5000/org/app:v1": "org/app",
+		"gcr.io/project/app@sha256:" + strings.Repeat("a", 64): "project/app",
+	} {
+		got, err := cacheRepo(tag)
+		suite.Require().NoError(err, tag)
+		suite.Equal(repo, got, tag)
+	}
+}
+
+func (suite *RegistryTestSuite) TestPullSendsCacheCredentials() {
+	suite.cached["/v2/mirror/library/app/manifests/"+suite.manifest] = true
+	host := strings.TrimPrefix(suite.server.URL, "http://")
+	cli := newFakeDockerAPI()
+	cli.registry = map[string]string{host + "/mirror/library/app@" + suite.manifest: suite.image.Manifest.Config.Digest}
+
+	configDir := writeDockerCLIConfig(suite.T(), `{"auths":{"`+host+`":{"auth":"dXNlcjpzZWNyZXQ="}}}`)
+	loaderOpts, err := newDockerLoaderOpts(context.Background(), Options{RegistryCache: suite.server.URL + "/mirror", DockerConfig: configDir})
+	suite.Require().NoError(err)
+	_, err = loadImage(context.Background(), newDockerLoaderWithAPI(cli, loaderOpts), suite.image, []string{"app:v1"}, Options{})
+	suite.Require().NoError(err)
+
+	suite.Require().Len(cli.pullAuths, 1)
+	auth, err := registry.DecodeAuthConfig(cli.pullAuths[0])
+	suite.Require().NoError(err)
+	suite.Equal("user", auth.Username)
+	suite.Equal("secret", auth.Password)
+	suite.Equal(host, auth.ServerAddress)
+}
+
+func (suite *RegistryTestSuite) TestBuildsLocallyOnCacheMiss() {
+	cli := newFakeDockerAPI()
+
+	action, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.Empty(action.PulledFrom)
+	suite.Equal([]string{"HEAD /v2/mirror/library/app/manifests/" + suite.manifest}, suite.requests)
+	suite.Empty(cli.pulls)
+	suite.Len(cli.loadedTars, 1)
+}
+
+func (suite *RegistryTestSuite) TestBuildsLocallyWhenPullFails() {
+	suite.cached["/v2/mirror/library/app/manifests/"+suite.manifest] = true
+	cli := newFakeDockerAPI()
+
+	action, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"app:v1"}, Options{})
+	suite.Require().NoError(err)
+	suite.Empty(action.PulledFrom)
+	suite.Len(cli.pulls, 1)
+	suite.Len(cli.loadedTars, 1)
+}
+
+func (suite *RegistryTestSuite) TestEditedImageIsNotLookedUp() {
+	cli := newFakeDockerAPI()
+
+	_, err := loadImage(context.Background(), suite.loader(cli), suite.image, []string{"app:v1"}, Options{StripEnv: []string{"SECRET"}})
+	suite.Require().NoError(err)
+	suite.Empty(suite.requests)
+	suite.Len(cli.loadedTars, 1)
+}
+
+// authenticatingCache returns a cache behind a registry that requires the
+// Authorization header, answering with the challenge otherwise.
+func (suite *RegistryTestSuite) authenticatingCache(challenge, authorization string, auth *registry.AuthConfig) *RegistryCache {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.Header().Set("WWW-Authenticate", challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	suite.T().Cleanup(server.Close)
+	cache, err := NewRegistryCache(server.URL + "/mirror")
+	suite.Require().NoError(err)
+	cache.auth = auth
+	return cache
+}
+
+func (suite *RegistryTestSuite) TestHasAuthenticatesWithBearerToken() {
+	tokenQueries := []string{}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		tokenQueries = append(tokenQueries, r.URL.RawQuery)
+		w.Write([]byte(`{"token":"abc"}`))
+	}))
+	suite.T().Cleanup(tokenServer.Close)
+	challenge := `Bearer realm="` + tokenServer.URL + `/token",service="cache",scope="repository:mirror/app:pull"`
+	cache := suite.authenticatingCache(challenge, "Bearer abc", &registry.AuthConfig{Username: "user", Password: "secret"})
+
+	found, err := cache.Has(context.Background(), "app", suite.manifest)
+	suite.Require().NoError(err)
+	suite.True(found)
+	suite.Equal([]string{"scope=repository%3Amirror%2Fapp%3Apull&service=cache"}, tokenQueries)
+
+	cache.auth = nil
+	_, err = cache.Has(context.Background(), "app", suite.manifest)
+	suite.ErrorContains(err, "error getting a registry token: 401")
+}
+
+func (suite *RegistryTestSuite) TestHasAuthenticatesWithBasicAuth() {
+	cache := suite.authenticatingCache(`Basic realm="cache"`, "Basic dXNlcjpzZWNyZXQ=", &registry.AuthConfig{Username: "user", Password: "secret"})
+	found, err := cache.Has(context.Background(), "app", suite.manifest)
+	suite.Require().NoError(err)
+	suite.True(found)
+
+	cache.auth = nil
+	_, err = cache.Has(context.Background(), "app", suite.manifest)
+	suite.ErrorContains(err, "the registry requires credentials")
+}
+
+func (suite *RegistryTestSuite) TestParseAuthChallenge() {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry",scope="repository:a:pull,push"`)
+	suite.Equal("Bearer", scheme)
+	suite.Equal(map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry",
+		"scope":   "repository:a:pull,push",
+	}, params)
+
+	scheme, params = parseAuthChallenge(`Basic realm=cache`)
+	suite.Equal("Basic", scheme)
+	suite.Equal(map[string]string{"realm": "cache"}, params)
+}
+
+func (suite *RegistryTestSuite) TestRegistryCacheURL() {
+	cache, err := NewRegistryCache("cache.example.com:5000/mirror/")
+	suite.Require().NoError(err)
+	suite.Equal("cache.example.com:5000/mirror/team/app@sha256:abc", cache.Reference(repoName("team/app:v1"), "sha256:abc"))
+
+	_, err = NewRegistryCache("ftp://cache.example.com")
+	suite.Error(err)
+}
+
+func (suite *RegistryTestSuite) TestRepoName() {
+	suite.Equal("app", repoName("app:v1"))
+	suite.Equal("localhost:5000/app", repoName("localhost:5000/app:v1"))
+	suite.Equal("localhost:5000/app", repoName("localhost:5000/app"))
+	suite.Equal("app", repoName("app@sha256:abc"))
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
@@ -0,0 +1,139 @@
+// Registry credentials from the config of the docker CLI.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	encodingjson "encoding/json"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+// dockerCLIConfig is the part of the config.json of the docker CLI holding
+// the registry credentials.
+type dockerCLIConfig struct {
+	Auths       map[string]dockerCLIAuth `json:"auths"`
+	CredsStore  string                   `json:"credsStore"`
+	CredHelpers map[string]string        `json:"credHelpers"`
+}
+
+// dockerCLIAuth are the credentials of a registry, stored by `docker login`
+// as the base64 of "user:password" in Auth.
+type dockerCLIAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// loadRegistryAuth returns the credentials for the registry host from the
+// config.json in configDir, or nil if it has none. As for the docker CLI, the
+// credential helper of the host, or else the credentials store, takes
+// precedence over the credentials in the file.
+func loadRegistryAuth(ctx context.Context, configDir, host string) (*registry.AuthConfig, error) {
+	data, err := os.ReadFile(filepath.Join(configDir, "config.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading docker config: %w", err)
+	}
+	config := dockerCLIConfig{}
+	if err := encodingjson.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing docker config %s: %w", filepath.Join(configDir, "config.json"), err)
+	}
+
+	if helper := config.CredHelpers[host]; helper != "" {
+		return helperRegistryAuth(ctx, helper, host)
+	}
+	if config.CredsStore != "" {
+		return helperRegistryAuth(ctx, config.CredsStore, host)
+	}
+	key, ok := registryAuthKey(config.Auths, host)
+	if !ok {
+		return nil, nil
+	}
+	entry := config.Auths[key]
+	auth := &registry.AuthConfig{
+		Username:      entry.Username,
+		Password:      entry.Password,
+		IdentityToken: entry.IdentityToken,
+		ServerAddress: host,
+	}
+	if entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth of %s in docker config: %w", key, err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid auth of %s in docker config: not a user:password pair", key)
+		}
+		auth.Username, auth.Password = username, password
+	}
+	return auth, nil
+}
+
+// registryAuthKey returns the key of the credentials of the host. The docker
+// CLI keys them by host, or by URL for older logins.
+func registryAuthKey(auths map[string]dockerCLIAuth, host string) (string, bool) {
+	if _, ok := auths[host]; ok {
+		return host, true
+	}
+	for key := range auths {
+		if u, err := url.Parse(key); err == nil && u.Host == host {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// credentialsNotFound is the output of a credential helper without
+// credentials for the registry.
+const credentialsNotFound = "credentials not found in native keychain"
+
+// helperCredentials are the credentials printed by `docker-credential-<helper>
+// get`. A Username of "<token>" means Secret is an identity token.
+type helperCredentials struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// helperRegistryAuth returns the credentials for the registry host from the
+// docker-credential-<helper> binary on the PATH, or nil if it has none.
+func helperRegistryAuth(ctx context.Context, helper, host string) (*registry.AuthConfig, error) {
+	program := "docker-credential-" + helper
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), credentialsNotFound) {
+			logger(ctx).Println(program, "has no credentials for", host+", accessing it without credentials")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error getting the credentials for %s from %s: %w: %s", host, program, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	creds := helperCredentials{}
+	if err := encodingjson.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("error parsing the credentials for %s from %s: %w", host, program, err)
+	}
+	auth := &registry.AuthConfig{ServerAddress: host}
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
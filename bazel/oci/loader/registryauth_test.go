@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeDockerCLIConfig writes config as the config.json of a new docker CLI
+// config dir.
+func writeDockerCLIConfig(t *testing.T, config string) string {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600))
+	return dir
+}
+
+func TestLoadRegistryAuthDecodesLogin(t *testing.T) {
+	// "user:p:ss" in base64, the password may have colons.
+	dir := writeDockerCLIConfig(t, `{"auths":{"cache.example.com":{"auth":"dXNlcjpwOnNz"}}}`)
+	auth, err := loadRegistryAuth(context.Background(), dir, "cache.example.com")
+	require.NoError(t, err)
+	require.NotNil(t, auth)
+	require.Equal(t, "user", auth.Username)
+	require.Equal(t, "p:ss", auth.Password)
+	require.Equal(t, "cache.example.com", auth.ServerAddress)
+}
+
+func TestLoadRegistryAuthMatchesURLKeys(t *testing.T) {
+	dir := writeDockerCLIConfig(t, `{"auths":{"https://cache.example.com:5000/v1/":{"username":"user","password":"secret"}}}`)
+	auth, err := loadRegistryAuth(context.Background(), dir, "cache.example.com:5000")
+	require.NoError(t, err)
+	require.NotNil(t, auth)
+	require.Equal(t, "user", auth.Username)
+	require.Equal(t, "secret", auth.Password)
+}
+
+func TestLoadRegistryAuthWithoutCredentials(t *testing.T) {
+	auth, err := loadRegistryAuth(context.Background(), t.TempDir(), "cache.example.com")
+	require.NoError(t, err)
+	require.Nil(t, auth)
+
+	dir := writeDockerCLIConfig(t, `{"auths":{"other.example.com":{"auth":"dXNlcjpwYXNz"}}}`)
+	auth, err = loadRegistryAuth(context.Background(), dir, "cache.example.com")
+	require.NoError(t, err)
+	require.Nil(t, auth)
+
+	dir = writeDockerCLIConfig(t, `{"auths":{"cache.example.com":{"auth":"not base64"}}}`)
+	_, err = loadRegistryAuth(context.Background(), dir, "cache.example.com")
+	require.ErrorContains(t, err, "invalid auth of cache.example.com")
+}
+
+// installCredentialHelper puts a docker-credential-<name> script on the PATH
+// printing the credentials for host, and the not found error for other hosts.
+func installCredentialHelper(t *testing.T, name, host, credentials string) {
+	dir := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+[ "$1" = get ] || exit 2
+if [ "$(cat)" = %q ]; then
+	echo %q
+else
+	echo "credentials not found in native keychain"
+	exit 1
+fi
+`, host, credentials)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestLoadRegistryAuthFromCredentialHelper(t *testing.T) {
+	installCredentialHelper(t, "ecr-login", "cache.example.com", `{"ServerURL":"cache.example.com","Username":"AWS","Secret":"from-helper"}`)
+	// The helper of the host takes precedence over the file and the store.
+	dir := writeDockerCLIConfig(t, `{"auths":{"cache.example.com":{"auth":"dXNlcjpwYXNz"}},"credsStore":"missing","credHelpers":{"cache.example.com":"ecr-login"}}`)
+	auth, err := loadRegistryAuth(context.Background(), dir, "cache.example.com")
+	require.NoError(t, err)
+	require.NotNil(t, auth)
+	require.Equal(t, "AWS", auth.Username)
+	require.Equal(t, "from-helper", auth.Password)
+	require.Equal(t, "cache.example.com", auth.ServerAddress)
+}
+
+func TestLoadRegistryAuthFromCredentialsStore(t *testing.T) {
+	installCredentialHelper(t, "desktop", "cache.example.com", `{"ServerURL":"cache.example.com","Username":"<token>","Secret":"identity"}`)
+	dir := writeDockerCLIConfig(t, `{"auths":{"cache.example.com":{}},"credsStore":"desktop"}`)
+	auth, err := loadRegistryAuth(context.Background(), dir, "cache.example.com")
+	require.NoError(t, err)
+	require.NotNil(t, auth)
+	require.Empty(t, auth.Username)
+	require.Equal(t, "identity", auth.IdentityToken)
+
+	auth, err = loadRegistryAuth(context.Background(), dir, "other.example.com")
+	require.NoError(t, err)
+	require.Nil(t, auth)
+
+	dir = writeDockerCLIConfig(t, `{"credsStore":"missing"}`)
+	_, err = loadRegistryAuth(context.Background(), dir, "cache.example.com")
+	require.ErrorContains(t, err, "docker-credential-missing")
+}
+
+func TestDockerConfigDir(t *testing.T) {
+	env := map[string]string{"HOME": "/home/user"}
+	getenv := func(name string) string { return env[name] }
+	require.Equal(t, "/home/user/.docker", dockerConfigDir("", getenv))
+
+	env["DOCKER_CONFIG"] = "/etc/docker-cli"
+	require.Equal(t, "/etc/docker-cli", dockerConfigDir("", getenv))
+	require.Equal(t, "/tmp/config", dockerConfigDir("/tmp/config", getenv))
+}
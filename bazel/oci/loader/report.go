@@ -0,0 +1,183 @@
+// Comparison report aggregating the outcomes of many loads.
+package main
+
+import (
+	"encoding/csv"
+	encodingjson "encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Outcomes of a load counted in the comparison report.
+const (
+	// outcomeLoaded is an image loaded without replacing another one.
+	outcomeLoaded = "loaded"
+	// outcomeAlreadyLoaded is an image found in the daemon by any check.
+	outcomeAlreadyLoaded = "alreadyLoaded"
+	// outcomeReloaded is an image loaded because a repo tag pointed at an
+	// image that did not match its config or layers, and the tag was moved.
+	outcomeReloaded = "reloaded"
+	// outcomeConflictSkipped is an image loaded while repo tags pointing at
+	// another image were left there, with --on-conflict=skip.
+	outcomeConflictSkipped = "conflictSkipped"
+	// outcomeForced is an image loaded with --no-cache, whether or not the
+	// daemon already had it.
+	outcomeForced = "forced"
+	// outcomePulled is an image pulled from the registry cache.
+	outcomePulled = "pulled"
+	// outcomeSkipped is an image not loaded, e.g. because of --skip-if-running.
+	outcomeSkipped = "skipped"
+)
+
+var reportOutcomes = []string{outcomeLoaded, outcomeAlreadyLoaded, outcomeReloaded, outcomeConflictSkipped, outcomeForced, outcomePulled, outcomeSkipped}
+
+// loadOutcome classifies the result of a load.
+func loadOutcome(action DockerLoadAction) string {
+	switch {
+	case action.SkippedReason != "":
+		return outcomeSkipped
+	case action.AlreadyLoaded:
+		return outcomeAlreadyLoaded
+	case action.PulledFrom != "":
+		return outcomePulled
+	case action.Forced:
+		return outcomeForced
+	case len(action.TagsRepointed) > 0:
+		return outcomeReloaded
+	case len(action.TagsSkipped) > 0:
+		return outcomeConflictSkipped
+	default:
+		return outcomeLoaded
+	}
+}
+
+// ReportEntry is the outcome of the load of one image.
+type ReportEntry struct {
+	Digest   string   `json:"digest"`
+	RepoTags []string `json:"repoTags"`
+	Outcome  string   `json:"outcome"`
+}
+
+// ComparisonReport counts the outcomes of the loads recorded in it.
+type ComparisonReport struct {
+	Total    int            `json:"total"`
+	Outcomes map[string]int `json:"outcomes"`
+	// Images is only kept in JSON reports.
+	Images []ReportEntry `json:"images,omitempty"`
+}
+
+// add records the outcome of a load.
+func (r *ComparisonReport) add(action DockerLoadAction, repoTags []string) {
+	if r.Outcomes == nil {
+		r.Outcomes = map[string]int{}
+	}
+	outcome := loadOutcome(action)
+	r.Total++
+	r.Outcomes[outcome]++
+	tags := append([]string(nil), repoTags...)
+	sort.Strings(tags)
+	r.Images = append(r.Images, ReportEntry{Digest: action.Digest, RepoTags: tags, Outcome: outcome})
+}
+
+// isCSVReport reports whether the report at path is written as CSV instead
+// of JSON.
+func isCSVReport(path string) bool {
+	return strings.HasSuffix(path, ".csv")
+}
+
+// readReport parses a report written by writeReport. An empty report has no
+// loads.
+func readReport(r io.Reader, asCSV bool) (ComparisonReport, error) {
+	report := ComparisonReport{Outcomes: map[string]int{}}
+	data, err := io.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return report, err
+	}
+	if !asCSV {
+		err := encodingjson.Unmarshal(data, &report)
+		if report.Outcomes == nil {
+			report.Outcomes = map[string]int{}
+		}
+		return report, err
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return report, err
+	}
+	for _, row := range rows[1:] {
+		if len(row) != 2 {
+			return report, fmt.Errorf("unexpected row %q", row)
+		}
+		count, err := strconv.Atoi(row[1])
+		if err != nil {
+			return report, fmt.Errorf("unexpected count in row %q", row)
+		}
+		if row[0] == "total" {
+			report.Total = count
+		} else {
+			report.Outcomes[row[0]] = count
+		}
+	}
+	return report, nil
+}
+
+// writeReport writes the report as indented JSON, or as CSV rows with the
+// count of every outcome and the total.
+func writeReport(w io.Writer, report ComparisonReport, asCSV bool) error {
+	if !asCSV {
+		data, err := encodingjson.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"outcome", "images"})
+	for _, outcome := range reportOutcomes {
+		cw.Write([]string{outcome, strconv.Itoa(report.Outcomes[outcome])})
+	}
+	cw.Write([]string{"total", strconv.Itoa(report.Total)})
+	cw.Flush()
+	return cw.Error()
+}
+
+// recordOutcome adds the outcome of a load to the report at path, creating
+// it if needed. The report is locked while it is updated, so concurrent
+// loads, e.g. of a batch run in parallel, all get counted.
+func recordOutcome(path string, action DockerLoadAction, repoTags []string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening comparison report: %w", err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("error locking comparison report: %w", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	asCSV := isCSVReport(path)
+	report, err := readReport(f, asCSV)
+	if err != nil {
+		return fmt.Errorf("error reading comparison report %s: %w", path, err)
+	}
+	report.add(action, repoTags)
+
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("error writing comparison report: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error writing comparison report: %w", err)
+	}
+	if err := writeReport(f, report, asCSV); err != nil {
+		return fmt.Errorf("error writing comparison report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/suite"
+)
+
+type ReportTestSuite struct {
+	suite.Suite
+	cli    *fakeDockerAPI
+	loader *DockerLoader
+}
+
+func (suite *ReportTestSuite) SetupTest() {
+	suite.cli = newFakeDockerAPI(types.ImageInspect{ID: "sha256:old", RepoTags: []string{"other:latest"}})
+	suite.loader = newDockerLoaderWithAPI(suite.cli, DockerLoaderOpts{})
+}
+
+// loadBatch loads a batch of images with mixed outcomes, recording them in
+// the report at path: app is loaded and then found, other replaces an older
+// image and tools is loaded.
+func (suite *ReportTestSuite) loadBatch(path string) {
+	dir := suite.T().TempDir()
+	app := writeTestImage(suite.T(), filepath.Join(dir, "app"), nil, testLayer{"app": "binary"})
+	other := writeTestImage(suite.T(), filepath.Join(dir, "other"), nil, testLayer{"other": "binary"})
+	tools := writeTestImage(suite.T(), filepath.Join(dir, "tools"), nil, testLayer{"tools": "binary"})
+
+	o := Options{ComparisonReport: path}
+	for _, load := range []struct {
+		image Image
+		tag   string
+	}{{app, "app"}, {app, "app"}, {other, "other"}, {tools, "tools"}} {
+		suite.Require().NoError(runLoad(context.Background(), io.Discard, suite.loader, load.image, []string{load.tag}, o))
+	}
+}
+
+func (suite *ReportTestSuite) TestJSONReport() {
+	path := filepath.Join(suite.T().TempDir(), "report.json")
+	suite.loadBatch(path)
+
+	f, err := os.Open(path)
+	suite.Require().NoError(err)
+	defer f.Close()
+	report, err := readReport(f, false)
+	suite.Require().NoError(err)
+	suite.Equal(4, report.Total)
+	suite.Equal(map[string]int{outcomeLoaded: 2, outcomeAlreadyLoaded: 1, outcomeReloaded: 1}, report.Outcomes)
+	suite.Require().Len(report.Images, 4)
+	suite.Equal(ReportEntry{Digest: report.Images[0].Digest, RepoTags: []string{"app:latest"}, Outcome: outcomeLoaded}, report.Images[0])
+	suite.Equal(outcomeReloaded, report.Images[2].Outcome)
+}
+
+func (suite *ReportTestSuite) TestForcedLoadsAreReported() {
+	path := filepath.Join(suite.T().TempDir(), "report.json")
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, suite.loader, image, []string{"app"}, Options{ComparisonReport: path}))
+
+	forcing := newDockerLoaderWithAPI(suite.cli, DockerLoaderOpts{NoCache: true})
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, forcing, image, []string{"app"}, Options{ComparisonReport: path, NoCache: true}))
+
+	f, err := os.Open(path)
+	suite.Require().NoError(err)
+	defer f.Close()
+	report, err := readReport(f, false)
+	suite.Require().NoError(err)
+	suite.Equal(map[string]int{outcomeLoaded: 1, outcomeForced: 1}, report.Outcomes)
+}
+
+func (suite *ReportTestSuite) TestReportHasExpandedTags() {
+	path := filepath.Join(suite.T().TempDir(), "report.json")
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	o := Options{ComparisonReport: path, Vars: map[string]string{"GIT_SHA": "abc123"}}
+	suite.Require().NoError(runLoad(context.Background(), io.Discard, suite.loader, image, []string{"app:${GIT_SHA}"}, o))
+
+	f, err := os.Open(path)
+	suite.Require().NoError(err)
+	defer f.Close()
+	report, err := readReport(f, false)
+	suite.Require().NoError(err)
+	suite.Require().Len(report.Images, 1)
+	suite.Equal([]string{"app:abc123"}, report.Images[0].RepoTags)
+}
+
+func (suite *ReportTestSuite) TestCSVReport() {
+	path := filepath.Join(suite.T().TempDir(), "report.csv")
+	suite.loadBatch(path)
+
+	data, err := os.ReadFile(path)
+	suite.Require().NoError(err)
+	suite.Equal(strings.Join([]string{
+		"outcome,images",
+		"loaded,2",
+		"alreadyLoaded,1",
+		"reloaded,1",
+		"conflictSkipped,0",
+		"forced,0",
+		"pulled,0",
+		"skipped,0",
+		"total,4",
+		"",
+	}, "\n"), string(data))
+}
+
+func (suite *ReportTestSuite) TestLoadOutcome() {
+	suite.Equal(outcomeSkipped, loadOutcome(DockerLoadAction{SkippedReason: "image in use by running container"}))
+	suite.Equal(outcomeAlreadyLoaded, loadOutcome(DockerLoadAction{AlreadyLoaded: true, TagsRepointed: []string{"app:latest"}}))
+	suite.Equal(outcomePulled, loadOutcome(DockerLoadAction{PulledFrom: "cache/app@sha256:abc"}))
+	suite.Equal(outcomeReloaded, loadOutcome(DockerLoadAction{TagsRepointed: []string{"app:latest"}, TagsSkipped: []string{"app:v1"}}))
+	suite.Equal(outcomeConflictSkipped, loadOutcome(DockerLoadAction{TagsSkipped: []string{"app:latest"}}))
+	suite.Equal(outcomeForced, loadOutcome(DockerLoadAction{Forced: true, TagsRepointed: []string{"app:latest"}}))
+	suite.Equal(outcomeLoaded, loadOutcome(DockerLoadAction{TagsAdded: []string{"app:latest"}}))
+}
+
+func TestReportTestSuite(t *testing.T) {
+	suite.Run(t, new(ReportTestSuite))
+}
@@ -0,0 +1,193 @@
+// Retries of Docker operations under a budget shared by the whole invocation.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// retryBackoff is the wait before the first retry, doubled on every retry.
+const retryBackoff = 200 * time.Millisecond
+
+// RetryBudget coordinates the retries of all the Docker operations of one
+// invocation, so that they do not each retry independently. Once MaxRetries
+// retries were made or Budget time was spent retrying, operations fail on
+// their first error. A nil RetryBudget never retries.
+type RetryBudget struct {
+	maxRetries int
+	budget     time.Duration
+
+	// patterns match the messages of the errors retried besides the ones
+	// isRetryableError knows about.
+	patterns []*regexp.Regexp
+
+	mu      sync.Mutex
+	retries int
+	spent   time.Duration
+
+	// sleep waits between attempts, replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// NewRetryBudget returns a budget of at most maxRetries retries taking at most
+// budget in total, counting the waits and the retried attempts. A zero budget
+// means no limit on the time.
+func NewRetryBudget(maxRetries int, budget time.Duration) *RetryBudget {
+	return &RetryBudget{
+		maxRetries: maxRetries,
+		budget:     budget,
+		sleep:      sleepContext,
+		now:        time.Now,
+	}
+}
+
+// RetryOn also retries the errors whose message matches any of the regular
+// expressions, unless they are permanent.
+func (r *RetryBudget) RetryOn(patterns []string) error {
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid retryable error pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Do runs the named operation, retrying it while it fails with a retryable
+// error and the budget allows it.
+func (r *RetryBudget) Do(ctx context.Context, name string, op func() error) error {
+	err := op()
+	for attempt := 0; err != nil && r.retryable(err); attempt++ {
+		wait, ok := r.take(retryBackoff << attempt)
+		if !ok {
+			return err
+		}
+		logger(ctx).Printf("Retrying %s after %s: %v", name, wait, err)
+
+		start := r.now()
+		if sleepErr := r.sleep(ctx, wait); sleepErr != nil {
+			return fmt.Errorf("%w (retry interrupted: %v)", err, sleepErr)
+		}
+		err = op()
+		r.spend(r.now().Sub(start))
+	}
+	return err
+}
+
+// take reserves a retry, returning the wait before it capped to the time left.
+func (r *RetryBudget) take(wait time.Duration) (time.Duration, bool) {
+	if r == nil {
+		return 0, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.retries >= r.maxRetries {
+		return 0, false
+	}
+	if r.budget > 0 {
+		left := r.budget - r.spent
+		if left <= 0 {
+			return 0, false
+		}
+		if wait > left {
+			wait = left
+		}
+	}
+	r.retries++
+	return wait, true
+}
+
+func (r *RetryBudget) spend(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spent += d
+}
+
+// retryable reports whether err is worth retrying, either as a known transient
+// failure or because it matches one of the patterns.
+func (r *RetryBudget) retryable(err error) bool {
+	if isPermanentError(err) {
+		return false
+	}
+	if isRetryableError(err) {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(err.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// permanentError is a failure that must not be retried, whatever it wraps.
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.error
+}
+
+// isPermanentError tells the failures no retry can fix: the ones the daemon
+// decided, such as an invalid reference or an error reported in a response
+// stream, the ones marked as permanent and cancellations.
+func isPermanentError(err error) bool {
+	var reported *daemonReportedError
+	var permanent *permanentError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &reported), errors.As(err, &permanent):
+		return true
+	case errdefs.IsInvalidParameter(err), errdefs.IsNotFound(err), errdefs.IsConflict(err),
+		errdefs.IsForbidden(err), errdefs.IsUnauthorized(err):
+		return true
+	}
+	return strings.Contains(err.Error(), "invalid reference format")
+}
+
+// isRetryableError tells transient failures, such as a dropped connection or
+// a busy daemon, from permanent ones, such as a missing image or a bad
+// request.
+func isRetryableError(err error) bool {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case client.IsErrConnectionFailed(err), errdefs.IsUnavailable(err):
+		return true
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
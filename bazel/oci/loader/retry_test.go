@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/suite"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+	slept time.Duration
+}
+
+func (suite *RetryTestSuite) SetupTest() {
+	suite.slept = 0
+}
+
+// newBudget returns a RetryBudget on a fake clock advanced only by the waits.
+func (suite *RetryTestSuite) newBudget(maxRetries int, budget time.Duration) *RetryBudget {
+	r := NewRetryBudget(maxRetries, budget)
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		suite.slept += d
+		return nil
+	}
+	r.now = func() time.Time { return time.Unix(0, 0).Add(suite.slept) }
+	return r
+}
+
+// failingOp returns an operation failing with err the first n calls.
+func failingOp(n int, err error, calls *int) func() error {
+	return func() error {
+		*calls++
+		if *calls <= n {
+			return err
+		}
+		return nil
+	}
+}
+
+var errDaemonBusy = errdefs.Unavailable(errors.New("daemon busy"))
+
+func (suite *RetryTestSuite) TestRetriesTransientError() {
+	calls := 0
+	err := suite.newBudget(3, 0).Do(context.Background(), "op", failingOp(2, errDaemonBusy, &calls))
+	suite.NoError(err)
+	suite.Equal(3, calls)
+	suite.Equal(3*retryBackoff, suite.slept)
+}
+
+func (suite *RetryTestSuite) TestPermanentErrorIsNotRetried() {
+	calls := 0
+	err := suite.newBudget(3, 0).Do(context.Background(), "op", failingOp(1, errdefs.NotFound(errors.New("no such image")), &calls))
+	suite.Error(err)
+	suite.Equal(1, calls)
+}
+
+func (suite *RetryTestSuite) TestRetriesErrorMatchingPattern() {
+	r := suite.newBudget(3, 0)
+	suite.Require().NoError(r.RetryOn([]string{`proxy: connection reset by \S+`}))
+
+	calls := 0
+	throttled := errors.New("proxy: connection reset by upstream")
+	suite.NoError(r.Do(context.Background(), "op", failingOp(2, throttled, &calls)))
+	suite.Equal(3, calls)
+
+	calls = 0
+	suite.Error(r.Do(context.Background(), "op", failingOp(1, errors.New("some other failure"), &calls)))
+	suite.Equal(1, calls)
+}
+
+func (suite *RetryTestSuite) TestPatternsNeverRetryPermanentErrors() {
+	r := suite.newBudget(3, 0)
+	suite.Require().NoError(r.RetryOn([]string{"."}))
+
+	for _, err := range []error{
+		&daemonReportedError{errors.New("Error loading tar file into Docker, error details: no space left on device")},
+		errdefs.InvalidParameter(errors.New("invalid reference format")),
+		errors.New("invalid reference format: repository name must be lowercase"),
+	} {
+		calls := 0
+		suite.Error(r.Do(context.Background(), "op", failingOp(1, err, &calls)))
+		suite.Equal(1, calls, err.Error())
+	}
+}
+
+func (suite *RetryTestSuite) TestInvalidPattern() {
+	suite.ErrorContains(NewRetryBudget(3, 0).RetryOn([]string{"("}), `invalid retryable error pattern "("`)
+}
+
+func (suite *RetryTestSuite) TestNilBudgetNeverRetries() {
+	calls := 0
+	var r *RetryBudget
+	suite.Error(r.Do(context.Background(), "op", failingOp(1, errDaemonBusy, &calls)))
+	suite.Equal(1, calls)
+}
+
+func (suite *RetryTestSuite) TestRetriesAreSharedAcrossOperations() {
+	r := suite.newBudget(2, 0)
+
+	calls := 0
+	suite.Error(r.Do(context.Background(), "first", failingOp(5, errDaemonBusy, &calls)))
+	suite.Equal(3, calls)
+
+	calls = 0
+	suite.Error(r.Do(context.Background(), "second", failingOp(5, errDaemonBusy, &calls)))
+	suite.Equal(1, calls)
+}
+
+func (suite *RetryTestSuite) TestTimeBudgetCapsRetries() {
+	r := suite.newBudget(100, retryBackoff*3)
+
+	calls := 0
+	suite.Error(r.Do(context.Background(), "first", failingOp(100, errDaemonBusy, &calls)))
+	suite.Equal(3, calls)
+	suite.Equal(retryBackoff*3, suite.slept)
+
+	calls = 0
+	suite.Error(r.Do(context.Background(), "second", failingOp(100, errDaemonBusy, &calls)))
+	suite.Equal(1, calls)
+}
+
+// flakyDockerAPI fails every tag with a transient error.
+type flakyDockerAPI struct {
+	*fakeDockerAPI
+	tagCalls int
+}
+
+func (f *flakyDockerAPI) ImageTag(ctx context.Context, ref, tag string) error {
+	f.tagCalls++
+	return errDaemonBusy
+}
+
+func (suite *RetryTestSuite) TestLoaderFailsFastOnceBudgetIsExhausted() {
+	cli := &flakyDockerAPI{fakeDockerAPI: newFakeDockerAPI(types.ImageInspect{ID: "sha256:app"})}
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{Retry: suite.newBudget(2, 0)})
+
+	suite.Error(loader.TagImage(context.Background(), "sha256:app", "app:v1"))
+	suite.Equal(3, cli.tagCalls)
+
+	suite.Error(loader.TagImage(context.Background(), "sha256:app", "app:v2"))
+	suite.Equal(4, cli.tagCalls)
+}
+
+func (suite *RetryTestSuite) TestLoadIsNotRetriedOnceSent() {
+	cli := newFakeDockerAPI()
+	// The stream ends without confirming the load.
+	cli.loadResponse = `{"stream":"Loading layer\n"}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{Retry: suite.newBudget(3, 0)})
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, nil, 0644))
+
+	_, err := loader.LoadTarIntoDocker(context.Background(), tarPath, "sha256:app", []string{"app:latest"})
+	suite.ErrorIs(err, io.ErrUnexpectedEOF)
+	suite.Len(cli.loadedTars, 1)
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
@@ -0,0 +1,41 @@
+// Lookup of image paths given relative to the Bazel runfiles.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bazelbuild/rules_go/go/runfiles"
+)
+
+// resolveRunfilesPath returns where the image directory at path is when path
+// is not found as given, looking it up as a runfiles path such as
+// "_main/app/image" through RUNFILES_MANIFEST_FILE, RUNFILES_DIR or the
+// runfiles next to the binary. Absolute paths, existing paths and paths the
+// runfiles do not know are returned as is.
+func resolveRunfilesPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	r, err := runfiles.New()
+	if err != nil {
+		return path
+	}
+	// Look up a file of the image, as manifests may list every file of the
+	// image instead of the directory.
+	index, err := r.Rlocation(filepath.ToSlash(filepath.Join(path, "index.json")))
+	if err != nil {
+		return path
+	}
+	if _, err := os.Stat(index); err != nil {
+		return path
+	}
+	resolved := filepath.Dir(index)
+	log.Println("Resolved", path, "through the runfiles to", resolved)
+	return resolved
+}
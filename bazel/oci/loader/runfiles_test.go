@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImagePathResolvesThroughRunfilesDir(t *testing.T) {
+	runfilesDir := t.TempDir()
+	imageDir := filepath.Join(runfilesDir, "_main", "images", "app")
+	original := writeTestImage(t, imageDir, nil, testLayer{"app": "binary"})
+	t.Setenv("RUNFILES_MANIFEST_FILE", "")
+	t.Setenv("RUNFILES_DIR", runfilesDir)
+
+	image, err := NewImage("_main/images/app")
+	require.NoError(t, err)
+	require.Equal(t, imageDir, image.Path)
+	require.Equal(t, original.Manifest, image.Manifest)
+}
+
+func TestImagePathResolvesThroughRunfilesManifest(t *testing.T) {
+	imageDir := t.TempDir()
+	original := writeTestImage(t, imageDir, nil, testLayer{"app": "binary"})
+	manifest := filepath.Join(t.TempDir(), "MANIFEST")
+	require.NoError(t, os.WriteFile(manifest, []byte("_main/images/app "+imageDir+"\n"), 0o644))
+	t.Setenv("RUNFILES_MANIFEST_FILE", manifest)
+	t.Setenv("RUNFILES_DIR", "")
+
+	image, err := NewImage("_main/images/app")
+	require.NoError(t, err)
+	require.Equal(t, imageDir, image.Path)
+	require.Equal(t, original.Manifest, image.Manifest)
+
+	_, err = NewImage("_main/images/missing")
+	require.ErrorContains(t, err, "_main/images/missing")
+}
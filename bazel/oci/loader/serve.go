@@ -0,0 +1,223 @@
+// HTTP server mode that keeps a Docker client warm across many loads.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	encodingjson "encoding/json"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultServeAddr = "localhost:8642"
+
+var serveAddr string
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve loads images on request over HTTP, reusing a single Docker client",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		loaderOpts, err := newDockerLoaderOpts(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		loader, err := NewDockerLoader(loaderOpts)
+		if err != nil {
+			return err
+		}
+
+		// Bound before logging, so clients waiting for the log line can
+		// connect right away.
+		listener, err := net.Listen("tcp", serveAddr)
+		if err != nil {
+			return err
+		}
+		log.Println("Listening on", listener.Addr())
+		return http.Serve(listener, newLoadServer(loader, opts))
+	},
+}
+
+// loadRequest is the body of a POST request to the load server.
+type loadRequest struct {
+	ImagePath string             `json:"imagePath"`
+	RepoTags  []string           `json:"repoTags"`
+	Options   loadRequestOptions `json:"options"`
+}
+
+// loadRequestOptions are the options a load request may set. They are named
+// as in Options. The hooks, the files read or written besides the image and
+// the connection to the daemon are only taken from the command line of the
+// server, since any local process or web page can send requests.
+type loadRequestOptions struct {
+	CompareFields      []string
+	IgnoreFields       []string
+	NormalizeUser      bool
+	MatchLayers        bool
+	MatchByDiffIDs     bool
+	RetagOnConfigMatch bool
+	RequireLabels      map[string]string
+	OnConflict         string
+	TagIfAbsent        bool
+	VerifyLoaded       bool
+	NoCache            bool
+	SkipIfRunning      bool
+	FailOnEmptyLayers  bool
+	StripEnv           []string
+	StripLabels        []string
+	DropHistory        bool
+	DockerCompatConfig bool
+	ExcludePaths       []string
+	Squash             bool
+	LabelSource        bool
+	TarFormat          string
+	StrictManifest     bool
+	ResolveSymlinks    bool
+}
+
+// options returns the options of the load, connecting to the daemon as the
+// server does.
+func (r loadRequestOptions) options(server Options) Options {
+	return Options{
+		DockerHost:         server.DockerHost,
+		DockerConnFD:       server.DockerConnFD,
+		DockerContext:      server.DockerContext,
+		RegistryCache:      server.RegistryCache,
+		MaxRetries:         server.MaxRetries,
+		RetryBudget:        server.RetryBudget,
+		RetryableErrors:    server.RetryableErrors,
+		CompareFields:      r.CompareFields,
+		IgnoreFields:       r.IgnoreFields,
+		NormalizeUser:      r.NormalizeUser,
+		MatchLayers:        r.MatchLayers,
+		MatchByDiffIDs:     r.MatchByDiffIDs,
+		RetagOnConfigMatch: r.RetagOnConfigMatch,
+		RequireLabels:      r.RequireLabels,
+		OnConflict:         r.OnConflict,
+		TagIfAbsent:        r.TagIfAbsent,
+		VerifyLoaded:       r.VerifyLoaded,
+		NoCache:            r.NoCache,
+		SkipIfRunning:      r.SkipIfRunning,
+		FailOnEmptyLayers:  r.FailOnEmptyLayers,
+		StripEnv:           r.StripEnv,
+		StripLabels:        r.StripLabels,
+		DropHistory:        r.DropHistory,
+		DockerCompatConfig: r.DockerCompatConfig,
+		ExcludePaths:       r.ExcludePaths,
+		Squash:             r.Squash,
+		LabelSource:        r.LabelSource,
+		TarFormat:          r.TarFormat,
+		StrictManifest:     r.StrictManifest,
+		ResolveSymlinks:    r.ResolveSymlinks,
+	}
+}
+
+// loadErrorResponse is returned in the body when a load fails.
+type loadErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// loadServer handles load requests, de-duplicating identical requests that are
+// in flight at the same time.
+type loadServer struct {
+	load  func(ctx context.Context, image Image, repoTags []string, o Options) (DockerLoadAction, error)
+	group singleflight.Group
+
+	// joined, if set, is called once a request started the load of its key
+	// or joined the one in flight.
+	joined func()
+
+	// opts are the options of the server command line.
+	opts Options
+}
+
+// newLoadServer creates a loadServer that loads images with the given loader.
+func newLoadServer(loader *DockerLoader, o Options) *loadServer {
+	return &loadServer{
+		load: func(ctx context.Context, image Image, repoTags []string, o Options) (DockerLoadAction, error) {
+			loaderOpts, err := newDockerLoaderOpts(ctx, o)
+			if err != nil {
+				return DockerLoadAction{}, err
+			}
+			return loadImage(ctx, loader.WithOpts(loaderOpts), image, repoTags, o)
+		},
+		opts: o,
+	}
+}
+
+func (s *loadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONResponse(w, http.StatusMethodNotAllowed, loadErrorResponse{Error: "only POST is supported"})
+		return
+	}
+
+	// Browsers cannot send JSON to another origin without a preflight, which
+	// the server does not answer, so web pages cannot send loads.
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeJSONResponse(w, http.StatusUnsupportedMediaType, loadErrorResponse{Error: "the request must be application/json"})
+		return
+	}
+
+	req := loadRequest{}
+	decoder := encodingjson.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, loadErrorResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	o := req.Options.options(s.opts)
+
+	image, err := OpenImage(req.ImagePath, o.StrictManifest, o.ResolveSymlinks)
+	if err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, loadErrorResponse{Error: fmt.Sprintf("invalid image: %v", err)})
+		return
+	}
+
+	repoTags, err := resolveRepoTags(r.Context(), req.RepoTags, o)
+	if err != nil {
+		writeJSONResponse(w, http.StatusBadRequest, loadErrorResponse{Error: fmt.Sprintf("invalid repo tags: %v", err)})
+		return
+	}
+
+	// Requests for the same image, tags and options share a single load.
+	tags := append([]string(nil), repoTags...)
+	sort.Strings(tags)
+	optsJSON, err := encodingjson.Marshal(o)
+	if err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, loadErrorResponse{Error: err.Error()})
+		return
+	}
+	key := fmt.Sprintf("%s %s %x", image.Manifest.Config.Digest, strings.Join(tags, ","), sha256.Sum256(optsJSON))
+
+	results := s.group.DoChan(key, func() (interface{}, error) {
+		return s.load(context.Background(), image, repoTags, o)
+	})
+	if s.joined != nil {
+		s.joined()
+	}
+	result := <-results
+	if result.Err != nil {
+		writeJSONResponse(w, http.StatusInternalServerError, loadErrorResponse{Error: result.Err.Error()})
+		return
+	}
+	// The same form as the JSON output of the command line.
+	writeJSONResponse(w, http.StatusOK, result.Val.(DockerLoadAction).canonicalCopy())
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := encodingjson.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Could not write response:", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ServeTestSuite struct {
+	suite.Suite
+	image Image
+}
+
+func (suite *ServeTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+}
+
+func (suite *ServeTestSuite) post(url string, req loadRequest) *http.Response {
+	body, err := encodingjson.Marshal(req)
+	suite.Require().NoError(err)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	suite.Require().NoError(err)
+	return resp
+}
+
+func (suite *ServeTestSuite) TestLoadReturnsAction() {
+	server := &loadServer{
+		load: func(ctx context.Context, image Image, repoTags []string, o Options) (DockerLoadAction, error) {
+			return DockerLoadAction{Digest: strings.ToUpper(strings.TrimPrefix(image.Manifest.Config.Digest, "sha256:")), TagsAdded: repoTags}, nil
+		},
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp := suite.post(ts.URL, loadRequest{ImagePath: suite.image.Path, RepoTags: []string{"app:v1", "app:latest"}})
+	defer resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+
+	// The action is in the canonical form of the JSON output.
+	action := DockerLoadAction{}
+	suite.Require().NoError(encodingjson.NewDecoder(resp.Body).Decode(&action))
+	suite.Equal(suite.image.Manifest.Config.Digest, action.Digest)
+	suite.Equal([]string{"app:latest", "app:v1"}, action.TagsAdded)
+}
+
+func (suite *ServeTestSuite) TestConcurrentIdenticalRequestsShareLoad() {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	joined := make(chan struct{})
+	server := &loadServer{
+		load: func(ctx context.Context, image Image, repoTags []string, o Options) (DockerLoadAction, error) {
+			loads.Add(1)
+			<-release
+			return DockerLoadAction{Digest: image.Manifest.Config.Digest}, nil
+		},
+		joined: func() { joined <- struct{}{} },
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := suite.post(ts.URL, loadRequest{ImagePath: suite.image.Path, RepoTags: []string{"app:latest"}})
+			resp.Body.Close()
+		}()
+	}
+
+	// Released once every request joined the load in flight.
+	for i := 0; i < 3; i++ {
+		<-joined
+	}
+	close(release)
+	wg.Wait()
+	suite.Equal(int32(1), loads.Load())
+}
+
+func (suite *ServeTestSuite) TestRequestsWithOtherOptionsDoNotShareLoad() {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	server := &loadServer{
+		load: func(ctx context.Context, image Image, repoTags []string, o Options) (DockerLoadAction, error) {
+			loads.Add(1)
+			started <- struct{}{}
+			<-release
+			return DockerLoadAction{Digest: image.Manifest.Config.Digest}, nil
+		},
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	wg := sync.WaitGroup{}
+	for _, squash := range []bool{false, true} {
+		wg.Add(1)
+		go func(squash bool) {
+			defer wg.Done()
+			resp := suite.post(ts.URL, loadRequest{ImagePath: suite.image.Path, RepoTags: []string{"app:latest"}, Options: loadRequestOptions{Squash: squash}})
+			resp.Body.Close()
+		}(squash)
+	}
+
+	// Both loads are in flight at the same time.
+	<-started
+	<-started
+	close(release)
+	wg.Wait()
+	suite.Equal(int32(2), loads.Load())
+}
+
+func (suite *ServeTestSuite) TestRequestUsesServerConnection() {
+	var loaded Options
+	server := &loadServer{
+		load: func(ctx context.Context, image Image, repoTags []string, o Options) (DockerLoadAction, error) {
+			loaded = o
+			return DockerLoadAction{}, nil
+		},
+		opts: Options{DockerHost: "tcp://daemon:2375", MaxRetries: 3, PreLoadHook: "true"},
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	resp := suite.post(ts.URL, loadRequest{ImagePath: suite.image.Path, RepoTags: []string{"app"}, Options: loadRequestOptions{OnConflict: conflictSkip}})
+	resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.Equal(Options{DockerHost: "tcp://daemon:2375", MaxRetries: 3, OnConflict: conflictSkip}, loaded)
+}
+
+func (suite *ServeTestSuite) TestRejectsHookOptions() {
+	ts := httptest.NewServer(&loadServer{})
+	defer ts.Close()
+
+	body := `{"imagePath":"` + suite.image.Path + `","repoTags":["app"],"options":{"PreLoadHook":"touch /tmp/pwned"}}`
+	resp, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (suite *ServeTestSuite) TestRejectsNonJSON() {
+	ts := httptest.NewServer(&loadServer{})
+	defer ts.Close()
+
+	body := `{"imagePath":"` + suite.image.Path + `","repoTags":["app"]}`
+	resp, err := http.Post(ts.URL, "text/plain", strings.NewReader(body))
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	suite.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func (suite *ServeTestSuite) TestRejectsNonPost() {
+	ts := httptest.NewServer(&loadServer{})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	suite.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestServeTestSuite(t *testing.T) {
+	suite.Run(t, new(ServeTestSuite))
+}
@@ -0,0 +1,86 @@
+// Building the tar while the daemon is checked, for --speculative-build.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+// speculativeBuild is a build of the tar started along with the check of
+// the daemon, so the tar is ready by the time the check finds the image has
+// to be loaded. A nil speculativeBuild is never used.
+type speculativeBuild struct {
+	repoTags []string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	tarPath  string
+	err      error
+
+	// handled is set once the tar is either used or removed.
+	handled bool
+
+	// logger is the logger of the load the build is for.
+	logger *log.Logger
+}
+
+// startSpeculativeBuild builds the tar of the prepared image in the
+// background, with its own copy of the builder. The build reports no
+// progress, since it may be thrown away.
+func startSpeculativeBuild(ctx context.Context, i Image, builder ImageBuilder, o Options) *speculativeBuild {
+	o.Progress = nil
+	ctx, cancel := context.WithCancel(ctx)
+	s := &speculativeBuild{repoTags: builder.repoTags, cancel: cancel, done: make(chan struct{}), logger: logger(ctx)}
+	go func() {
+		defer close(s.done)
+		s.tarPath, s.err = buildTar(ctx, i, &builder, o)
+	}()
+	return s
+}
+
+// take waits for the build and returns the tar if it carries the repo tags.
+// A failed build, or a tar with other tags, is left for the caller to build
+// again.
+func (s *speculativeBuild) take(repoTags []string) (string, bool) {
+	if s == nil || s.handled {
+		return "", false
+	}
+	<-s.done
+	s.handled = true
+	s.cancel()
+	if s.err != nil {
+		s.logger.Println("Speculative build failed, building again:", s.err)
+		return "", false
+	}
+	if !slicesEqual(s.repoTags, repoTags) {
+		// Removed before the tar is rebuilt in the same staging dir.
+		s.remove()
+		return "", false
+	}
+	return s.tarPath, true
+}
+
+// discard cancels the build, unless its tar was used, without waiting for
+// it: the tar, if the build still completes, is removed in the background.
+func (s *speculativeBuild) discard() {
+	if s == nil || s.handled {
+		return
+	}
+	s.handled = true
+	s.cancel()
+	go func() {
+		<-s.done
+		s.remove()
+	}()
+}
+
+// remove removes the tar of the finished build, if any.
+func (s *speculativeBuild) remove() {
+	if s.err != nil {
+		return
+	}
+	s.logger.Println("Discarding speculatively built tar", s.tarPath)
+	if err := os.Remove(s.tarPath); err != nil {
+		s.logger.Println("Could not remove speculatively built tar:", err)
+	}
+}
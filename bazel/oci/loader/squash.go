@@ -0,0 +1,257 @@
+// Flattening of the image layers into a single layer.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// squashedFiles finds the layer each path of the flattened filesystem comes
+// from. The layers are walked from the top down: a path is taken from the
+// topmost layer having it, and whiteouts, opaque directories and files
+// replacing directories hide the paths of the layers below.
+type squashedFiles struct {
+	winners map[string]int
+	// hidden paths hide themselves and everything below them, opaque paths
+	// only what is below them.
+	hidden map[string]bool
+	opaque map[string]bool
+}
+
+func entryPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// isHidden reports whether an upper layer hides name.
+func (s *squashedFiles) isHidden(name string) bool {
+	if s.hidden[name] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if s.hidden[dir] || s.opaque[dir] {
+			return true
+		}
+	}
+	// An opaque root hides every path.
+	return s.opaque[""]
+}
+
+// addLayer records the paths the layer brings into the flattened filesystem.
+// What the layer hides only applies to the layers below it.
+func (s *squashedFiles) addLayer(layer int, headers []*tar.Header) {
+	hidden := []string{}
+	opaque := []string{}
+	for _, header := range headers {
+		name := entryPath(header.Name)
+		dir, base := path.Dir(name), path.Base(name)
+		if dir == "." {
+			dir = ""
+		}
+		switch {
+		case base == whiteoutOpaque:
+			opaque = append(opaque, dir)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			hidden = append(hidden, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		case name == "" || s.isHidden(name):
+			// Not in the flattened filesystem.
+		default:
+			if _, ok := s.winners[name]; !ok || s.winners[name] == layer {
+				s.winners[name] = layer
+				if header.Typeflag != tar.TypeDir {
+					// A file replaces whatever was below it.
+					hidden = append(hidden, name)
+				}
+			}
+		}
+	}
+	for _, name := range hidden {
+		s.hidden[name] = true
+	}
+	for _, name := range opaque {
+		s.opaque[name] = true
+	}
+}
+
+// hardLinkCopies finds the hard links of the flattened filesystem that have
+// to be written as regular files: those whose target is hidden by an upper
+// layer, and those whose target is replaced in a layer above the link's, which
+// is written after it. It returns them by layer, along with the paths whose
+// content the copies take, including the targets of hard links to them.
+func (s *squashedFiles) hardLinkCopies(layerHeaders [][]*tar.Header) (map[int]map[string]bool, map[string]bool) {
+	copies := map[int]map[string]bool{}
+	sources := map[string]bool{}
+	for k, headers := range layerHeaders {
+		for _, header := range headers {
+			name := entryPath(header.Name)
+			if winner, ok := s.winners[name]; header.Typeflag != tar.TypeLink || !ok || winner != k {
+				continue
+			}
+			target := entryPath(header.Linkname)
+			if winner, ok := s.winners[target]; ok && winner <= k {
+				continue
+			}
+			if copies[k] == nil {
+				copies[k] = map[string]bool{}
+			}
+			copies[k][name] = true
+			sources[target] = true
+		}
+	}
+	// The source of a copy may itself be a hard link.
+	for added := true; added; {
+		added = false
+		for _, headers := range layerHeaders {
+			for _, header := range headers {
+				target := entryPath(header.Linkname)
+				if header.Typeflag == tar.TypeLink && sources[entryPath(header.Name)] && !sources[target] {
+					sources[target] = true
+					added = true
+				}
+			}
+		}
+	}
+	return copies, sources
+}
+
+// squashLayers writes the layers of the image flattened into a single gzipped
+// layer into blobsDir, returning its descriptor and diff ID.
+func (i *Image) squashLayers(ctx context.Context, blobsDir string) (Descriptor, string, error) {
+	s := squashedFiles{winners: map[string]int{}, hidden: map[string]bool{}, opaque: map[string]bool{}}
+	layerHeaders := make([][]*tar.Header, len(i.Manifest.Layers))
+	for k := len(i.Manifest.Layers) - 1; k >= 0; k-- {
+		layer := i.Manifest.Layers[k]
+		err := readLayerEntries(i.BlobPath(layer.Digest), func(header *tar.Header, _ io.Reader) error {
+			layerHeaders[k] = append(layerHeaders[k], header)
+			return nil
+		})
+		if err != nil {
+			return Descriptor{}, "", fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+		}
+		s.addLayer(k, layerHeaders[k])
+	}
+	copies, sources := s.hardLinkCopies(layerHeaders)
+
+	out, err := os.CreateTemp(blobsDir, "layer-*")
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// The digest covers the blob as written, the diff ID the uncompressed tar.
+	blobHash := sha256.New()
+	diffHash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(out, blobHash))
+	tw := tar.NewWriter(io.MultiWriter(gz, diffHash))
+
+	// Written from the bottom up, so hard links come after their targets. The
+	// content of the files the copied hard links need is kept as the layers
+	// go by, so a copy gets the content its target had in the link's layer.
+	files := 0
+	contents := map[string][]byte{}
+	for k, layer := range i.Manifest.Layers {
+		err := readLayerEntries(i.BlobPath(layer.Digest), func(header *tar.Header, content io.Reader) error {
+			name := entryPath(header.Name)
+			if sources[name] {
+				switch header.Typeflag {
+				case tar.TypeReg:
+					data, err := io.ReadAll(content)
+					if err != nil {
+						return err
+					}
+					contents[name] = data
+					content = bytes.NewReader(data)
+				case tar.TypeLink:
+					contents[name] = contents[entryPath(header.Linkname)]
+				}
+			}
+			if winner, ok := s.winners[name]; !ok || winner != k {
+				return nil
+			}
+			if header.Typeflag == tar.TypeLink && copies[k][name] {
+				data, ok := contents[entryPath(header.Linkname)]
+				if !ok {
+					logger(ctx).Println("Dropping hard link", header.Name, "to missing file", header.Linkname)
+					return nil
+				}
+				logger(ctx).Println("Writing hard link", header.Name, "as a copy of", header.Linkname)
+				copied := *header
+				copied.Typeflag = tar.TypeReg
+				copied.Linkname = ""
+				copied.Size = int64(len(data))
+				header, content = &copied, bytes.NewReader(data)
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			files++
+			_, err := io.Copy(tw, content)
+			return err
+		})
+		if err != nil {
+			return Descriptor{}, "", fmt.Errorf("error squashing layer %s: %w", layer.Digest, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return Descriptor{}, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return Descriptor{}, "", err
+	}
+	if err := out.Close(); err != nil {
+		return Descriptor{}, "", err
+	}
+
+	squashed := Descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: hashDigest(blobHash)}
+	if info, err := os.Stat(out.Name()); err == nil {
+		squashed.Size = int(info.Size())
+	}
+	if err := os.Rename(out.Name(), filepath.Join(blobsDir, strings.TrimPrefix(squashed.Digest, "sha256:"))); err != nil {
+		return Descriptor{}, "", err
+	}
+	logger(ctx).Println("Squashed", len(i.Manifest.Layers), "layers into", squashed.Digest, "with", files, "entries")
+	return squashed, hashDigest(diffHash), nil
+}
+
+// squash replaces the layers of the image with a single flattened layer,
+// written into blobsDir. It returns the config update replacing the diff IDs,
+// which also turns the history entries into empty_layer entries followed by
+// one for the squashed layer.
+func (i *Image) squash(ctx context.Context, blobsDir string) (func(map[string]interface{}) error, error) {
+	layers := len(i.Manifest.Layers)
+	squashed, diffID, err := i.squashLayers(ctx, blobsDir)
+	if err != nil {
+		return nil, err
+	}
+	i.Manifest.Layers = []Descriptor{squashed}
+	i.PreparedBlobsDir = blobsDir
+
+	return func(configData map[string]interface{}) error {
+		rootfs, ok := configData["rootfs"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config json missing rootfs key")
+		}
+		rootfs["diff_ids"] = []interface{}{diffID}
+		if entries, ok := configData["history"].([]interface{}); ok {
+			for _, entry := range entries {
+				if fields, ok := entry.(map[string]interface{}); ok {
+					fields["empty_layer"] = true
+				}
+			}
+			configData["history"] = append(entries, map[string]interface{}{
+				"created_by": "loader --squash",
+				"comment":    fmt.Sprintf("squashed %d layers at load time", layers),
+			})
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SquashTestSuite struct {
+	suite.Suite
+	image Image
+}
+
+func (suite *SquashTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil,
+		testLayer{"etc/os-release": "debian", "etc/app.conf": "v1", "opt/cache/data.bin": "cache", "var/lib/a": "a"},
+		testLayer{"opt/cache/.wh.data.bin": "", "etc/app.conf": "v2", "app": "binary"},
+		testLayer{"var/lib/.wh..wh..opq": "", "var/lib/b": "b"},
+	)
+}
+
+// squashedImage prepares the image with Squash, returning it along with its
+// config.
+func (suite *SquashTestSuite) squashedImage() (Image, map[string]interface{}) {
+	image := suite.image
+	builder := NewImageBuilder(image.Manifest.Config.Digest, []string{"app:latest"})
+	builder.Edits = ConfigEdits{Squash: true}
+	suite.Require().NoError(builder.Prepare(context.Background(), &image))
+
+	configJSON, err := os.ReadFile(builder.ConfigPath)
+	suite.Require().NoError(err)
+	configData := map[string]interface{}{}
+	suite.Require().NoError(encodingjson.Unmarshal(configJSON, &configData))
+	return image, configData
+}
+
+// testTarEntry is an entry of a layer written by tarTestEntries: a hard link
+// to linkname if it has one, a regular file with content otherwise.
+type testTarEntry struct {
+	name     string
+	content  string
+	linkname string
+}
+
+// tarTestEntries returns the uncompressed tar with the entries, in order.
+func tarTestEntries(t *testing.T, entries ...testTarEntry) []byte {
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0o755, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		if entry.linkname != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0o755, Linkname: entry.linkname, Typeflag: tar.TypeLink}
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// squashedEntries returns the entries of the squashed layer of the image, by
+// name, as the type of the entry followed by its content.
+func (suite *SquashTestSuite) squashedEntries() map[string]string {
+	image, _ := suite.squashedImage()
+	suite.Require().Len(image.Manifest.Layers, 1)
+	entries := map[string]string{}
+	err := readLayerEntries(image.BlobPath(image.Manifest.Layers[0].Digest), func(header *tar.Header, content io.Reader) error {
+		data, err := io.ReadAll(content)
+		entries[header.Name] = string(header.Typeflag) + string(data)
+		return err
+	})
+	suite.Require().NoError(err)
+	return entries
+}
+
+func (suite *SquashTestSuite) TestSquashMergesFilesystem() {
+	image, configData := suite.squashedImage()
+	suite.NotEqual(suite.image.Manifest.Config.Digest, image.Manifest.Config.Digest)
+	suite.Require().Len(image.Manifest.Layers, 1)
+	suite.Len(configDiffIDs(configData), 1)
+
+	files := map[string]string{}
+	err := readLayerEntries(image.BlobPath(image.Manifest.Layers[0].Digest), func(header *tar.Header, content io.Reader) error {
+		data, err := io.ReadAll(content)
+		files[header.Name] = string(data)
+		return err
+	})
+	suite.Require().NoError(err)
+	suite.Equal(map[string]string{
+		"etc/os-release": "debian",
+		"etc/app.conf":   "v2",
+		"app":            "binary",
+		"var/lib/b":      "b",
+	}, files)
+}
+
+func (suite *SquashTestSuite) TestSquashKeepsHistoryAsEmptyLayers() {
+	setTestHistory(suite.T(), &suite.image, []interface{}{
+		map[string]interface{}{"created_by": "ADD rootfs.tar /"},
+		map[string]interface{}{"created_by": "RUN make"},
+		map[string]interface{}{"created_by": "RUN clean"},
+	})
+	_, configData := suite.squashedImage()
+	suite.Equal([]interface{}{
+		map[string]interface{}{"created_by": "ADD rootfs.tar /", "empty_layer": true},
+		map[string]interface{}{"created_by": "RUN make", "empty_layer": true},
+		map[string]interface{}{"created_by": "RUN clean", "empty_layer": true},
+		map[string]interface{}{"created_by": "loader --squash", "comment": "squashed 3 layers at load time"},
+	}, configData["history"])
+}
+
+func (suite *SquashTestSuite) TestSquashedImageLoads() {
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{Squash: true})
+	suite.Require().NoError(err)
+
+	loaded := cli.find("app:latest")
+	suite.Require().NotNil(loaded)
+	suite.Equal(action.Digest, loaded.ID)
+	suite.Len(loaded.RootFS.Layers, 1)
+}
+
+func (suite *SquashTestSuite) TestSquashCopiesHardLinkToHiddenFile() {
+	suite.image = writeTestImageTars(suite.T(), suite.T().TempDir(), nil,
+		tarTestEntries(suite.T(),
+			testTarEntry{name: "usr/bin/perl", content: "perl"},
+			testTarEntry{name: "usr/bin/perl5", linkname: "usr/bin/perl"},
+		),
+		tarTestEntries(suite.T(), testTarEntry{name: "usr/bin/.wh.perl"}),
+	)
+	suite.Equal(map[string]string{
+		"usr/bin/perl5": string(tar.TypeReg) + "perl",
+	}, suite.squashedEntries())
+}
+
+func (suite *SquashTestSuite) TestSquashCopiesHardLinkToReplacedFile() {
+	suite.image = writeTestImageTars(suite.T(), suite.T().TempDir(), nil,
+		tarTestEntries(suite.T(),
+			testTarEntry{name: "bin/a", content: "v1"},
+			testTarEntry{name: "bin/b", linkname: "bin/a"},
+			testTarEntry{name: "bin/c", linkname: "bin/b"},
+		),
+		tarTestEntries(suite.T(),
+			testTarEntry{name: "bin/a", content: "v2"},
+			testTarEntry{name: "bin/d", linkname: "bin/a"},
+		),
+	)
+	suite.Equal(map[string]string{
+		"bin/a": string(tar.TypeReg) + "v2",
+		"bin/b": string(tar.TypeReg) + "v1",
+		"bin/c": string(tar.TypeLink),
+		"bin/d": string(tar.TypeLink),
+	}, suite.squashedEntries())
+}
+
+func TestSquashTestSuite(t *testing.T) {
+	suite.Run(t, new(SquashTestSuite))
+}
@@ -0,0 +1,53 @@
+// Resolution of OCI layouts whose files are symlinks, as found in Bazel
+// runfiles and output trees.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// resolveLink returns the real path of the file at path, following every
+// symlink on the way. what names the file in the errors.
+func resolveLink(path, what string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		if target, linkErr := os.Readlink(path); linkErr == nil {
+			return "", fmt.Errorf("%s is a dangling symlink: %s points to %s, which does not exist", what, path, target)
+		}
+		return "", fmt.Errorf("%s is missing: %s does not exist", what, path)
+	}
+	return "", fmt.Errorf("error resolving %s: %w", what, err)
+}
+
+// ResolveSymlinks resolves the layout root and every blob the image refers
+// to, so a dangling symlink fails here, naming the missing blob, rather than
+// halfway through the build.
+func (i *Image) ResolveSymlinks() error {
+	root, err := resolveLink(i.Path, "OCI layout")
+	if err != nil {
+		return err
+	}
+	i.Path = root
+
+	digests := []string{i.Manifest.Config.Digest}
+	for _, layer := range i.Manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+
+	i.ResolvedBlobs = map[string]string{}
+	for _, digest := range digests {
+		resolved, err := resolveLink(i.BlobPath(digest), "blob "+digest)
+		if err != nil {
+			return err
+		}
+		i.ResolvedBlobs[digest] = resolved
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSymlinkedLayout writes the image into a separate store and returns an
+// OCI layout whose index.json and blobs are relative symlinks into it, the way
+// Bazel lays out runfiles.
+func writeSymlinkedLayout(t *testing.T) (string, Image) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store")
+	image := writeTestImage(t, store, nil, testLayer{"app": "binary"})
+
+	layout := filepath.Join(dir, "layout")
+	blobsDir := filepath.Join(layout, "blobs", "sha256")
+	require.NoError(t, os.MkdirAll(blobsDir, 0o755))
+	require.NoError(t, os.Symlink("../store/index.json", filepath.Join(layout, "index.json")))
+
+	blobs, err := os.ReadDir(filepath.Join(store, "blobs", "sha256"))
+	require.NoError(t, err)
+	for _, blob := range blobs {
+		target := filepath.Join("..", "..", "..", "store", "blobs", "sha256", blob.Name())
+		require.NoError(t, os.Symlink(target, filepath.Join(blobsDir, blob.Name())))
+	}
+	return layout, image
+}
+
+func TestSymlinkedLayoutLoads(t *testing.T) {
+	layout, original := writeSymlinkedLayout(t)
+	root := filepath.Join(filepath.Dir(layout), "root")
+	require.NoError(t, os.Symlink("layout", root))
+
+	image, err := OpenImage(root, true, true)
+	require.NoError(t, err)
+	require.Equal(t, original.Manifest, image.Manifest)
+	require.Equal(t, layout, image.Path)
+
+	_, entries := buildTestTar(t, image, TarFormatDocker)
+	layerDigest := image.Manifest.Layers[0].Digest
+	layer, err := os.ReadFile(original.BlobPath(layerDigest))
+	require.NoError(t, err)
+	require.Equal(t, layer, entries[blobName(layerDigest)+".tar.gz"])
+}
+
+func TestDanglingBlobSymlinkNamesTheBlob(t *testing.T) {
+	layout, image := writeSymlinkedLayout(t)
+	layerDigest := image.Manifest.Layers[0].Digest
+	require.NoError(t, os.Remove(image.BlobPath(layerDigest)))
+
+	_, err := OpenImage(layout, false, false)
+	require.NoError(t, err)
+
+	_, err = OpenImage(layout, false, true)
+	require.ErrorContains(t, err, "blob "+layerDigest+" is a dangling symlink")
+}
+
+func TestDanglingIndexSymlink(t *testing.T) {
+	layout, _ := writeSymlinkedLayout(t)
+	require.NoError(t, os.Remove(filepath.Join(filepath.Dir(layout), "store", "index.json")))
+
+	_, err := NewImage(layout)
+	require.ErrorContains(t, err, "index.json is a dangling symlink")
+}
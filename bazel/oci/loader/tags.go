@@ -0,0 +1,119 @@
+// Normalization of the repo tags requested for an image.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultTag is what Docker assumes for references without a tag.
+const defaultTag = "latest"
+
+// normalizeRepoTag returns the tag with an explicit ":latest" if it has none,
+// the way Docker interprets it. References by digest are returned as is.
+func normalizeRepoTag(tag string) string {
+	if strings.Contains(tag, "@") {
+		return tag
+	}
+	// A colon before the last slash belongs to the registry port.
+	if strings.Contains(tag[strings.LastIndex(tag, "/")+1:], ":") {
+		return tag
+	}
+	return tag + ":" + defaultTag
+}
+
+// normalizeRepoTags normalizes every tag, dropping the ones that end up
+// duplicated so that "foo" and "foo:latest" are only handled once.
+func normalizeRepoTags(ctx context.Context, tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, requested := range tags {
+		tag := normalizeRepoTag(requested)
+		if tag != requested {
+			logger(ctx).Println("Repo tag", requested, "has no tag, using", tag)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// varReference matches the ${VAR} references expanded in the repo tags.
+var varReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandRepoTags replaces ${VAR} references in the tags with the value from
+// vars, falling back to the environment. Only the braced form is expanded, so
+// a "$" on its own is left alone. Variables set to an empty value expand to
+// it, while unset variables are an error unless allowUnset is set, in which
+// case they expand to an empty string.
+func expandRepoTags(ctx context.Context, tags []string, vars map[string]string, lookupEnv func(string) (string, bool), allowUnset bool) ([]string, error) {
+	expanded := []string{}
+	for _, tag := range tags {
+		unset := []string{}
+		result := varReference.ReplaceAllStringFunc(tag, func(ref string) string {
+			name := varReference.FindStringSubmatch(ref)[1]
+			if value, ok := vars[name]; ok {
+				return value
+			}
+			value, ok := lookupEnv(name)
+			if !ok {
+				unset = append(unset, name)
+			}
+			return value
+		})
+
+		if len(unset) > 0 {
+			if !allowUnset {
+				return nil, fmt.Errorf("repo tag %q uses unset variables %v", tag, unset)
+			}
+			logger(ctx).Println("Warning: repo tag", tag, "uses unset variables", unset, "expanding them to empty")
+		}
+		expanded = append(expanded, result)
+	}
+	return expanded, nil
+}
+
+// resolveRepoTags expands the variables of the requested tags and normalizes
+// them, once for the whole run.
+func resolveRepoTags(ctx context.Context, tags []string, o Options) ([]string, error) {
+	expanded, err := expandRepoTags(ctx, tags, o.Vars, os.LookupEnv, o.AllowUnsetVars)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeRepoTags(ctx, expanded), nil
+}
+
+// readDigestFile reads the digest written by --digest-file at path.
+func readDigestFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading digest file: %w", err)
+	}
+	digest := strings.TrimSpace(string(data))
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("digest file %s does not hold a sha256 digest: %q", path, digest)
+	}
+	return digest, nil
+}
+
+// digestTags returns a tag naming the image by digest in every repository of
+// the tags. Tags cannot hold the colon of a digest, so "sha256:<hex>" becomes
+// "<repo>:sha256-<hex>".
+func digestTags(repoTags []string, digest string) []string {
+	tag := strings.Replace(digest, ":", "-", 1)
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, repoTag := range repoTags {
+		repo := repoName(repoTag)
+		if !seen[repo] {
+			seen[repo] = true
+			tags = append(tags, repo+":"+tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TagsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TagsTestSuite) TestTagWithoutTagPortionGetsLatest() {
+	suite.Equal("foo:latest", normalizeRepoTag("foo"))
+	suite.Equal("foo:latest", normalizeRepoTag("foo:latest"))
+	suite.Equal("foo:v1", normalizeRepoTag("foo:v1"))
+}
+
+func (suite *TagsTestSuite) TestRegistryPortIsNotATag() {
+	suite.Equal("localhost:5000/foo:latest", normalizeRepoTag("localhost:5000/foo"))
+	suite.Equal("localhost:5000/foo:v1", normalizeRepoTag("localhost:5000/foo:v1"))
+}
+
+func (suite *TagsTestSuite) TestDigestReferenceIsUnchanged() {
+	ref := "foo@sha256:3c2f6b3c1a7c0c4e0d7d7f9f2a1b5e6d8c9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c"
+	suite.Equal(ref, normalizeRepoTag(ref))
+}
+
+func (suite *TagsTestSuite) TestImplicitAndExplicitLatestAreTheSameTag() {
+	suite.Equal([]string{"foo:latest", "bar:v1"}, normalizeRepoTags(context.Background(), []string{"foo", "bar:v1", "foo:latest"}))
+}
+
+// lookupTestEnv looks variables up in env instead of the environment.
+func lookupTestEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func (suite *TagsTestSuite) TestExpandFromEnv() {
+	env := map[string]string{"GIT_SHA": "abc123"}
+	tags, err := expandRepoTags(context.Background(), []string{"myrepo:${GIT_SHA}", "myrepo:latest"}, nil, lookupTestEnv(env), false)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"myrepo:abc123", "myrepo:latest"}, tags)
+}
+
+func (suite *TagsTestSuite) TestVarsOverrideEnv() {
+	env := map[string]string{"GIT_SHA": "abc123"}
+	vars := map[string]string{"GIT_SHA": "def456", "REGISTRY": "localhost:5000"}
+	tags, err := expandRepoTags(context.Background(), []string{"${REGISTRY}/myrepo:${GIT_SHA}"}, vars, lookupTestEnv(env), false)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"localhost:5000/myrepo:def456"}, tags)
+}
+
+func (suite *TagsTestSuite) TestUnsetVarIsAnError() {
+	_, err := expandRepoTags(context.Background(), []string{"myrepo:${GIT_SHA}"}, nil, lookupTestEnv(nil), false)
+	suite.ErrorContains(err, "GIT_SHA")
+}
+
+func (suite *TagsTestSuite) TestUnsetVarAllowed() {
+	tags, err := expandRepoTags(context.Background(), []string{"myrepo:dev${SUFFIX}"}, nil, lookupTestEnv(nil), true)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"myrepo:dev"}, tags)
+}
+
+func (suite *TagsTestSuite) TestEmptyVarIsSet() {
+	env := map[string]string{"SUFFIX": ""}
+	tags, err := expandRepoTags(context.Background(), []string{"myrepo:dev${SUFFIX}"}, nil, lookupTestEnv(env), false)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"myrepo:dev"}, tags)
+}
+
+func (suite *TagsTestSuite) TestOnlyBracedVarsAreExpanded() {
+	env := map[string]string{"GIT_SHA": "abc123"}
+	tags, err := expandRepoTags(context.Background(), []string{"myrepo:$GIT_SHA", "myrepo:${GIT_SHA}"}, nil, lookupTestEnv(env), false)
+	suite.Require().NoError(err)
+	suite.Equal([]string{"myrepo:$GIT_SHA", "myrepo:abc123"}, tags)
+}
+
+func (suite *TagsTestSuite) TestReadDigestFile() {
+	dir := suite.T().TempDir()
+	path := filepath.Join(dir, "image.digest")
+	suite.Require().NoError(writeDigestFile(path, testDigest))
+	digest, err := readDigestFile(path)
+	suite.Require().NoError(err)
+	suite.Equal(testDigest, digest)
+
+	_, err = readDigestFile(filepath.Join(dir, "missing.digest"))
+	suite.ErrorContains(err, "error reading digest file")
+
+	suite.Require().NoError(os.WriteFile(path, []byte("not a digest\n"), 0o644))
+	_, err = readDigestFile(path)
+	suite.ErrorContains(err, `does not hold a sha256 digest: "not a digest"`)
+}
+
+func (suite *TagsTestSuite) TestDigestTags() {
+	tags := digestTags([]string{"app:v1", "app", "localhost:5000/team/api:latest"}, testDigest)
+	suite.Equal([]string{
+		"app:sha256-" + strings.TrimPrefix(testDigest, "sha256:"),
+		"localhost:5000/team/api:sha256-" + strings.TrimPrefix(testDigest, "sha256:"),
+	}, tags)
+}
+
+func TestTagsTestSuite(t *testing.T) {
+	suite.Run(t, new(TagsTestSuite))
+}
@@ -0,0 +1,104 @@
+// OpenTelemetry spans for the phases of the load.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/juanique/monorepo/bazel/oci/loader"
+
+// Attributes of the spans.
+const (
+	attrDigest    = attribute.Key("loader.digest")
+	attrImageSize = attribute.Key("loader.image_size")
+	attrOutcome   = attribute.Key("loader.outcome")
+)
+
+var (
+	// tracer creates the spans of the load. It does nothing unless
+	// --otel-endpoint is set.
+	tracer trace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+	// traceParent is the span of the build running the loader, from the
+	// TRACEPARENT environment variable, if any.
+	traceParent trace.SpanContext
+	// shutdownTracing flushes the spans, if --otel-endpoint is set.
+	shutdownTracing func(context.Context) error
+)
+
+// tracingFlushTimeout bounds the export of the pending spans on exit, so an
+// unreachable collector does not hold up the loader.
+const tracingFlushTimeout = 5 * time.Second
+
+// setupTracing exports the spans over OTLP/HTTP to the endpoint, e.g.
+// http://localhost:4318, or localhost:4318 for plain HTTP.
+func setupTracing(endpoint string) error {
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint)}
+	if !strings.Contains(endpoint, "://") {
+		exporterOpts = []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure()}
+	}
+	exporter, err := otlptracehttp.New(context.Background(), exporterOpts...)
+	if err != nil {
+		return fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+	useSpanExporter(exporter)
+
+	carrier := propagation.MapCarrier{"traceparent": os.Getenv("TRACEPARENT")}
+	traceParent = trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	return nil
+}
+
+// useSpanExporter exports the spans with the exporter, in batches so the
+// exports do not slow the load down. flushTracing exports the last batch.
+func useSpanExporter(exporter sdktrace.SpanExporter) {
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	tracer = provider.Tracer(tracerName)
+	shutdownTracing = provider.Shutdown
+}
+
+// flushTracing exports the pending spans and stops the exporter, if any. It
+// must run before the process exits, including through os.Exit, or the last
+// batch of spans is lost.
+func flushTracing() {
+	if shutdownTracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Println("Could not export the spans:", err)
+	}
+	shutdownTracing = nil
+}
+
+// startSpan starts a span of the load with the attributes. Spans without a
+// parent in ctx join the trace of the build running the loader.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if traceParent.IsValid() && !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, traceParent)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, recording the outcome or the error.
+func endSpan(span trace.Span, outcome string, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		outcome = "error"
+	}
+	span.SetAttributes(attrOutcome.String(outcome))
+	span.End()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type TelemetryTestSuite struct {
+	suite.Suite
+	image    Image
+	exporter *tracetest.InMemoryExporter
+}
+
+func (suite *TelemetryTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	suite.exporter = tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(suite.exporter))
+	previous := tracer
+	tracer = provider.Tracer(tracerName)
+	suite.T().Cleanup(func() {
+		tracer = previous
+		traceParent = trace.SpanContext{}
+	})
+}
+
+// spans returns the attributes of the ended spans by name.
+func (suite *TelemetryTestSuite) spans() map[string]map[attribute.Key]attribute.Value {
+	spans := map[string]map[attribute.Key]attribute.Value{}
+	for _, span := range suite.exporter.GetSpans() {
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, attr := range span.Attributes {
+			attrs[attr.Key] = attr.Value
+		}
+		spans[span.Name] = attrs
+	}
+	return spans
+}
+
+// recordingExporter keeps the names of the exported spans, which the
+// InMemoryExporter forgets on shutdown.
+type recordingExporter struct {
+	names []string
+}
+
+func (e *recordingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, span := range spans {
+		e.names = append(e.names, span.Name())
+	}
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func (suite *TelemetryTestSuite) TestFlushExportsBatchedSpans() {
+	exporter := &recordingExporter{}
+	useSpanExporter(exporter)
+	suite.T().Cleanup(func() { shutdownTracing = nil })
+
+	_, span := startSpan(context.Background(), "Load")
+	endSpan(span, "loaded", nil)
+	flushTracing()
+	suite.Equal([]string{"Load"}, exporter.names)
+	suite.Nil(shutdownTracing)
+
+	// Flushing again does nothing.
+	flushTracing()
+}
+
+func (suite *TelemetryTestSuite) TestLoadSpans() {
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(), DockerLoaderOpts{})
+	action, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{})
+	suite.Require().NoError(err)
+
+	spans := suite.spans()
+	suite.Require().Contains(spans, "CheckImageExists")
+	suite.Equal("not_found", spans["CheckImageExists"][attrOutcome].AsString())
+	suite.Require().Contains(spans, "Build")
+	suite.Equal(action.Digest, spans["Build"][attrDigest].AsString())
+	suite.Positive(spans["Build"][attrImageSize].AsInt64())
+	suite.Equal("built", spans["Build"][attrOutcome].AsString())
+	suite.Require().Contains(spans, "LoadTarIntoDocker")
+	suite.Equal(action.Digest, spans["LoadTarIntoDocker"][attrDigest].AsString())
+	suite.Positive(spans["LoadTarIntoDocker"][attrImageSize].AsInt64())
+	suite.Equal("loaded", spans["LoadTarIntoDocker"][attrOutcome].AsString())
+
+}
+
+func (suite *TelemetryTestSuite) TestLoadedImageSpans() {
+	cli := newFakeDockerAPI(types.ImageInspect{ID: suite.image.Manifest.Config.Digest})
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{})
+	suite.Require().NoError(err)
+
+	spans := suite.spans()
+	suite.Equal("found", spans["CheckImageExists"][attrOutcome].AsString())
+	suite.Equal("tagged", spans["ensureTags"][attrOutcome].AsString())
+	suite.NotContains(spans, "Build")
+	suite.NotContains(spans, "LoadTarIntoDocker")
+}
+
+func (suite *TelemetryTestSuite) TestFailedSpan() {
+	cli := newFakeDockerAPI()
+	cli.loadResponse = `{"errorDetail":{"message":"no space left on device"}}`
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{})
+	suite.Require().Error(err)
+
+	suite.Equal("error", suite.spans()["LoadTarIntoDocker"][attrOutcome].AsString())
+}
+
+func (suite *TelemetryTestSuite) TestSpansJoinTraceParent() {
+	traceParent = trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	loader := newDockerLoaderWithAPI(newFakeDockerAPI(), DockerLoaderOpts{})
+	_, err := loadImage(context.Background(), loader, suite.image, []string{"app"}, Options{})
+	suite.Require().NoError(err)
+
+	spans := suite.exporter.GetSpans()
+	suite.Require().NotEmpty(spans)
+	for _, span := range spans {
+		suite.Equal(traceParent.TraceID(), span.SpanContext.TraceID(), span.Name)
+	}
+}
+
+func TestTelemetryTestSuite(t *testing.T) {
+	suite.Run(t, new(TelemetryTestSuite))
+}
@@ -0,0 +1,136 @@
+// Verification of layer blobs against the digests in the manifest.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/juanique/monorepo/salsa/go/json"
+)
+
+// verifyCacheFile is the name of the verification cache inside the cache dir.
+const verifyCacheFile = "verified_layers.json"
+
+// verifiedLayer records that the file at a path had the given digest when it
+// had the given size and modification time.
+type verifiedLayer struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	Digest  string `json:"digest"`
+}
+
+// LayerVerifier checks that layer blobs match their manifest digests. When it
+// has a cache dir, layers whose size and modification time did not change
+// since they were last verified are not hashed again.
+type LayerVerifier struct {
+	cacheDir string
+
+	// hashFile computes the digest of a file, replaceable in tests.
+	hashFile func(path string) (string, error)
+}
+
+// NewLayerVerifier creates a LayerVerifier caching its results in cacheDir. An
+// empty cacheDir disables the cache.
+func NewLayerVerifier(cacheDir string) *LayerVerifier {
+	return &LayerVerifier{cacheDir: cacheDir, hashFile: sha256File}
+}
+
+// Verify checks every layer of the image, returning an error for the first
+// layer that does not match its digest.
+func (v *LayerVerifier) Verify(ctx context.Context, i Image) error {
+	cache := v.loadCache(ctx)
+
+	for _, layer := range i.Manifest.Layers {
+		path := i.BlobPath(layer.Digest)
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("error reading layer %s: %w", layer.Digest, err)
+		}
+
+		cached, ok := cache[path]
+		if ok && cached.Size == info.Size() && cached.ModTime == info.ModTime().UnixNano() && cached.Digest == layer.Digest {
+			continue
+		}
+
+		digest, err := v.hashFile(path)
+		if err != nil {
+			return fmt.Errorf("error hashing layer %s: %w", layer.Digest, err)
+		}
+		if digest != layer.Digest {
+			return fmt.Errorf("layer %s does not match its digest, got %s", path, digest)
+		}
+		cache[path] = verifiedLayer{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Digest: digest}
+	}
+
+	v.saveCache(ctx, cache)
+	return nil
+}
+
+// loadCache reads the verification cache. A missing or unreadable cache is
+// treated as empty, so every layer gets verified.
+func (v *LayerVerifier) loadCache(ctx context.Context) map[string]verifiedLayer {
+	cache := map[string]verifiedLayer{}
+	if v.cacheDir == "" {
+		return cache
+	}
+
+	path := filepath.Join(v.cacheDir, verifyCacheFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return cache
+	}
+	if err := json.FromFile(path, &cache); err != nil {
+		logger(ctx).Println("Ignoring unreadable layer verification cache:", err)
+		return map[string]verifiedLayer{}
+	}
+	return cache
+}
+
+// saveCache writes the verification cache. Failing to write it only costs
+// hashing the layers again next time.
+func (v *LayerVerifier) saveCache(ctx context.Context, cache map[string]verifiedLayer) {
+	if v.cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(v.cacheDir, 0o755); err != nil {
+		logger(ctx).Println("Could not create layer verification cache dir:", err)
+		return
+	}
+
+	// Write to a temporary file first so concurrent runs never read a partial
+	// cache.
+	tmp, err := os.CreateTemp(v.cacheDir, verifyCacheFile+".*")
+	if err != nil {
+		logger(ctx).Println("Could not write layer verification cache:", err)
+		return
+	}
+	tmp.Close()
+	if err := json.ToFile(tmp.Name(), cache); err != nil {
+		logger(ctx).Println("Could not write layer verification cache:", err)
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(v.cacheDir, verifyCacheFile)); err != nil {
+		logger(ctx).Println("Could not write layer verification cache:", err)
+		os.Remove(tmp.Name())
+	}
+}
+
+// sha256File returns the digest of the file contents.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
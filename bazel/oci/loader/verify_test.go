@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type VerifyTestSuite struct {
+	suite.Suite
+	image    Image
+	cacheDir string
+	hashed   int
+}
+
+func (suite *VerifyTestSuite) SetupTest() {
+	suite.image = writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	suite.cacheDir = suite.T().TempDir()
+	suite.hashed = 0
+}
+
+// newVerifier returns a LayerVerifier that counts how many layers it hashes.
+func (suite *VerifyTestSuite) newVerifier() *LayerVerifier {
+	v := NewLayerVerifier(suite.cacheDir)
+	v.hashFile = func(path string) (string, error) {
+		suite.hashed++
+		return sha256File(path)
+	}
+	return v
+}
+
+func (suite *VerifyTestSuite) TestUnchangedLayerIsNotHashedAgain() {
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Equal(1, suite.hashed)
+
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Equal(1, suite.hashed)
+}
+
+func (suite *VerifyTestSuite) TestModifiedLayerIsHashedAgain() {
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+
+	layerPath := suite.image.BlobPath(suite.image.Manifest.Layers[0].Digest)
+	suite.Require().NoError(os.WriteFile(layerPath, []byte("corrupted"), 0o644))
+	suite.Require().NoError(os.Chtimes(layerPath, time.Now(), time.Now().Add(time.Hour)))
+
+	suite.Error(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Equal(2, suite.hashed)
+}
+
+func (suite *VerifyTestSuite) TestCorruptCacheFallsBackToFullVerification() {
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Require().NoError(os.WriteFile(filepath.Join(suite.cacheDir, verifyCacheFile), []byte("{not json"), 0o644))
+
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Equal(2, suite.hashed)
+}
+
+func (suite *VerifyTestSuite) TestWithoutCacheDirAlwaysHashes() {
+	suite.cacheDir = ""
+
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Require().NoError(suite.newVerifier().Verify(context.Background(), suite.image))
+	suite.Equal(2, suite.hashed)
+}
+
+func TestVerifyTestSuite(t *testing.T) {
+	suite.Run(t, new(VerifyTestSuite))
+}
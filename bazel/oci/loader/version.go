@@ -0,0 +1,82 @@
+// Checking of the Docker daemon version against a minimum requirement.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// versionGetter is the part of the Docker client used to read the daemon
+// version.
+type versionGetter interface {
+	ServerVersion(ctx context.Context) (types.Version, error)
+}
+
+// parseDaemonVersion returns the numeric components of a Docker version.
+// Docker versions are not strict semver: they may have a "v" prefix, zero
+// padded components ("17.06.2") and suffixes such as "-ce" or "-rc.1", which
+// are ignored.
+func parseDaemonVersion(version string) ([]int, error) {
+	trimmed := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if end := strings.IndexAny(trimmed, "-+~ "); end >= 0 {
+		trimmed = trimmed[:end]
+	}
+
+	parts := []int{}
+	for _, part := range strings.Split(trimmed, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Docker version %q", version)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// compareVersions returns -1, 0 or 1 if a is lower, equal or greater than b.
+// Missing components count as zero.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		x, y := 0, 0
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkDaemonVersion fails unless the daemon version satisfies requirement,
+// given as a minimum version such as ">=24.0" or just "24.0".
+func checkDaemonVersion(ctx context.Context, cli versionGetter, requirement string) error {
+	required, err := parseDaemonVersion(strings.TrimPrefix(strings.TrimSpace(requirement), ">="))
+	if err != nil {
+		return fmt.Errorf("invalid daemon version requirement %q: %w", requirement, err)
+	}
+
+	version, err := cli.ServerVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting the Docker daemon version: %w", err)
+	}
+	actual, err := parseDaemonVersion(version.Version)
+	if err != nil {
+		return err
+	}
+
+	if compareVersions(actual, required) < 0 {
+		return fmt.Errorf("Docker daemon version %s does not satisfy the required %s", version.Version, requirement)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/suite"
+)
+
+type VersionTestSuite struct {
+	suite.Suite
+}
+
+// fakeVersionGetter reports a fixed daemon version.
+type fakeVersionGetter string
+
+func (f fakeVersionGetter) ServerVersion(ctx context.Context) (types.Version, error) {
+	return types.Version{Version: string(f)}, nil
+}
+
+func (suite *VersionTestSuite) TestParseDaemonVersion() {
+	for version, want := range map[string][]int{
+		"24.0.7":       {24, 0, 7},
+		"v25.0.0":      {25, 0, 0},
+		"17.06.2-ce":   {17, 6, 2},
+		"26.1.0-rc.1":  {26, 1, 0},
+		"1.13.1+dirty": {1, 13, 1},
+	} {
+		got, err := parseDaemonVersion(version)
+		suite.Require().NoError(err, version)
+		suite.Equal(want, got, version)
+	}
+
+	_, err := parseDaemonVersion("dev")
+	suite.Error(err)
+}
+
+func (suite *VersionTestSuite) TestDaemonVersionSatisfiesRequirement() {
+	ctx := context.Background()
+	suite.NoError(checkDaemonVersion(ctx, fakeVersionGetter("24.0.7"), ">=24.0"))
+	suite.NoError(checkDaemonVersion(ctx, fakeVersionGetter("24.0.0"), ">=24.0"))
+	suite.NoError(checkDaemonVersion(ctx, fakeVersionGetter("25.0.2"), "24"))
+}
+
+func (suite *VersionTestSuite) TestDaemonVersionBelowRequirement() {
+	ctx := context.Background()
+	suite.ErrorContains(checkDaemonVersion(ctx, fakeVersionGetter("20.10.21"), ">=24.0"), "does not satisfy")
+	suite.Error(checkDaemonVersion(ctx, fakeVersionGetter("17.06.2-ce"), ">=17.6.3"))
+	suite.Error(checkDaemonVersion(ctx, fakeVersionGetter("24.0.7"), ">=latest"))
+}
+
+func TestVersionTestSuite(t *testing.T) {
+	suite.Run(t, new(VersionTestSuite))
+}
@@ -0,0 +1,168 @@
+// Preloading of base images so that derived images reuse their layers.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/juanique/monorepo/salsa/go/json"
+	"github.com/spf13/cobra"
+)
+
+// warmCacheRepo is the repository the base images loaded by warm-cache are
+// tagged in. Their layers count as already present when loading other images.
+const warmCacheRepo = "oci-loader-warm-cache"
+
+// warmDedupLayers loads the missing base images from a single tar packing
+// their shared layers once.
+var warmDedupLayers bool
+
+var warmCacheCmd = &cobra.Command{
+	Use:   "warm-cache <baseImagePath...>",
+	Short: "warm-cache loads base images so that images built on them reuse their layers",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		loaderOpts, err := newDockerLoaderOpts(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		loader, err := NewDockerLoader(loaderOpts)
+		if err != nil {
+			return err
+		}
+		if warmDedupLayers {
+			return warmCacheShared(context.Background(), loader, args, cmd.OutOrStdout())
+		}
+		return warmCache(context.Background(), loader, args, cmd.OutOrStdout())
+	},
+}
+
+// warmCacheTag is the tag a base image is loaded under, so that loading the
+// same base image again is a no-op.
+func warmCacheTag(i Image) string {
+	id := strings.TrimPrefix(i.Manifest.Config.Digest, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return warmCacheRepo + ":" + id
+}
+
+// warmCache loads the base images at the given paths, writing the layers each
+// of them made present to w.
+func warmCache(ctx context.Context, loader *DockerLoader, paths []string, w io.Writer) error {
+	for _, path := range paths {
+		image, err := OpenImage(path, false, false)
+		if err != nil {
+			return err
+		}
+		tag := warmCacheTag(image)
+		action, err := loadImage(ctx, loader, image, []string{tag}, Options{})
+		if err != nil {
+			return fmt.Errorf("error loading base image %s: %w", path, err)
+		}
+
+		configData := map[string]interface{}{}
+		if err := json.FromFile(image.ConfigBlobPath(), &configData); err != nil {
+			return fmt.Errorf("failed to read config: %w", err)
+		}
+		writeWarmedImage(w, path, tag, configDiffIDs(configData), action.LayerStats)
+	}
+	return nil
+}
+
+// writeWarmedImage writes the layers a base image made present to w.
+func writeWarmedImage(w io.Writer, path, tag string, diffIDs []string, stats LayerStats) {
+	fmt.Fprintf(w, "%s as %s: %d layers present (%d loaded, %d already present)\n",
+		path, tag, len(diffIDs), stats.LayersLoaded, stats.LayersReused)
+	for _, diffID := range diffIDs {
+		fmt.Fprintln(w, "  "+diffID)
+	}
+}
+
+// warmCacheShared is warmCache loading all the missing base images at once,
+// from a tar that packs the layers they share a single time. The savings are
+// written to w after the images.
+func warmCacheShared(ctx context.Context, loader *DockerLoader, paths []string, w io.Writer) error {
+	pending := []preparedImage{}
+	pendingPaths := []string{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		image, err := OpenImage(path, false, false)
+		if err != nil {
+			return err
+		}
+		tag := warmCacheTag(image)
+		p, err := prepareForLoad(ctx, image, []string{tag}, Options{})
+		if err != nil {
+			return fmt.Errorf("error preparing base image %s: %w", path, err)
+		}
+		diffIDs := configDiffIDs(p.ConfigData)
+		if seen[p.ID] {
+			writeWarmedImage(w, path, tag, diffIDs, LayerStats{LayersReused: len(diffIDs)})
+			continue
+		}
+		seen[p.ID] = true
+
+		found, _, err := loader.CheckImageExists(ctx, p.ID, p.ConfigData, p.RepoTags)
+		if err != nil {
+			return fmt.Errorf("error checking base image %s: %w", path, err)
+		}
+		if found {
+			writeWarmedImage(w, path, tag, diffIDs, LayerStats{LayersReused: len(diffIDs)})
+			continue
+		}
+		pending = append(pending, p)
+		pendingPaths = append(pendingPaths, path)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	existingLayers := loader.warmLayerChains(ctx)
+	tarPath, stats, err := buildSharedTar(ctx, pending, BuildOpts{})
+	if err != nil {
+		return err
+	}
+	// The tar loads every pending image, the first one is only the one
+	// checked for.
+	first := pending[0]
+	if _, err := loader.LoadTarIntoDocker(ctx, tarPath, first.Image.Manifest.Config.Digest, first.RepoTags); err != nil {
+		return fmt.Errorf("error loading base images: %w", err)
+	}
+
+	for k, p := range pending {
+		diffIDs := configDiffIDs(p.ConfigData)
+		layerStats := computeLayerStats(p.Image.Manifest.Layers, diffIDs, existingLayers)
+		writeWarmedImage(w, pendingPaths[k], p.RepoTags[0], diffIDs, layerStats)
+	}
+	fmt.Fprintln(w, stats)
+	return nil
+}
+
+// warmLayerChains returns the layer diff IDs of the base images loaded by
+// warm-cache.
+func (d *DockerLoader) warmLayerChains(ctx context.Context) [][]string {
+	var images []types.ImageSummary
+	err := d.opts.Retry.Do(ctx, "image list", func() error {
+		var err error
+		images, err = d.cli.ImageList(ctx, types.ImageListOptions{Filters: filters.NewArgs(filters.Arg("reference", warmCacheRepo))})
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+
+	chains := [][]string{}
+	for _, summary := range images {
+		inspect, err := d.inspectImage(ctx, summary.ID)
+		if err != nil {
+			continue
+		}
+		chains = append(chains, inspect.RootFS.Layers)
+	}
+	return chains
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	encodingjson "encoding/json"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type WarmCacheTestSuite struct {
+	suite.Suite
+}
+
+func (suite *WarmCacheTestSuite) TestDerivedImageReusesWarmedLayers() {
+	base := testLayer{"etc/os-release": "debian"}
+	baseImage := writeTestImage(suite.T(), suite.T().TempDir(), nil, base)
+	derived := writeTestImage(suite.T(), suite.T().TempDir(), nil, base, testLayer{"app": "binary"})
+
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	out := bytes.Buffer{}
+	suite.Require().NoError(warmCache(context.Background(), loader, []string{baseImage.Path}, &out))
+	suite.Contains(out.String(), warmCacheTag(baseImage)+": 1 layers present (1 loaded, 0 already present)")
+
+	action, err := loadImage(context.Background(), loader, derived, []string{"app"}, Options{})
+	suite.Require().NoError(err)
+	suite.Equal(1, action.LayersReused)
+	suite.Equal(1, action.LayersLoaded)
+}
+
+func (suite *WarmCacheTestSuite) TestWarmingTwiceLoadsOnce() {
+	baseImage := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"etc/os-release": "debian"})
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	paths := []string{baseImage.Path, baseImage.Path}
+	suite.Require().NoError(warmCache(context.Background(), loader, paths, &bytes.Buffer{}))
+	suite.Len(cli.loadedTars, 1)
+}
+
+func (suite *WarmCacheTestSuite) TestDedupLayersPacksSharedLayerOnce() {
+	base := testLayer{"etc/os-release": "debian"}
+	first := writeTestImage(suite.T(), suite.T().TempDir(), nil, base, testLayer{"usr/bin/python": "python"})
+	second := writeTestImage(suite.T(), suite.T().TempDir(), nil, base, testLayer{"usr/bin/node": "node"})
+
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+	out := bytes.Buffer{}
+	paths := []string{first.Path, second.Path}
+	suite.Require().NoError(warmCacheShared(context.Background(), loader, paths, &out))
+	suite.Require().Len(cli.loadedTars, 1)
+
+	tarPath := filepath.Join(suite.T().TempDir(), "image.tar")
+	suite.Require().NoError(os.WriteFile(tarPath, []byte(cli.loadedTars[0]), 0o644))
+	entries := readTestTar(suite.T(), tarPath)
+	baseLayer := blobName(first.Manifest.Layers[0].Digest) + ".tar.gz"
+	suite.Contains(entries, baseLayer)
+	suite.Len(entries, 6, "two configs, three distinct layers and manifest.json")
+
+	manifests := []OutputManifest{}
+	suite.Require().NoError(encodingjson.Unmarshal(entries["manifest.json"], &manifests))
+	suite.Require().Len(manifests, 2)
+	suite.Equal(baseLayer, manifests[0].Layers[0])
+	suite.Equal(baseLayer, manifests[1].Layers[0])
+
+	for _, image := range []Image{first, second} {
+		suite.NotNil(cli.find(warmCacheTag(image)))
+	}
+	suite.Contains(out.String(), "Packed 3 layers for 2 images, sharing 1 layers")
+}
+
+func (suite *WarmCacheTestSuite) TestDedupLayersSkipsLoadedImages() {
+	baseImage := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"etc/os-release": "debian"})
+	cli := newFakeDockerAPI()
+	loader := newDockerLoaderWithAPI(cli, DockerLoaderOpts{})
+
+	paths := []string{baseImage.Path}
+	suite.Require().NoError(warmCacheShared(context.Background(), loader, paths, &bytes.Buffer{}))
+	out := bytes.Buffer{}
+	suite.Require().NoError(warmCacheShared(context.Background(), loader, append(paths, baseImage.Path), &out))
+	suite.Len(cli.loadedTars, 1)
+	suite.Contains(out.String(), warmCacheTag(baseImage)+": 1 layers present (0 loaded, 1 already present)")
+}
+
+func TestWarmCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(WarmCacheTestSuite))
+}
@@ -0,0 +1,261 @@
+// Bazel persistent worker mode, handling many loads with one Docker client.
+// See https://bazel.build/remote/persistent for the protocol.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// workRequest holds the fields of the Bazel WorkRequest proto used here.
+type workRequest struct {
+	Arguments []string
+	RequestID int32
+	Cancel    bool
+}
+
+// workResponse is the Bazel WorkResponse proto.
+type workResponse struct {
+	ExitCode  int32
+	Output    string
+	RequestID int32
+}
+
+// readWorkRequest reads the next length delimited WorkRequest.
+func readWorkRequest(r *bufio.Reader) (workRequest, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return workRequest{}, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return workRequest{}, err
+	}
+
+	req := workRequest{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return req, fmt.Errorf("invalid work request: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var arg []byte
+			arg, n = protowire.ConsumeBytes(b)
+			req.Arguments = append(req.Arguments, string(arg))
+		case num == 3 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			req.RequestID = int32(v)
+		case num == 4 && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			req.Cancel = protowire.DecodeBool(v)
+		default:
+			// inputs, verbosity and sandbox_dir are not used.
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return req, fmt.Errorf("invalid work request: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return req, nil
+}
+
+// writeWorkResponse writes the response, length delimited.
+func writeWorkResponse(w io.Writer, resp workResponse) error {
+	msg := []byte{}
+	if resp.ExitCode != 0 {
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(int64(resp.ExitCode)))
+	}
+	if resp.Output != "" {
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, resp.Output)
+	}
+	if resp.RequestID != 0 {
+		msg = protowire.AppendTag(msg, 3, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(int64(resp.RequestID)))
+	}
+	_, err := w.Write(append(protowire.AppendVarint(nil, uint64(len(msg))), msg...))
+	return err
+}
+
+// persistentWorker runs the loads of the work requests with a single loader.
+// Identical requests in flight at the same time share a single load.
+type persistentWorker struct {
+	loader *DockerLoader
+	group  singleflight.Group
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// runPersistentWorker serves work requests from in until it is closed.
+func runPersistentWorker(in io.Reader, out io.Writer) error {
+	loaderOpts, err := newDockerLoaderOpts(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	loader, err := NewDockerLoader(loaderOpts)
+	if err != nil {
+		return err
+	}
+	return (&persistentWorker{loader: loader, out: out}).serve(in)
+}
+
+// serve handles the requests read from in. Multiplex requests, which have a
+// request ID, run concurrently; singleplex ones one at a time.
+func (w *persistentWorker) serve(in io.Reader) error {
+	r := bufio.NewReader(in)
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		req, err := readWorkRequest(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Cancel {
+			// Cancellation is not supported, the request just finishes.
+			continue
+		}
+
+		if req.RequestID == 0 {
+			if err := w.respond(req); err != nil {
+				return err
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.respond(req); err != nil {
+				log.Println("Could not write work response:", err)
+			}
+		}()
+	}
+}
+
+func (w *persistentWorker) respond(req workRequest) error {
+	resp := workResponse{RequestID: req.RequestID}
+	args, err := expandArgFiles(req.Arguments)
+	if err != nil {
+		resp.ExitCode, resp.Output = 1, fmt.Sprintln("error:", err)
+	} else {
+		result, _, _ := w.group.Do(strings.Join(args, "\x00"), func() (interface{}, error) {
+			return w.handle(context.Background(), args), nil
+		})
+		shared := result.(workResponse)
+		resp.ExitCode, resp.Output = shared.ExitCode, shared.Output
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return writeWorkResponse(w.out, resp)
+}
+
+// handle runs a load with the given command line arguments, returning its
+// output and exit code. The output starts with the logs of the load, which
+// also go to the log of the worker.
+func (w *persistentWorker) handle(ctx context.Context, args []string) workResponse {
+	logs := &lockedBuffer{}
+	ctx = withLogger(ctx, log.New(io.MultiWriter(log.Writer(), logs), "", log.Flags()))
+	out := bytes.Buffer{}
+	exitCode, err := w.run(ctx, args, &out)
+	if err != nil {
+		fmt.Fprintln(&out, "error:", err)
+		exitCode = 1
+	}
+	return workResponse{ExitCode: int32(exitCode), Output: logs.String() + out.String()}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes, as the logs of a
+// load are also written by its hooks and background builds.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (w *persistentWorker) run(ctx context.Context, args []string, out io.Writer) (int, error) {
+	o := Options{}
+	flags := pflag.NewFlagSet("loader", pflag.ContinueOnError)
+	flags.SetOutput(out)
+	registerFlags(flags, &o)
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	if err := applyFlagDefaults(flags, o.ConfigFile, os.Getenv); err != nil {
+		return 0, err
+	}
+	if flags.NArg() < 1 {
+		return 0, fmt.Errorf("missing image path")
+	}
+
+	loaderOpts, err := newDockerLoaderOpts(ctx, o)
+	if err != nil {
+		return 0, err
+	}
+	loader := w.loader.WithOpts(loaderOpts)
+	image, err := OpenImage(flags.Arg(0), o.StrictManifest, o.ResolveSymlinks)
+	if err != nil {
+		return 0, err
+	}
+	repoTags := flags.Args()[1:]
+
+	if o.CheckOnly {
+		return checkOnlyExitCode(ctx, loader, image, repoTags, o, out)
+	}
+	return 0, runLoad(ctx, out, loader, image, repoTags, o)
+}
+
+// expandArgFiles replaces "@file" arguments with the lines of the file, the
+// way Bazel passes long command lines.
+func expandArgFiles(args []string) ([]string, error) {
+	expanded := []string{}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		data, err := os.ReadFile(arg[1:])
+		if err != nil {
+			return nil, fmt.Errorf("error reading arguments file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				expanded = append(expanded, line)
+			}
+		}
+	}
+	return expanded, nil
+}
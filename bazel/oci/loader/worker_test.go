@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type WorkerTestSuite struct {
+	suite.Suite
+	cli    *fakeDockerAPI
+	worker *persistentWorker
+	out    bytes.Buffer
+}
+
+func (suite *WorkerTestSuite) SetupTest() {
+	suite.cli = newFakeDockerAPI()
+	suite.out = bytes.Buffer{}
+	suite.worker = &persistentWorker{loader: newDockerLoaderWithAPI(suite.cli, DockerLoaderOpts{}), out: &suite.out}
+}
+
+// encodeWorkRequest encodes a length delimited WorkRequest, the way Bazel
+// sends them.
+func encodeWorkRequest(req workRequest) []byte {
+	msg := []byte{}
+	for _, arg := range req.Arguments {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, arg)
+	}
+	// An input, which the worker ignores.
+	input := protowire.AppendTag(nil, 1, protowire.BytesType)
+	input = protowire.AppendString(input, "image/index.json")
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, input)
+	if req.RequestID != 0 {
+		msg = protowire.AppendTag(msg, 3, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(req.RequestID))
+	}
+	return append(protowire.AppendVarint(nil, uint64(len(msg))), msg...)
+}
+
+// readWorkResponses decodes the responses written by the worker.
+func (suite *WorkerTestSuite) readWorkResponses() []workResponse {
+	r := bufio.NewReader(&suite.out)
+	responses := []workResponse{}
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return responses
+		}
+		suite.Require().NoError(err)
+		b := make([]byte, size)
+		_, err = io.ReadFull(r, b)
+		suite.Require().NoError(err)
+
+		resp := workResponse{}
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			suite.Require().Positive(n)
+			b = b[n:]
+			switch num {
+			case 1:
+				v, n := protowire.ConsumeVarint(b)
+				resp.ExitCode, b = int32(v), b[n:]
+			case 2:
+				v, n := protowire.ConsumeString(b)
+				resp.Output, b = v, b[n:]
+			case 3:
+				v, n := protowire.ConsumeVarint(b)
+				resp.RequestID, b = int32(v), b[n:]
+			default:
+				b = b[protowire.ConsumeFieldValue(num, typ, b):]
+			}
+		}
+		responses = append(responses, resp)
+	}
+}
+
+func (suite *WorkerTestSuite) TestSerializedRequests() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	in := bytes.Buffer{}
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{image.Path, "app:v1"}}))
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{"--output=digest", image.Path, "app:v1"}}))
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{"/does/not/exist", "app:v1"}}))
+
+	suite.Require().NoError(suite.worker.serve(&in))
+	responses := suite.readWorkResponses()
+	suite.Require().Len(responses, 3)
+
+	suite.Equal(int32(0), responses[0].ExitCode)
+	suite.Contains(responses[0].Output, "Tagged image with app:v1")
+	suite.Len(suite.cli.loadedTars, 1)
+
+	suite.Equal(int32(0), responses[1].ExitCode)
+	// The logs come first, the digest is the last line.
+	suite.Regexp("\nsha256:[a-f0-9]{64}\n$", responses[1].Output)
+
+	suite.Equal(int32(1), responses[2].ExitCode)
+	suite.Contains(responses[2].Output, "error:")
+}
+
+func (suite *WorkerTestSuite) TestFailedRequestHasItsLogs() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	digestFile := filepath.Join(suite.T().TempDir(), "image.digest")
+	suite.Require().NoError(writeDigestFile(digestFile, testDigest))
+	in := bytes.Buffer{}
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{"--tag-from-digest-file=" + digestFile, image.Path, "app"}, RequestID: 1}))
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{"--check-only", image.Path, "other"}, RequestID: 2}))
+
+	suite.Require().NoError(suite.worker.serve(&in))
+	outputs := map[int32]string{}
+	for _, resp := range suite.readWorkResponses() {
+		outputs[resp.RequestID] = resp.Output
+	}
+	suite.Contains(outputs[1], "Computed Image ID: "+image.Manifest.Config.Digest)
+	suite.Contains(outputs[1], "Repo tag app has no tag")
+	suite.NotContains(outputs[1], "other")
+	suite.Contains(outputs[1], "error: digest file")
+	suite.Contains(outputs[2], "Repo tag other has no tag")
+	suite.NotContains(outputs[2], "Repo tag app")
+}
+
+func (suite *WorkerTestSuite) TestMultiplexRequestsKeepTheirIDs() {
+	image := writeTestImage(suite.T(), suite.T().TempDir(), nil, testLayer{"app": "binary"})
+	in := bytes.Buffer{}
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{"--check-only", image.Path, "app:v1"}, RequestID: 7}))
+	in.Write(encodeWorkRequest(workRequest{Arguments: []string{"--unknown-flag"}, RequestID: 8}))
+
+	suite.Require().NoError(suite.worker.serve(&in))
+	exitCodes := map[int32]int32{}
+	for _, resp := range suite.readWorkResponses() {
+		exitCodes[resp.RequestID] = resp.ExitCode
+	}
+	suite.Equal(map[int32]int32{7: 1, 8: 1}, exitCodes)
+}
+
+func TestWorkerTestSuite(t *testing.T) {
+	suite.Run(t, new(WorkerTestSuite))
+}